@@ -0,0 +1,27 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+)
+
+// RequireAdmin only lets requests through to inner if they carry the
+// configured admin token as "Authorization: Bearer <token>". Admin routes are
+// disabled entirely while no adminToken is configured.
+func RequireAdmin(inner http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token := configuration.Get().AdminToken
+		if token == "" {
+			writeProblem(w, r, http.StatusForbidden, "Admin endpoints are disabled because no adminToken is configured.")
+			return
+		}
+		given, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="photopost admin"`)
+			writeProblem(w, r, http.StatusUnauthorized, "A valid admin token is required.")
+			return
+		}
+		inner(w, r)
+	}
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/mattgibbs/photopost/config"
+	"github.com/mattgibbs/photopost/controllers"
+	"github.com/mattgibbs/photopost/model"
+	"io"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// commands are run with `photopost <command> [flags] [config file]`.
+// Without a command, photopost runs the server.
+var commands = map[string]func(args []string) int{
+	"verify":         runVerify,
+	"import":         runImport,
+	"import-takeout": runImportTakeout,
+	"export":         runExport,
+	"import-archive": runImportArchive,
+	"backup":         runBackup,
+	"restore":        runRestore,
+}
+
+// loadCommandConfig loads the configuration for a command and sets up
+// human readable logging.
+func loadCommandConfig(args []string) *config.Config {
+	cfg, err := config.Load(args)
+	if errors.Is(err, flag.ErrHelp) {
+		os.Exit(0)
+	}
+	if err != nil {
+		log.Fatalf("Error: Invalid configuration.\n%s", err)
+	}
+	if err := setupLogging(os.Stderr, cfg.LogLevel, "text"); err != nil {
+		log.Fatalf("Error: Invalid logging configuration. %s", err)
+	}
+	return cfg
+}
+
+func openDatastore(cfg *config.Config) model.Datastore {
+	return model.NewSQLiteDatastore(fmt.Sprintf("%s?mode=rwc", cfg.DatabaseURL))
+}
+
+// runVerify recomputes the hash of every image and reports posts whose
+// image is missing or does not match its content addressed name.
+func runVerify(args []string) int {
+	cfg := loadCommandConfig(args)
+	ds := openDatastore(cfg)
+	defer ds.Close()
+	pc := controllers.NewPostController(ds, config.NewStore(cfg))
+	report, err := pc.VerifyImages(os.Stdout)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: Could not verify images. %s\n", err)
+		return 2
+	}
+	fmt.Printf("Checked %d images for %d posts: %d missing, %d corrupt, %d orphaned, %d stale temporary uploads.\n",
+		report.Images, report.Posts, report.Missing, report.Corrupt, report.Orphaned, report.Stale)
+	if report.Problems() > 0 {
+		return 1
+	}
+	return 0
+}
+
+// runImport creates posts for the images in a directory tree:
+//
+//	photopost import [import flags] <dir> [config flags] [config file]
+func runImport(args []string) int {
+	return runImportCommand("import", "<dir>", args, (*controllers.PostController).ImportDirectory)
+}
+
+// runImportTakeout imports a Google Takeout export, zipped or extracted:
+//
+//	photopost import-takeout [import flags] <zip or dir> [config flags] [config file]
+func runImportTakeout(args []string) int {
+	return runImportCommand("import-takeout", "<zip or dir>", args, (*controllers.PostController).ImportTakeout)
+}
+
+type importFunc func(c *controllers.PostController, ctx context.Context, source string, opts controllers.ImportOptions, out io.Writer) (controllers.ImportReport, error)
+
+// runImportCommand parses the import flags, which come before the source,
+// and the configuration, which comes after it, and runs an import.
+func runImportCommand(name string, source string, args []string, importer importFunc) int {
+	flags := flag.NewFlagSet("photopost "+name, flag.ContinueOnError)
+	opts := controllers.ImportOptions{}
+	flags.IntVar(&opts.Workers, "workers", runtime.NumCPU(), "number of images to import at once")
+	flags.BoolVar(&opts.DryRun, "dry-run", false, "report what would be imported without saving anything")
+	flags.StringVar(&opts.Duplicates, "duplicates", "reject", "what to do with duplicate images: reject, warn or allow")
+	flags.StringVar(&opts.Author, "author", "", "author of posts whose sidecar does not name one")
+	flags.StringVar(&opts.Album, "album", "", "album of posts whose sidecar does not name one")
+	flags.Func("tags", "comma separated tags added to every post", func(value string) error {
+		opts.Tags = append(opts.Tags, strings.Split(value, ",")...)
+		return nil
+	})
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: photopost %s [import flags] %s [config flags] [config file]\n", name, source)
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return 0
+		}
+		return 2
+	}
+	if flags.NArg() < 1 {
+		flags.Usage()
+		return 2
+	}
+	cfg := loadCommandConfig(flags.Args()[1:])
+	ds := openDatastore(cfg)
+	defer ds.Close()
+	pc := controllers.NewPostController(ds, config.NewStore(cfg))
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	report, err := importer(pc, ctx, flags.Arg(0), opts, os.Stdout)
+	note := ""
+	if report.Resumed > 0 {
+		note += fmt.Sprintf(" %d already imported by an earlier run.", report.Resumed)
+	}
+	if opts.DryRun {
+		note += " Dry run, nothing was saved."
+	}
+	fmt.Printf("Imported %d files: %d created, %d duplicates, %d skipped, %d failed.%s\n",
+		report.Files, report.Created, report.Duplicates, report.Skipped, report.Failed, note)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: Import stopped. %s\n", err)
+		return 2
+	}
+	if report.Failed > 0 {
+		return 1
+	}
+	return 0
+}
+
+// runExport writes an export archive of every post and image:
+//
+//	photopost export [-o file] [config flags] [config file]
+func runExport(args []string) int {
+	flags := flag.NewFlagSet("photopost export", flag.ContinueOnError)
+	output := flags.String("o", "", "file to write the archive to (default photopost-export-<time>.zip)")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: photopost export [-o file] [config flags] [config file]")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return 0
+		}
+		return 2
+	}
+	cfg := loadCommandConfig(flags.Args())
+	ds := openDatastore(cfg)
+	defer ds.Close()
+	pc := controllers.NewPostController(ds, config.NewStore(cfg))
+	if *output == "" {
+		*output = fmt.Sprintf("photopost-export-%s.zip", time.Now().UTC().Format("20060102-150405"))
+	}
+
+	// Write to a temporary file so that a failed export leaves nothing that
+	// looks like a finished archive.
+	tmp, err := os.CreateTemp(filepath.Dir(*output), ".photopost-export-*")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: Could not create export. %s\n", err)
+		return 2
+	}
+	defer os.Remove(tmp.Name())
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	report, err := pc.ExportArchive(ctx, tmp)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), *output)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: Could not export. %s\n", err)
+		return 2
+	}
+	fmt.Printf("Exported %d posts and %d images to %s.\n", report.Posts, report.Images, *output)
+	return 0
+}
+
+// runImportArchive restores an export archive into an empty (or at least
+// non-overlapping) library:
+//
+//	photopost import-archive <archive> [config flags] [config file]
+func runImportArchive(args []string) int {
+	if len(args) < 1 || strings.HasPrefix(args[0], "-") {
+		fmt.Fprintln(os.Stderr, "Usage: photopost import-archive <archive> [config flags] [config file]")
+		return 2
+	}
+	cfg := loadCommandConfig(args[1:])
+	ds := openDatastore(cfg)
+	defer ds.Close()
+	pc := controllers.NewPostController(ds, config.NewStore(cfg))
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	report, err := pc.ImportArchive(ctx, args[0])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: Could not import %s, nothing was restored. %s\n", args[0], err)
+		return 2
+	}
+	fmt.Printf("Restored %d posts and %d images (%d images were already present).\n", report.Posts, report.Images, report.ExistingFiles)
+	return 0
+}
+
+// runBackup takes a snapshot of the database and uploads in backupDir, and
+// removes the oldest snapshots beyond backupKeep. It is safe to run while the
+// server is running:
+//
+//	photopost backup [config flags] [config file]
+func runBackup(args []string) int {
+	cfg := loadCommandConfig(args)
+	if cfg.BackupDir == "" {
+		fmt.Fprintln(os.Stderr, "Error: No backupDir is configured.")
+		return 2
+	}
+	ds := openDatastore(cfg)
+	defer ds.Close()
+	bc := controllers.NewBackupController(ds, config.NewStore(cfg))
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	report, err := bc.Backup(ctx)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: Could not back up. %s\n", err)
+		return 2
+	}
+	fmt.Printf("Backed up to %s: %d images, %d copied and %d unchanged since the last backup.\n",
+		report.Snapshot, report.Images, report.Copied, report.Linked)
+	if len(report.Missing) > 0 {
+		fmt.Printf("%d images were deleted during the backup and are not in it.\n", len(report.Missing))
+	}
+	if len(report.Removed) > 0 {
+		fmt.Printf("Removed %d old backups.\n", len(report.Removed))
+	}
+	return 0
+}
+
+// runRestore replaces the database with the one in a backup snapshot, given
+// as a path or as a snapshot name in backupDir, and copies back any missing
+// images. The server must be stopped first:
+//
+//	photopost restore <snapshot> [config flags] [config file]
+func runRestore(args []string) int {
+	if len(args) < 1 || strings.HasPrefix(args[0], "-") {
+		fmt.Fprintln(os.Stderr, "Usage: photopost restore <snapshot> [config flags] [config file]")
+		return 2
+	}
+	cfg := loadCommandConfig(args[1:])
+	snapshot := args[0]
+	if _, err := os.Stat(snapshot); os.IsNotExist(err) && cfg.BackupDir != "" && !strings.ContainsRune(snapshot, filepath.Separator) {
+		snapshot = filepath.Join(cfg.BackupDir, snapshot)
+	}
+	report, err := controllers.RestoreBackup(snapshot, cfg.DatabaseURL, cfg.UploadsPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: Could not restore %s. %s\n", snapshot, err)
+		if report.SavedDatabase != "" {
+			fmt.Fprintf(os.Stderr, "The previous database was moved to %s.\n", report.SavedDatabase)
+		}
+		return 2
+	}
+	fmt.Printf("Restored %s (schema version %d): %d images, %d copied back.\n", snapshot, report.SchemaVersion, report.Images, report.Copied)
+	if report.SavedDatabase != "" {
+		fmt.Printf("The previous database was kept as %s.\n", report.SavedDatabase)
+	}
+	return 0
+}
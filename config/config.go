@@ -3,25 +3,162 @@ package config
 import (
 	"encoding/json"
 	"fmt"
-	"os"
+	"time"
 )
 
+// Config holds every photopost setting. Each field can be set, in increasing
+// order of precedence, by Default, the config file (using the json key), a
+// PHOTOPOST_* environment variable and a command line flag. See load.go.
+//
+// Fields tagged redact:"true" are replaced with "[REDACTED]" when logged.
+// Fields tagged reload:"restart" are not applied when the configuration is
+// reloaded while the server is running.
 type Config struct {
-	DatabaseURL string `json:"databaseURL"`
-	UploadsPath string `json:"uploadsPath"`
-	Port        string `json:"port"`
-	Production  bool   `json:"production"`
+	DatabaseURL     string   `json:"databaseURL" reload:"restart"`
+	UploadsPath     string   `json:"uploadsPath" reload:"restart"`
+	Port            string   `json:"port" reload:"restart"`
+	Production      bool     `json:"production"`
+	ReadTimeout     Duration `json:"readTimeout" reload:"restart"`
+	WriteTimeout    Duration `json:"writeTimeout" reload:"restart"`
+	IdleTimeout     Duration `json:"idleTimeout" reload:"restart"`
+	ShutdownTimeout Duration `json:"shutdownTimeout"`
+	LogLevel        string   `json:"logLevel"`
+	LogFormat       string   `json:"logFormat"`
+	// TrustedProxies are the addresses or CIDR ranges of reverse proxies
+	// whose X-Forwarded-For headers are believed.
+	TrustedProxies    []string `json:"trustedProxies"`
+	SlideshowInterval Duration `json:"slideshowInterval"`
+	AdminToken        string   `json:"adminToken" redact:"true"`
+	MaxUploadBytes    int64    `json:"maxUploadBytes"`
+	MaxPixels         int64    `json:"maxPixels"`
+	AllowedTypes      []string `json:"allowedTypes"`
+	MaxBatchFiles     int      `json:"maxBatchFiles"`
+	MaxBatchBytes     int64    `json:"maxBatchBytes"`
+
+	DuplicatePolicy       string `json:"duplicatePolicy"`
+	NearDuplicateDistance int    `json:"nearDuplicateDistance"`
+
+	ResumableUploadExpiry Duration `json:"resumableUploadExpiry"`
+
+	BackupDir      string   `json:"backupDir"`
+	BackupInterval Duration `json:"backupInterval"`
+	BackupKeep     int      `json:"backupKeep"`
+
+	WatchDirs    []string `json:"watchDirs" reload:"restart"`
+	WatchAction  string   `json:"watchAction"`
+	WatchSettle  Duration `json:"watchSettle"`
+	WatchRetries int      `json:"watchRetries"`
+	WatchAuthor  string   `json:"watchAuthor"`
+	WatchAlbum   string   `json:"watchAlbum"`
+
+	MailSenders    map[string]string `json:"mailSenders"`
+	MaxMailBytes   int64             `json:"maxMailBytes"`
+	SMTPAddr       string            `json:"smtpAddr" reload:"restart"`
+	SMTPHostname   string            `json:"smtpHostname" reload:"restart"`
+	SMTPRecipients []string          `json:"smtpRecipients"`
+
+	IMAPURL             string   `json:"imapURL"`
+	IMAPUsername        string   `json:"imapUsername"`
+	IMAPPassword        string   `json:"imapPassword" redact:"true"`
+	IMAPInterval        Duration `json:"imapInterval"`
+	IMAPDoneMailbox     string   `json:"imapDoneMailbox"`
+	IMAPRejectedMailbox string   `json:"imapRejectedMailbox"`
+
+	RandomFavoriteTag    string   `json:"randomFavoriteTag"`
+	RandomFavoriteWeight int      `json:"randomFavoriteWeight"`
+	RandomRecentWeight   int      `json:"randomRecentWeight"`
+	RandomRecentWithin   Duration `json:"randomRecentWithin"`
+	RandomUnseenWeight   int      `json:"randomUnseenWeight"`
+	RandomClientExpiry   Duration `json:"randomClientExpiry"`
+
+	TimeZone           string `json:"timeZone"`
+	MemoriesWindowDays int    `json:"memoriesWindowDays"`
 }
 
-func LoadConfig(file string) (*Config, error) {
-	var config Config
-	configFile, err := os.Open(file)
-	defer configFile.Close()
-	if err != nil {
-		fmt.Println(err.Error())
-		return nil, err
+// Duration is a time.Duration that is written as a string ("30s", "5m") in
+// config files.
+type Duration time.Duration
+
+func (d Duration) Duration() time.Duration {
+	return time.Duration(d)
+}
+
+func (d Duration) String() string {
+	return time.Duration(d).String()
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var v interface{}
+	if err := json.Unmarshal(b, &v); err != nil {
+		return err
 	}
-	jsonParser := json.NewDecoder(configFile)
-	jsonParser.Decode(&config)
-	return &config, nil
+	switch value := v.(type) {
+	case float64:
+		*d = Duration(time.Duration(value) * time.Second)
+	case string:
+		parsed, err := time.ParseDuration(value)
+		if err != nil {
+			return err
+		}
+		*d = Duration(parsed)
+	default:
+		return fmt.Errorf("invalid duration %s", string(b))
+	}
+	return nil
+}
+
+// Default returns the configuration used for any setting that is not present
+// in the config file, environment or flags.
+func Default() Config {
+	return Config{
+		DatabaseURL:       "photopost.db",
+		UploadsPath:       "uploads",
+		Port:              "8080",
+		ReadTimeout:       Duration(5 * time.Minute),
+		WriteTimeout:      Duration(5 * time.Minute),
+		IdleTimeout:       Duration(2 * time.Minute),
+		ShutdownTimeout:   Duration(30 * time.Second),
+		LogLevel:          "info",
+		LogFormat:         "json",
+		SlideshowInterval: Duration(10 * time.Second),
+		MaxUploadBytes:    50 << 20,
+		MaxPixels:         50000000,
+		AllowedTypes:      []string{"image/jpeg", "image/gif", "image/png"},
+		MaxBatchFiles:     50,
+		MaxBatchBytes:     500 << 20,
+
+		DuplicatePolicy:       "warn",
+		NearDuplicateDistance: 6,
+
+		ResumableUploadExpiry: Duration(24 * time.Hour),
+
+		BackupKeep: 7,
+
+		WatchAction:  "move",
+		WatchSettle:  Duration(5 * time.Second),
+		WatchRetries: 3,
+
+		MaxMailBytes: 100 << 20,
+		SMTPHostname: "photopost",
+
+		IMAPInterval:    Duration(time.Minute),
+		IMAPDoneMailbox: "Photopost",
+
+		RandomFavoriteTag:  "favorite",
+		RandomRecentWithin: Duration(30 * 24 * time.Hour),
+		RandomClientExpiry: Duration(30 * 24 * time.Hour),
+
+		TimeZone:           "Local",
+		MemoriesWindowDays: 3,
+	}
+}
+
+// LoadConfig reads file on top of the defaults and applies any PHOTOPOST_*
+// environment variables. Use Load to also apply command line flags.
+func LoadConfig(file string) (*Config, error) {
+	return Load([]string{"-config", file})
 }
@@ -0,0 +1,263 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+const EnvPrefix = "PHOTOPOST_"
+
+var durationType = reflect.TypeOf(Duration(0))
+
+// Load builds the configuration from, in increasing order of precedence:
+// Default, the config file, PHOTOPOST_* environment variables and the
+// command line flags in args. The config file is given with -config, as the
+// only positional argument, after the flags, or with PHOTOPOST_CONFIG.
+//
+// Every setting has a flag and an environment variable derived from its
+// config file key, e.g. uploadsPath is -uploads-path and
+// PHOTOPOST_UPLOADS_PATH.
+func Load(args []string) (*Config, error) {
+	config, _, err := LoadWithFile(args)
+	return config, err
+}
+
+// LoadWithFile is Load, but also returns the path of the config file that was
+// read (empty if there was none) so it can be watched for changes.
+func LoadWithFile(args []string) (*Config, string, error) {
+	config := Default()
+	fields := settableFields(&config)
+
+	flags := flag.NewFlagSet("photopost", flag.ContinueOnError)
+	file := flags.String("config", os.Getenv(EnvPrefix+"CONFIG"), "path to a JSON, YAML or TOML config file")
+	flagValues := map[string]string{}
+	for _, f := range fields {
+		key := f.key
+		flags.Func(f.flagName(), fmt.Sprintf("%s (env %s)", key, f.envName()), func(value string) error {
+			flagValues[key] = value
+			return nil
+		})
+	}
+	if err := flags.Parse(args); err != nil {
+		return nil, "", err
+	}
+	// Flags stop at the first argument that is not one, so anything after
+	// the config file would otherwise be silently ignored.
+	if flags.NArg() > 1 {
+		return nil, "", fmt.Errorf("unexpected arguments after the config file %s: %s (flags must come before it)", flags.Arg(0), strings.Join(flags.Args()[1:], " "))
+	}
+	if flags.NArg() == 1 {
+		configFlag := false
+		flags.Visit(func(f *flag.Flag) { configFlag = configFlag || f.Name == "config" })
+		if configFlag {
+			return nil, "", fmt.Errorf("the config file is given both with -config and as %s", flags.Arg(0))
+		}
+		*file = flags.Arg(0)
+	}
+
+	if *file != "" {
+		if err := decodeFile(*file, &config); err != nil {
+			return nil, "", fmt.Errorf("config file %s: %w", *file, err)
+		}
+	}
+	var errs []error
+	for _, f := range fields {
+		if value, ok := os.LookupEnv(f.envName()); ok {
+			if err := setFromString(f.value, value); err != nil {
+				errs = append(errs, fmt.Errorf("environment variable %s: %w", f.envName(), err))
+			}
+		}
+	}
+	for _, f := range fields {
+		if value, ok := flagValues[f.key]; ok {
+			if err := setFromString(f.value, value); err != nil {
+				errs = append(errs, fmt.Errorf("flag -%s: %w", f.flagName(), err))
+			}
+		}
+	}
+	if len(errs) > 0 {
+		return nil, "", errors.Join(errs...)
+	}
+	if err := config.Validate(); err != nil {
+		return nil, "", err
+	}
+	return &config, *file, nil
+}
+
+// decodeFile strictly decodes a JSON, YAML or TOML file into config. YAML
+// and TOML are converted to JSON first so that every format shares the json
+// keys and reports unknown keys the same way.
+func decodeFile(file string, config *Config) error {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	switch strings.ToLower(filepath.Ext(file)) {
+	case ".json":
+	case ".yaml", ".yml":
+		var values map[string]interface{}
+		if err := yaml.Unmarshal(data, &values); err != nil {
+			return err
+		}
+		if data, err = json.Marshal(values); err != nil {
+			return err
+		}
+	case ".toml":
+		var values map[string]interface{}
+		if _, err := toml.Decode(string(data), &values); err != nil {
+			return err
+		}
+		if data, err = json.Marshal(values); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unknown config file format %q, expected .json, .yaml, .yml or .toml", filepath.Ext(file))
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(config); err != nil {
+		// encoding/json reports unknown keys as `json: unknown field "x"`.
+		return errors.New(strings.TrimPrefix(err.Error(), "json: "))
+	}
+	return nil
+}
+
+type field struct {
+	key   string
+	value reflect.Value
+	tag   reflect.StructTag
+}
+
+func (f field) envName() string {
+	return EnvPrefix + strings.ToUpper(strings.ReplaceAll(splitWords(f.key), "-", "_"))
+}
+
+func (f field) flagName() string {
+	return splitWords(f.key)
+}
+
+// settableFields lists every leaf setting in config, keyed by its json key.
+// Settings in nested structs get dotted keys ("smtp.listen").
+func settableFields(config *Config) []field {
+	return collectFields(reflect.ValueOf(config).Elem(), "")
+}
+
+func collectFields(v reflect.Value, prefix string) []field {
+	var fields []field
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		key := strings.Split(sf.Tag.Get("json"), ",")[0]
+		if key == "" || key == "-" {
+			continue
+		}
+		if prefix != "" {
+			key = prefix + "." + key
+		}
+		fv := v.Field(i)
+		if fv.Kind() == reflect.Struct && fv.Type() != durationType {
+			fields = append(fields, collectFields(fv, key)...)
+			continue
+		}
+		fields = append(fields, field{key: key, value: fv, tag: sf.Tag})
+	}
+	return fields
+}
+
+// splitWords turns a json key like "databaseURL" or "smtp.maxSize" into
+// "database-url" or "smtp-max-size".
+func splitWords(key string) string {
+	var b strings.Builder
+	runes := []rune(key)
+	for i, r := range runes {
+		switch {
+		case r == '.':
+			b.WriteRune('-')
+		case unicode.IsUpper(r):
+			prevLower := i > 0 && unicode.IsLower(runes[i-1])
+			nextLower := i+1 < len(runes) && unicode.IsLower(runes[i+1]) && i > 0 && unicode.IsUpper(runes[i-1])
+			if prevLower || nextLower {
+				b.WriteRune('-')
+			}
+			b.WriteRune(unicode.ToLower(r))
+		default:
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+func setFromString(v reflect.Value, s string) error {
+	if v.Type() == durationType {
+		var d Duration
+		if err := d.UnmarshalJSON([]byte(strconv.Quote(s))); err != nil {
+			return err
+		}
+		v.Set(reflect.ValueOf(d))
+		return nil
+	}
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(s)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return fmt.Errorf("%q is not a boolean", s)
+		}
+		v.SetBool(b)
+	case reflect.Int, reflect.Int64:
+		n, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return fmt.Errorf("%q is not an integer", s)
+		}
+		v.SetInt(n)
+	case reflect.Float64:
+		n, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return fmt.Errorf("%q is not a number", s)
+		}
+		v.SetFloat(n)
+	case reflect.Slice:
+		if v.Type().Elem().Kind() != reflect.String {
+			return fmt.Errorf("unsupported setting type %s", v.Type())
+		}
+		var items []string
+		for _, item := range strings.Split(s, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
+		}
+		v.Set(reflect.ValueOf(items))
+	case reflect.Map:
+		// Maps are written as key=value pairs separated by commas.
+		if v.Type().Key().Kind() != reflect.String || v.Type().Elem().Kind() != reflect.String {
+			return fmt.Errorf("unsupported setting type %s", v.Type())
+		}
+		m := reflect.MakeMap(v.Type())
+		for _, pair := range strings.Split(s, ",") {
+			if pair = strings.TrimSpace(pair); pair == "" {
+				continue
+			}
+			k, val, ok := strings.Cut(pair, "=")
+			if !ok {
+				return fmt.Errorf("%q is not a key=value pair", pair)
+			}
+			m.SetMapIndex(reflect.ValueOf(strings.TrimSpace(k)), reflect.ValueOf(strings.TrimSpace(val)))
+		}
+		v.Set(m)
+	default:
+		return fmt.Errorf("unsupported setting type %s", v.Type())
+	}
+	return nil
+}
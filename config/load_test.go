@@ -0,0 +1,119 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeConfig writes a config file named name into a new directory, with
+// uploadsPath set to that directory so that it is valid.
+func writeConfig(t *testing.T, name string, format string) string {
+	t.Helper()
+	dir := t.TempDir()
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, []byte(strings.ReplaceAll(format, "UPLOADS", dir)), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadPrecedence(t *testing.T) {
+	file := writeConfig(t, "photopost.json", `{"uploadsPath": "UPLOADS", "port": "9001", "logLevel": "warn", "adminToken": "from-file"}`)
+	t.Setenv("PHOTOPOST_PORT", "9002")
+	t.Setenv("PHOTOPOST_LOG_LEVEL", "debug")
+
+	cfg, path, err := LoadWithFile([]string{"-port", "9003", file})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if path != file {
+		t.Errorf("config file = %q, want %q", path, file)
+	}
+	// The flag beats the environment, which beats the file, which beats
+	// the default.
+	if cfg.Port != "9003" {
+		t.Errorf("port = %s, want the flag's 9003", cfg.Port)
+	}
+	if cfg.LogLevel != "debug" {
+		t.Errorf("logLevel = %s, want the environment's debug", cfg.LogLevel)
+	}
+	if cfg.AdminToken != "from-file" {
+		t.Errorf("adminToken = %q, want the file's", cfg.AdminToken)
+	}
+	if cfg.SlideshowInterval != Default().SlideshowInterval {
+		t.Errorf("slideshowInterval = %s, want the default", cfg.SlideshowInterval)
+	}
+}
+
+func TestLoadConfigFromEnvironment(t *testing.T) {
+	file := writeConfig(t, "photopost.json", `{"uploadsPath": "UPLOADS", "port": "9001"}`)
+	t.Setenv("PHOTOPOST_CONFIG", file)
+	cfg, err := Load(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Port != "9001" {
+		t.Errorf("port = %s, want 9001 from PHOTOPOST_CONFIG's file", cfg.Port)
+	}
+}
+
+func TestLoadFormats(t *testing.T) {
+	for _, tt := range []struct {
+		name   string
+		format string
+	}{
+		{"photopost.json", `{"uploadsPath": "UPLOADS", "port": "9001", "imapInterval": "90s", "allowedTypes": ["image/png"], "mailSenders": {"alice@example.com": "Alice"}}`},
+		{"photopost.yaml", "uploadsPath: UPLOADS\nport: \"9001\"\nimapInterval: 90s\nallowedTypes:\n  - image/png\nmailSenders:\n  alice@example.com: Alice\n"},
+		{"photopost.toml", "uploadsPath = \"UPLOADS\"\nport = \"9001\"\nimapInterval = \"90s\"\nallowedTypes = [\"image/png\"]\n\n[mailSenders]\n\"alice@example.com\" = \"Alice\"\n"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, err := Load([]string{writeConfig(t, tt.name, tt.format)})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cfg.Port != "9001" || cfg.IMAPInterval != Duration(90*time.Second) {
+				t.Errorf("port = %s, imapInterval = %s", cfg.Port, cfg.IMAPInterval)
+			}
+			if len(cfg.AllowedTypes) != 1 || cfg.AllowedTypes[0] != "image/png" {
+				t.Errorf("allowedTypes = %v", cfg.AllowedTypes)
+			}
+			if cfg.MailSenders["alice@example.com"] != "Alice" {
+				t.Errorf("mailSenders = %v", cfg.MailSenders)
+			}
+		})
+	}
+}
+
+func TestLoadUnknownKeys(t *testing.T) {
+	for _, tt := range []struct {
+		name   string
+		format string
+	}{
+		{"photopost.json", `{"uploadsPath": "UPLOADS", "uploadPath": "/tmp"}`},
+		{"photopost.yaml", "uploadsPath: UPLOADS\nuploadPath: /tmp\n"},
+		{"photopost.toml", "uploadsPath = \"UPLOADS\"\nuploadPath = \"/tmp\"\n"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Load([]string{writeConfig(t, tt.name, tt.format)})
+			if err == nil || !strings.Contains(err.Error(), `"uploadPath"`) {
+				t.Errorf("Load = %v, want an error naming the unknown key", err)
+			}
+		})
+	}
+}
+
+func TestLoadRejectsExtraArguments(t *testing.T) {
+	file := writeConfig(t, "photopost.json", `{"uploadsPath": "UPLOADS"}`)
+	for _, args := range [][]string{
+		{file, "-port", "9000"},
+		{file, "other.json"},
+		{"-config", file, "other.json"},
+	} {
+		if _, err := Load(args); err == nil {
+			t.Errorf("Load(%q) succeeded, want the arguments after the flags refused", args)
+		}
+	}
+}
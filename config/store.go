@@ -0,0 +1,58 @@
+package config
+
+import (
+	"reflect"
+	"sync/atomic"
+)
+
+// Store holds the live configuration. Readers call Get for every request so
+// that a reload is picked up without locking; a reload swaps in a complete
+// new Config with Set.
+type Store struct {
+	current atomic.Pointer[Config]
+}
+
+func NewStore(c *Config) *Store {
+	s := new(Store)
+	s.Set(c)
+	return s
+}
+
+func (s *Store) Get() *Config {
+	return s.current.Load()
+}
+
+func (s *Store) Set(c *Config) {
+	s.current.Store(c)
+}
+
+// Diff compares two configurations and returns the keys of the settings
+// that changed, split into those that can be applied to a running server and
+// those (tagged reload:"restart") that only take effect after a restart.
+func Diff(old *Config, new *Config) (applied []string, restart []string) {
+	oldCopy, newCopy := *old, *new
+	oldFields := settableFields(&oldCopy)
+	newFields := settableFields(&newCopy)
+	for i, f := range newFields {
+		if reflect.DeepEqual(f.value.Interface(), oldFields[i].value.Interface()) {
+			continue
+		}
+		if f.tag.Get("reload") == "restart" {
+			restart = append(restart, f.key)
+		} else {
+			applied = append(applied, f.key)
+		}
+	}
+	return applied, restart
+}
+
+// KeepRestartSettings copies every setting that needs a restart from old
+// into new, so the running server keeps using the values it started with.
+func KeepRestartSettings(old *Config, new *Config) {
+	oldFields := settableFields(old)
+	for i, f := range settableFields(new) {
+		if f.tag.Get("reload") == "restart" {
+			f.value.Set(oldFields[i].value)
+		}
+	}
+}
@@ -0,0 +1,215 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/mail"
+	"net/netip"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ImageTypes are the image types photopost has decoders for, which are the
+// only ones allowedTypes may list: every upload is decoded to check its
+// dimensions and hash it. The decoders are registered in controllers.
+var ImageTypes = []string{"image/jpeg", "image/gif", "image/png"}
+
+// maxMemoriesWindowDays keeps the days around a date that memories can fall
+// back to well short of half a year, so that the windows of neighbouring
+// years do not overlap.
+const maxMemoriesWindowDays = 30
+
+// ParseTrustedProxy reads an entry of trustedProxies, which is an IP
+// address or a CIDR range such as 10.0.0.0/8.
+func ParseTrustedProxy(proxy string) (netip.Prefix, error) {
+	if strings.Contains(proxy, "/") {
+		prefix, err := netip.ParsePrefix(proxy)
+		return prefix.Masked(), err
+	}
+	addr, err := netip.ParseAddr(proxy)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	addr = addr.Unmap()
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
+
+// Validate reports every problem with the configuration at once.
+func (c *Config) Validate() error {
+	var errs []error
+	port, err := strconv.Atoi(c.Port)
+	if err != nil || port < 1 || port > 65535 {
+		errs = append(errs, fmt.Errorf("port: %q is not a port number between 1 and 65535", c.Port))
+	}
+	if c.DatabaseURL == "" {
+		errs = append(errs, errors.New("databaseURL: must be set"))
+	}
+	if c.UploadsPath == "" {
+		errs = append(errs, errors.New("uploadsPath: must be set"))
+	} else if info, err := os.Stat(c.UploadsPath); err != nil {
+		errs = append(errs, fmt.Errorf("uploadsPath: %w", err))
+	} else if !info.IsDir() {
+		errs = append(errs, fmt.Errorf("uploadsPath: %s is not a directory", c.UploadsPath))
+	}
+	for name, d := range map[string]Duration{
+		"readTimeout":     c.ReadTimeout,
+		"writeTimeout":    c.WriteTimeout,
+		"idleTimeout":     c.IdleTimeout,
+		"shutdownTimeout": c.ShutdownTimeout,
+	} {
+		if d < 0 {
+			errs = append(errs, fmt.Errorf("%s: must not be negative", name))
+		}
+	}
+	if c.SlideshowInterval < Duration(time.Second) {
+		errs = append(errs, errors.New("slideshowInterval: must be at least 1s"))
+	}
+	if c.MaxUploadBytes <= 0 {
+		errs = append(errs, errors.New("maxUploadBytes: must be greater than 0"))
+	}
+	if c.MaxPixels <= 0 {
+		errs = append(errs, errors.New("maxPixels: must be greater than 0"))
+	}
+	if c.MaxBatchFiles <= 0 {
+		errs = append(errs, errors.New("maxBatchFiles: must be greater than 0"))
+	}
+	if c.MaxBatchBytes < c.MaxUploadBytes {
+		errs = append(errs, errors.New("maxBatchBytes: must be at least maxUploadBytes"))
+	}
+	if len(c.AllowedTypes) == 0 {
+		errs = append(errs, errors.New("allowedTypes: at least one image type must be allowed"))
+	}
+	for _, t := range c.AllowedTypes {
+		if !slices.Contains(ImageTypes, t) {
+			errs = append(errs, fmt.Errorf("allowedTypes: %q is not one of %s", t, strings.Join(ImageTypes, ", ")))
+		}
+	}
+	if c.ResumableUploadExpiry < Duration(time.Minute) {
+		errs = append(errs, errors.New("resumableUploadExpiry: must be at least 1m"))
+	}
+	switch c.DuplicatePolicy {
+	case "reject", "warn", "allow":
+	default:
+		errs = append(errs, fmt.Errorf("duplicatePolicy: %q is not one of reject, warn or allow", c.DuplicatePolicy))
+	}
+	if c.NearDuplicateDistance < 0 || c.NearDuplicateDistance > 64 {
+		errs = append(errs, errors.New("nearDuplicateDistance: must be between 0 and 64"))
+	}
+	if c.BackupInterval != 0 && c.BackupInterval < Duration(time.Minute) {
+		errs = append(errs, errors.New("backupInterval: must be 0 (no scheduled backups) or at least 1m"))
+	}
+	if c.BackupInterval != 0 && c.BackupDir == "" {
+		errs = append(errs, errors.New("backupDir: must be set for scheduled backups"))
+	}
+	if c.BackupKeep < 1 {
+		errs = append(errs, errors.New("backupKeep: must be at least 1"))
+	}
+	switch c.WatchAction {
+	case "move", "delete", "leave":
+	default:
+		errs = append(errs, fmt.Errorf("watchAction: %q is not one of move, delete or leave", c.WatchAction))
+	}
+	for _, dir := range c.WatchDirs {
+		if info, err := os.Stat(dir); err != nil {
+			errs = append(errs, fmt.Errorf("watchDirs: %w", err))
+		} else if !info.IsDir() {
+			errs = append(errs, fmt.Errorf("watchDirs: %s is not a directory", dir))
+		}
+	}
+	if len(c.WatchDirs) > 0 && c.WatchAuthor == "" {
+		errs = append(errs, errors.New("watchAuthor: must be set when watchDirs is"))
+	}
+	if c.WatchSettle < Duration(time.Second) {
+		errs = append(errs, errors.New("watchSettle: must be at least 1s"))
+	}
+	if c.WatchRetries < 0 {
+		errs = append(errs, errors.New("watchRetries: must not be negative"))
+	}
+	for address := range c.MailSenders {
+		if _, err := mail.ParseAddress(address); err != nil {
+			errs = append(errs, fmt.Errorf("mailSenders: %q is not an email address", address))
+		}
+	}
+	if c.MaxMailBytes <= 0 {
+		errs = append(errs, errors.New("maxMailBytes: must be greater than 0"))
+	}
+	if c.SMTPAddr != "" {
+		if _, _, err := net.SplitHostPort(c.SMTPAddr); err != nil {
+			errs = append(errs, fmt.Errorf("smtpAddr: %q is not a host:port address", c.SMTPAddr))
+		}
+		if len(c.MailSenders) == 0 {
+			errs = append(errs, errors.New("mailSenders: must list at least one sender when smtpAddr is set"))
+		}
+	}
+	if c.IMAPURL != "" {
+		if u, err := url.Parse(c.IMAPURL); err != nil || (u.Scheme != "imaps" && u.Scheme != "imap") || u.Host == "" {
+			errs = append(errs, fmt.Errorf("imapURL: %q is not an imaps:// or imap:// URL", c.IMAPURL))
+		}
+		if c.IMAPUsername == "" {
+			errs = append(errs, errors.New("imapUsername: must be set when imapURL is"))
+		}
+		if c.IMAPDoneMailbox == "" {
+			errs = append(errs, errors.New("imapDoneMailbox: must be set when imapURL is"))
+		}
+		if len(c.MailSenders) == 0 {
+			errs = append(errs, errors.New("mailSenders: must list at least one sender when imapURL is set"))
+		}
+	}
+	if c.IMAPInterval < Duration(10*time.Second) {
+		errs = append(errs, errors.New("imapInterval: must be at least 10s"))
+	}
+	for name, weight := range map[string]int{
+		"randomFavoriteWeight": c.RandomFavoriteWeight,
+		"randomRecentWeight":   c.RandomRecentWeight,
+		"randomUnseenWeight":   c.RandomUnseenWeight,
+	} {
+		if weight < 0 || weight > 10 {
+			errs = append(errs, fmt.Errorf("%s: must be between 0 and 10", name))
+		}
+	}
+	if c.RandomRecentWithin < Duration(time.Hour) {
+		errs = append(errs, errors.New("randomRecentWithin: must be at least 1h"))
+	}
+	if c.RandomClientExpiry < Duration(time.Hour) {
+		errs = append(errs, errors.New("randomClientExpiry: must be at least 1h"))
+	}
+	if _, err := time.LoadLocation(c.TimeZone); err != nil {
+		errs = append(errs, fmt.Errorf("timeZone: %q is not a known time zone", c.TimeZone))
+	}
+	if c.MemoriesWindowDays < 0 || c.MemoriesWindowDays > maxMemoriesWindowDays {
+		errs = append(errs, fmt.Errorf("memoriesWindowDays: must be between 0 and %d", maxMemoriesWindowDays))
+	}
+	for _, proxy := range c.TrustedProxies {
+		if _, err := ParseTrustedProxy(proxy); err != nil {
+			errs = append(errs, fmt.Errorf("trustedProxies: %q is not an IP address or CIDR range", proxy))
+		}
+	}
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(c.LogLevel)); err != nil {
+		errs = append(errs, fmt.Errorf("logLevel: %q is not one of debug, info, warn or error", c.LogLevel))
+	}
+	if format := strings.ToLower(c.LogFormat); format != "json" && format != "text" {
+		errs = append(errs, fmt.Errorf("logFormat: %q is not one of json or text", c.LogFormat))
+	}
+	return errors.Join(errs...)
+}
+
+// LogValue logs the configuration with sensitive settings redacted.
+func (c *Config) LogValue() slog.Value {
+	copy := *c
+	var attrs []slog.Attr
+	for _, f := range settableFields(&copy) {
+		if f.tag.Get("redact") == "true" && !f.value.IsZero() {
+			attrs = append(attrs, slog.String(f.key, "[REDACTED]"))
+			continue
+		}
+		attrs = append(attrs, slog.Any(f.key, f.value.Interface()))
+	}
+	return slog.GroupValue(attrs...)
+}
@@ -0,0 +1,19 @@
+package config
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidateAllowedTypesNeedDecoders(t *testing.T) {
+	c := Default()
+	c.UploadsPath = t.TempDir()
+	if err := c.Validate(); err != nil {
+		t.Fatalf("default configuration is invalid: %v", err)
+	}
+	c.AllowedTypes = []string{"image/jpeg", "image/webp"}
+	err := c.Validate()
+	if err == nil || !strings.Contains(err.Error(), `allowedTypes: "image/webp"`) {
+		t.Fatalf("Validate() = %v, want an allowedTypes error for image/webp", err)
+	}
+}
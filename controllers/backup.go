@@ -0,0 +1,406 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/mattgibbs/photopost/config"
+	"github.com/mattgibbs/photopost/model"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A backup is a snapshot directory in the backup directory, named after the
+// time it was taken, holding a copy of the database, the images its posts
+// refer to under uploads/, and backup.json. Snapshots are written under a
+// ".partial-" name and renamed once complete, so a snapshot that is there is
+// whole. Images that have not changed since the previous snapshot are hard
+// linked to it rather than copied, since their names are their content.
+const (
+	backupStampFormat  = "20060102-150405"
+	backupPartial      = ".partial-"
+	backupDatabaseFile = "photopost.db"
+	backupUploadsDir   = "uploads"
+	backupManifestFile = "backup.json"
+)
+
+// BackupManifest is written to backup.json in each snapshot.
+type BackupManifest struct {
+	Created       time.Time `json:"created"`
+	SchemaVersion int       `json:"schemaVersion"`
+	Images        int       `json:"images"`
+	Linked        int       `json:"linked"`
+	Missing       []string  `json:"missing,omitempty"`
+}
+
+type BackupReport struct {
+	Snapshot string   `json:"snapshot"`
+	Images   int      `json:"images"`
+	Copied   int      `json:"copied"`
+	Linked   int      `json:"linked"`
+	Missing  []string `json:"missing,omitempty"`
+	Removed  []string `json:"removed,omitempty"`
+}
+
+type BackupController struct {
+	datastore     model.Datastore
+	configuration *config.Store
+	// running is held while a backup is being taken, so that a scheduled
+	// backup and a requested one do not run at once.
+	running sync.Mutex
+}
+
+func NewBackupController(ds model.Datastore, configuration *config.Store) *BackupController {
+	c := new(BackupController)
+	c.datastore = ds
+	c.configuration = configuration
+	return c
+}
+
+var errBackupRunning = errorWithStatus(http.StatusConflict, "a backup is already running")
+
+// Backup takes a snapshot of the database and uploads in the configured
+// backup directory, then removes the oldest snapshots beyond backupKeep.
+func (c *BackupController) Backup(ctx context.Context) (BackupReport, error) {
+	if !c.running.TryLock() {
+		return BackupReport{}, errBackupRunning
+	}
+	defer c.running.Unlock()
+	cfg := c.configuration.Get()
+	if cfg.BackupDir == "" {
+		return BackupReport{}, errorWithStatus(http.StatusServiceUnavailable, "backups are disabled because no backupDir is configured")
+	}
+	report, err := c.snapshot(ctx, cfg)
+	if err != nil {
+		return report, err
+	}
+	report.Removed, err = pruneBackups(cfg.BackupDir, cfg.BackupKeep)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error while removing old backups", "dir", cfg.BackupDir, "err", err)
+	}
+	return report, nil
+}
+
+func (c *BackupController) snapshot(ctx context.Context, cfg *config.Config) (BackupReport, error) {
+	var report BackupReport
+	if err := os.MkdirAll(cfg.BackupDir, 0755); err != nil {
+		return report, err
+	}
+	previous, err := listBackups(cfg.BackupDir)
+	if err != nil {
+		return report, err
+	}
+	now := time.Now().UTC()
+	stamp := now.Format(backupStampFormat)
+	report.Snapshot = filepath.Join(cfg.BackupDir, stamp)
+	if _, err := os.Stat(report.Snapshot); err == nil {
+		return report, errorWithStatus(http.StatusConflict, "a backup named %s already exists", stamp)
+	}
+	partial := filepath.Join(cfg.BackupDir, backupPartial+stamp)
+	if err := os.MkdirAll(filepath.Join(partial, backupUploadsDir), 0755); err != nil {
+		return report, err
+	}
+	complete := false
+	defer func() {
+		if !complete {
+			os.RemoveAll(partial)
+		}
+	}()
+
+	databaseFile := filepath.Join(partial, backupDatabaseFile)
+	if err := c.datastore.Backup(ctx, databaseFile); err != nil {
+		return report, fmt.Errorf("database: %w", err)
+	}
+	schemaVersion, err := model.CheckDatabase(databaseFile)
+	if err != nil {
+		return report, fmt.Errorf("database copy: %w", err)
+	}
+	imageFiles, err := model.BackupImageFiles(databaseFile)
+	if err != nil {
+		return report, err
+	}
+
+	var lastUploads string
+	if len(previous) > 0 {
+		lastUploads = filepath.Join(cfg.BackupDir, previous[len(previous)-1], backupUploadsDir)
+	}
+	for _, imageFile := range imageFiles {
+		if err := ctx.Err(); err != nil {
+			return report, err
+		}
+		name := filepath.Base(imageFile)
+		linked, err := backupImage(filepath.Join(cfg.UploadsPath, name), filepath.Join(partial, backupUploadsDir, name), lastUploads)
+		switch {
+		case errors.Is(err, fs.ErrNotExist):
+			// The post was most likely deleted after the database was
+			// copied, taking its image with it.
+			slog.WarnContext(ctx, "Image missing while backing up", "file", imageFile)
+			report.Missing = append(report.Missing, name)
+			continue
+		case err != nil:
+			return report, fmt.Errorf("image %s: %w", name, err)
+		case linked:
+			report.Linked++
+		default:
+			report.Copied++
+		}
+		report.Images++
+	}
+
+	manifest := BackupManifest{
+		Created:       now,
+		SchemaVersion: schemaVersion,
+		Images:        report.Images,
+		Linked:        report.Linked,
+		Missing:       report.Missing,
+	}
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return report, err
+	}
+	if err := os.WriteFile(filepath.Join(partial, backupManifestFile), data, 0644); err != nil {
+		return report, err
+	}
+	if err := os.Rename(partial, report.Snapshot); err != nil {
+		return report, err
+	}
+	complete = true
+	return report, nil
+}
+
+// backupImage puts a copy of src at dst, hard linking the copy in the last
+// snapshot if it is the same size, and otherwise copying src.
+func backupImage(src string, dst string, lastUploads string) (linked bool, err error) {
+	info, err := os.Stat(src)
+	if err != nil {
+		return false, err
+	}
+	if lastUploads != "" {
+		last := filepath.Join(lastUploads, filepath.Base(dst))
+		if lastInfo, err := os.Stat(last); err == nil && lastInfo.Size() == info.Size() {
+			if err := os.Link(last, dst); err == nil {
+				return true, nil
+			}
+		}
+	}
+	return false, copyFile(src, dst)
+}
+
+// copyFile copies src to dst, which must not exist, and syncs it.
+func copyFile(src string, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if err == nil {
+		err = out.Sync()
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(dst)
+	}
+	return err
+}
+
+// listBackups returns the names of the complete snapshots in dir, oldest
+// first.
+func listBackups(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		if _, err := time.Parse(backupStampFormat, entry.Name()); err == nil {
+			names = append(names, entry.Name())
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// pruneBackups removes all but the newest keep snapshots in dir, along with
+// partial snapshots left behind by a crash.
+func pruneBackups(dir string, keep int) ([]string, error) {
+	names, err := listBackups(dir)
+	if err != nil {
+		return nil, err
+	}
+	var removed []string
+	var errs []error
+	for len(names) > keep {
+		if err := os.RemoveAll(filepath.Join(dir, names[0])); err != nil {
+			errs = append(errs, err)
+		} else {
+			removed = append(removed, names[0])
+		}
+		names = names[1:]
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return removed, err
+	}
+	for _, entry := range entries {
+		// Only partial snapshots older than a day, in case one is being
+		// written by another process.
+		if !strings.HasPrefix(entry.Name(), backupPartial) {
+			continue
+		}
+		info, err := entry.Info()
+		if err == nil && time.Since(info.ModTime()) > 24*time.Hour {
+			if err := os.RemoveAll(filepath.Join(dir, entry.Name())); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+	return removed, errors.Join(errs...)
+}
+
+// BackupHandler takes a backup and reports on it.
+func (c *BackupController) BackupHandler(w http.ResponseWriter, r *http.Request) {
+	if err := http.NewResponseController(w).SetWriteDeadline(time.Time{}); err != nil {
+		slog.WarnContext(r.Context(), "Could not lift the write deadline for a backup", "err", err)
+	}
+	report, err := c.Backup(r.Context())
+	if err != nil {
+		status := statusForError(err)
+		if status == http.StatusInternalServerError {
+			slog.ErrorContext(r.Context(), "Error while backing up", "err", err)
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+	slog.InfoContext(r.Context(), "Backed up", "snapshot", report.Snapshot, "images", report.Images, "linked", report.Linked)
+	writeJSON(w, r, http.StatusCreated, report)
+}
+
+// ScheduleBackups takes a backup every backupInterval until ctx is done. The
+// interval is read before each wait, so reloading the configuration changes
+// it; an interval of 0 disables scheduled backups until it is set.
+func (c *BackupController) ScheduleBackups(ctx context.Context) {
+	for {
+		interval := c.configuration.Get().BackupInterval.Duration()
+		wait := interval
+		if wait == 0 {
+			// Check again later in case a reload enables backups.
+			wait = time.Minute
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+		if interval == 0 {
+			continue
+		}
+		report, err := c.Backup(ctx)
+		if err != nil {
+			if ctx.Err() == nil && !errors.Is(err, errBackupRunning) {
+				slog.Error("Scheduled backup failed", "err", err)
+			}
+			continue
+		}
+		slog.Info("Scheduled backup finished", "snapshot", report.Snapshot, "images", report.Images, "linked", report.Linked, "removed", len(report.Removed))
+	}
+}
+
+type BackupRestoreReport struct {
+	SchemaVersion int
+	Images        int
+	Copied        int
+	SavedDatabase string
+}
+
+// RestoreBackup replaces the database at databasePath with the one in a
+// snapshot, and copies any of its images that are not in uploadsPath. The
+// snapshot's database is checked for integrity, and every image it refers to
+// must be in the snapshot, before anything is changed. The old database is
+// kept next to it with a ".before-restore-<time>" suffix. The server must not
+// be running.
+func RestoreBackup(snapshot string, databasePath string, uploadsPath string) (BackupRestoreReport, error) {
+	var report BackupRestoreReport
+	source := filepath.Join(snapshot, backupDatabaseFile)
+	if _, err := os.Stat(source); err != nil {
+		return report, fmt.Errorf("not a photopost backup: %w", err)
+	}
+	var err error
+	if report.SchemaVersion, err = model.CheckDatabase(source); err != nil {
+		return report, err
+	}
+	imageFiles, err := model.BackupImageFiles(source)
+	if err != nil {
+		return report, err
+	}
+	snapshotUploads := filepath.Join(snapshot, backupUploadsDir)
+	for _, imageFile := range imageFiles {
+		if _, err := os.Stat(filepath.Join(snapshotUploads, filepath.Base(imageFile))); err != nil {
+			return report, fmt.Errorf("image %s: %w", filepath.Base(imageFile), err)
+		}
+	}
+
+	// Copy the database next to its destination and check the copy, so
+	// that swapping it in is a rename.
+	incoming := databasePath + ".restoring"
+	os.Remove(incoming)
+	if err := copyFile(source, incoming); err != nil {
+		return report, err
+	}
+	defer os.Remove(incoming)
+	if _, err := model.CheckDatabase(incoming); err != nil {
+		return report, fmt.Errorf("database copy: %w", err)
+	}
+
+	for _, imageFile := range imageFiles {
+		name := filepath.Base(imageFile)
+		dst := filepath.Join(uploadsPath, name)
+		report.Images++
+		if _, err := os.Stat(dst); err == nil {
+			continue
+		}
+		if err := copyFile(filepath.Join(snapshotUploads, name), dst); err != nil {
+			return report, fmt.Errorf("image %s: %w", name, err)
+		}
+		report.Copied++
+	}
+
+	saved := fmt.Sprintf("%s.before-restore-%s", databasePath, time.Now().UTC().Format(backupStampFormat))
+	if _, err := os.Stat(databasePath); err == nil {
+		if err := os.Rename(databasePath, saved); err != nil {
+			return report, err
+		}
+		report.SavedDatabase = saved
+	}
+	// A journal or WAL left by the old database would be applied to the
+	// restored one, so it goes with the old database.
+	for _, suffix := range []string{"-journal", "-wal", "-shm"} {
+		if _, err := os.Stat(databasePath + suffix); err == nil {
+			if err := os.Rename(databasePath+suffix, saved+suffix); err != nil {
+				return report, err
+			}
+		}
+	}
+	if err := os.Rename(incoming, databasePath); err != nil {
+		return report, err
+	}
+	return report, nil
+}
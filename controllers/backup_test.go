@@ -0,0 +1,208 @@
+package controllers
+
+import (
+	"context"
+	"github.com/mattgibbs/photopost/config"
+	"github.com/mattgibbs/photopost/model"
+	"image/color"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestBackups returns a library with two posts and a BackupController
+// for it that keeps keep snapshots.
+func newTestBackups(t *testing.T, keep int) (*PostController, *BackupController) {
+	t.Helper()
+	backupDir := filepath.Join(t.TempDir(), "backups")
+	c := newTestController(t, func(cfg *config.Config) {
+		cfg.BackupDir = backupDir
+		cfg.BackupKeep = keep
+	})
+	createTestPost(t, c, &model.Post{Title: "beach", Author: "Alice", Tags: []string{"sea"}, PostTime: time.Now()}, testPNG(t, color.Black))
+	createTestPost(t, c, &model.Post{Title: "fade", Author: "Bob", PostTime: time.Now()}, gradientPNG(t))
+	return c, NewBackupController(c.datastore, c.configuration)
+}
+
+func TestBackupAndRestore(t *testing.T) {
+	c, backups := newTestBackups(t, 7)
+	report, err := backups.Backup(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Images != 2 || report.Copied != 2 || len(report.Missing) != 0 {
+		t.Errorf("backup report = %+v, want both images copied", report)
+	}
+	for _, name := range []string{backupDatabaseFile, backupManifestFile} {
+		if _, err := os.Stat(filepath.Join(report.Snapshot, name)); err != nil {
+			t.Errorf("the snapshot has no %s: %s", name, err)
+		}
+	}
+
+	// Restore over an older database, with a WAL that must not be applied
+	// to the restored one.
+	dir := t.TempDir()
+	databasePath := filepath.Join(dir, "photopost.db")
+	uploadsPath := filepath.Join(dir, "uploads")
+	if err := os.Mkdir(uploadsPath, 0755); err != nil {
+		t.Fatal(err)
+	}
+	writeFiles(t, dir, map[string][]byte{"photopost.db": []byte("old"), "photopost.db-wal": []byte("old wal")})
+	restored, err := RestoreBackup(report.Snapshot, databasePath, uploadsPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if restored.Images != 2 || restored.Copied != 2 {
+		t.Errorf("restore report = %+v, want both images copied", restored)
+	}
+	if old, err := os.ReadFile(restored.SavedDatabase); err != nil || string(old) != "old" {
+		t.Errorf("the old database was not kept as %s: %v", restored.SavedDatabase, err)
+	}
+	if _, err := os.Stat(restored.SavedDatabase + "-wal"); err != nil {
+		t.Errorf("the old WAL was not moved aside: %s", err)
+	}
+	if _, err := os.Stat(databasePath + "-wal"); !os.IsNotExist(err) {
+		t.Errorf("the old WAL was left next to the restored database: %v", err)
+	}
+
+	datastore := model.NewSQLiteDatastore(databasePath)
+	defer datastore.Close()
+	want, err := c.datastore.FindAllPosts()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := datastore.FindAllPosts()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("restored posts = %v, want %v", got, want)
+	}
+	for _, post := range got {
+		if _, err := os.Stat(filepath.Join(uploadsPath, filepath.Base(post.ImageFile))); err != nil {
+			t.Errorf("post %d's image was not restored: %s", post.Id, err)
+		}
+	}
+}
+
+func TestBackupKeep(t *testing.T) {
+	_, backups := newTestBackups(t, 2)
+	backupDir := backups.configuration.Get().BackupDir
+	old := []string{"20190101-000000", "20190102-000000", "20190103-000000"}
+	for _, name := range old {
+		if err := os.MkdirAll(filepath.Join(backupDir, name), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// A partial snapshot left by a crash long ago, one that may still be
+	// being written, and a directory that is not a snapshot.
+	for _, name := range []string{backupPartial + "20190101-000000", backupPartial + "20190104-000000", "notes"} {
+		if err := os.Mkdir(filepath.Join(backupDir, name), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	longAgo := time.Now().Add(-48 * time.Hour)
+	if err := os.Chtimes(filepath.Join(backupDir, backupPartial+"20190101-000000"), longAgo, longAgo); err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := backups.Backup(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := old[:2]; !reflect.DeepEqual(report.Removed, want) {
+		t.Errorf("removed = %q, want %q", report.Removed, want)
+	}
+	entries, err := os.ReadDir(backupDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var left []string
+	for _, entry := range entries {
+		left = append(left, entry.Name())
+	}
+	if want := []string{backupPartial + "20190104-000000", old[2], filepath.Base(report.Snapshot), "notes"}; !reflect.DeepEqual(left, want) {
+		t.Errorf("backup directory holds %q, want %q", left, want)
+	}
+}
+
+func TestBackupImageLinksUnchangedImages(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string][]byte{
+		"uploads/a.png":      []byte("image a"),
+		"uploads/b.png":      []byte("image b, now longer"),
+		"last/uploads/a.png": []byte("image a"),
+		"last/uploads/b.png": []byte("image b"),
+	})
+	if err := os.Mkdir(filepath.Join(dir, "next"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	lastUploads := filepath.Join(dir, "last", "uploads")
+	for _, tt := range []struct {
+		name   string
+		linked bool
+	}{
+		{"a.png", true},
+		{"b.png", false},
+	} {
+		dst := filepath.Join(dir, "next", tt.name)
+		linked, err := backupImage(filepath.Join(dir, "uploads", tt.name), dst, lastUploads)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if linked != tt.linked {
+			t.Errorf("%s: linked = %t, want %t", tt.name, linked, tt.linked)
+		}
+		dstInfo, err := os.Stat(dst)
+		if err != nil {
+			t.Fatal(err)
+		}
+		lastInfo, err := os.Stat(filepath.Join(lastUploads, tt.name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if same := os.SameFile(dstInfo, lastInfo); same != tt.linked {
+			t.Errorf("%s: same file as the last snapshot's = %t, want %t", tt.name, same, tt.linked)
+		}
+	}
+}
+
+func TestBackupMissingImage(t *testing.T) {
+	c, backups := newTestBackups(t, 7)
+	posts, err := c.datastore.FindAllPosts()
+	if err != nil {
+		t.Fatal(err)
+	}
+	missing := filepath.Base(posts[0].ImageFile)
+	if err := os.Remove(posts[0].ImageFile); err != nil {
+		t.Fatal(err)
+	}
+
+	// The snapshot is taken without the image, and says so.
+	report, err := backups.Backup(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Images != 1 || !reflect.DeepEqual(report.Missing, []string{missing}) {
+		t.Errorf("backup report = %+v, want %s missing", report, missing)
+	}
+
+	// It cannot be restored, and nothing is changed trying.
+	dir := t.TempDir()
+	databasePath := filepath.Join(dir, "photopost.db")
+	writeFiles(t, dir, map[string][]byte{"photopost.db": []byte("old")})
+	_, err = RestoreBackup(report.Snapshot, databasePath, dir)
+	if err == nil || !strings.Contains(err.Error(), missing) {
+		t.Errorf("RestoreBackup = %v, want the missing image refused", err)
+	}
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 1 {
+		t.Errorf("the restore left %d files, want only the old database", len(entries))
+	}
+	if old, err := os.ReadFile(databasePath); err != nil || string(old) != "old" {
+		t.Errorf("the old database was changed: %v", err)
+	}
+}
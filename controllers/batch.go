@@ -0,0 +1,258 @@
+package controllers
+
+import (
+	"errors"
+	"fmt"
+	"github.com/mattgibbs/photopost/config"
+	"github.com/mattgibbs/photopost/metrics"
+	"github.com/mattgibbs/photopost/model"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	batchCreated   = "created"
+	batchDuplicate = "duplicate"
+	batchRejected  = "rejected"
+)
+
+// BatchResult reports what happened to one image of a batch upload.
+type BatchResult struct {
+	Index       int              `json:"index"`
+	Filename    string           `json:"filename"`
+	Status      string           `json:"status"`
+	Reason      string           `json:"reason,omitempty"`
+	DuplicateOf int64            `json:"duplicateOf,omitempty"`
+	Duplicates  []DuplicateMatch `json:"duplicates,omitempty"`
+	Post        *model.Post      `json:"post,omitempty"`
+}
+
+type batchItem struct {
+	result        BatchResult
+	img           *uploadedImage
+	post          *model.Post
+	imageFilename string
+	created       bool
+}
+
+// batchReadError reports a batch request that went over maxBatchBytes with
+// that limit, rather than the limit for a single upload.
+func batchReadError(err error, cfg *config.Config) error {
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		return errorWithStatus(http.StatusRequestEntityTooLarge, "Upload is larger than the %d byte batch limit.", cfg.MaxBatchBytes)
+	}
+	return err
+}
+
+// PostBatchCreate creates a post for each "image" part of a multipart
+// upload. The author, text, album, tags and postTime fields are shared by
+// every post. Each post's title is taken from a "title.N" field, where N is
+// the zero based position of the image in the upload, then from a shared
+// "title" field, and finally from the image's filename.
+//
+// The "duplicates" field applies to every image, as it does for PostCreate.
+// A bad or rejected duplicate image is reported in its result without
+// affecting the others; every post that is created is saved in a single
+// transaction.
+func (c *PostController) PostBatchCreate(w http.ResponseWriter, r *http.Request) {
+	cfg := c.configuration.Get()
+	r.Body = http.MaxBytesReader(w, r.Body, cfg.MaxBatchBytes)
+	reader, err := r.MultipartReader()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Could not parse upload form: %s", err), http.StatusBadRequest)
+		return
+	}
+	var items []*batchItem
+	defer func() {
+		for _, item := range items {
+			item.img.discard()
+		}
+	}()
+	fields := url.Values{}
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			err = batchReadError(uploadReadError(err, cfg), cfg)
+			http.Error(w, err.Error(), statusForError(err))
+			return
+		}
+		if part.FormName() != "image" || part.FileName() == "" {
+			if err := readFormField(part, fields, cfg); err != nil {
+				err = batchReadError(err, cfg)
+				http.Error(w, err.Error(), statusForError(err))
+				return
+			}
+			continue
+		}
+		item := &batchItem{result: BatchResult{Index: len(items), Filename: part.FileName()}}
+		items = append(items, item)
+		if len(items) > cfg.MaxBatchFiles {
+			item.reject(fmt.Sprintf("A batch can have at most %d images.", cfg.MaxBatchFiles))
+			part.Close()
+			continue
+		}
+		item.img, err = receiveImage(part, part.Header.Get("Content-Type"), part.FileName(), cfg)
+		part.Close()
+		// A request that is too large or cut off fails as a whole, not just
+		// this image.
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) || statusForError(err) == http.StatusBadRequest {
+			err = batchReadError(err, cfg)
+			http.Error(w, err.Error(), statusForError(err))
+			return
+		}
+		if err != nil {
+			item.reject(err.Error())
+		}
+	}
+	if len(items) == 0 {
+		http.Error(w, "At least one image is required.", http.StatusBadRequest)
+		return
+	}
+
+	policy, err := duplicatePolicy(fields, cfg)
+	if err != nil {
+		http.Error(w, err.Error(), statusForError(err))
+		return
+	}
+
+	// Build and validate every post before anything is stored.
+	byImage := map[string]*batchItem{}
+	for _, item := range items {
+		if item.result.Status != "" {
+			continue
+		}
+		if err := c.prepareBatchItem(item, fields, policy, byImage); err != nil {
+			slog.ErrorContext(r.Context(), "Error while checking batch image", "filename", item.result.Filename, "err", err)
+			http.Error(w, err.Error(), statusForError(err))
+			return
+		}
+	}
+
+	var posts []*model.Post
+	var accepted []*batchItem
+	c.images.RLock()
+	for _, item := range items {
+		if item.result.Status != "" {
+			continue
+		}
+		item.created, err = item.img.store(item.imageFilename)
+		if err != nil {
+			break
+		}
+		accepted = append(accepted, item)
+		posts = append(posts, item.post)
+	}
+	if err == nil && len(posts) > 0 {
+		_, err = c.datastore.SavePosts(posts)
+	}
+	c.images.RUnlock()
+	if err != nil {
+		c.removeBatchImages(r, accepted)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	results := make([]BatchResult, len(items))
+	for i, item := range items {
+		if item.post != nil && item.result.Status == "" {
+			metrics.ObserveUpload(item.img.contentType, item.img.size)
+			item.result.Status = batchCreated
+			item.result.Post = item.post
+		}
+		results[i] = item.result
+	}
+	slog.InfoContext(r.Context(), "Saved batch upload", "images", len(items), "created", len(posts))
+	writeJSON(w, r, http.StatusOK, map[string]interface{}{"results": results})
+}
+
+func (item *batchItem) reject(reason string) {
+	item.result.Status = batchRejected
+	item.result.Reason = reason
+}
+
+// prepareBatchItem builds the post for an image and looks for duplicates of
+// it, both among existing posts and earlier in the batch. With a "reject"
+// policy a duplicate is not created; with "warn" it is created and its result
+// lists the duplicates. Problems with the image are recorded in the item; the
+// returned error is for failures that should abort the whole batch.
+func (c *PostController) prepareBatchItem(item *batchItem, fields url.Values, policy string, byImage map[string]*batchItem) error {
+	post, err := postFromFields(fields)
+	if err != nil {
+		item.reject(err.Error())
+		return nil
+	}
+	post.Title = batchTitle(fields, item.result.Index, item.result.Filename)
+	item.imageFilename, err = item.img.storedFilename(c.configuration.Get().UploadsPath)
+	if err != nil {
+		item.reject(err.Error())
+		return nil
+	}
+	post.ImageFile = item.imageFilename
+	if valid, validation_err := post.Validate(); !valid {
+		item.reject(validation_err.Error())
+		return nil
+	}
+	if err := setImageHashes(post, item.img); err != nil {
+		item.reject(err.Error())
+		return nil
+	}
+	if policy != duplicatesAllow {
+		if first, ok := byImage[item.imageFilename]; ok {
+			item.result.Reason = fmt.Sprintf("Same image as item %d of this batch.", first.result.Index)
+			if policy == duplicatesReject {
+				item.result.Status = batchDuplicate
+				return nil
+			}
+		}
+		duplicates, err := c.findDuplicates(post)
+		if err != nil {
+			return err
+		}
+		if len(duplicates) > 0 {
+			item.result.Duplicates = duplicates
+			if item.result.Reason == "" && duplicates[0].Exact {
+				item.result.Reason = "This image has already been posted."
+			} else if item.result.Reason == "" {
+				item.result.Reason = "This image looks like one that has already been posted."
+			}
+			if policy == duplicatesReject {
+				item.result.Status = batchDuplicate
+				item.result.DuplicateOf = duplicates[0].PostId
+				return nil
+			}
+		}
+	}
+	if _, ok := byImage[item.imageFilename]; !ok {
+		byImage[item.imageFilename] = item
+	}
+	item.post = post
+	return nil
+}
+
+func batchTitle(fields url.Values, index int, filename string) string {
+	if title := fields.Get(fmt.Sprintf("title.%d", index)); title != "" {
+		return title
+	}
+	if title := fields.Get("title"); title != "" {
+		return title
+	}
+	name := filepath.Base(filename)
+	return strings.TrimSuffix(name, filepath.Ext(name))
+}
+
+// removeBatchImages undoes storing the images of a batch that failed to save.
+func (c *PostController) removeBatchImages(r *http.Request, items []*batchItem) {
+	for _, item := range items {
+		if item.created {
+			c.removeUnreferencedImage(r.Context(), item.imageFilename)
+		}
+	}
+}
@@ -0,0 +1,48 @@
+package controllers
+
+import (
+	"bytes"
+	"github.com/mattgibbs/photopost/config"
+	"image/color"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestPostBatchCreateOverBatchLimit(t *testing.T) {
+	images := [][]byte{
+		testPNG(t, color.Black),
+		testPNG(t, color.RGBA{R: 255, A: 255}),
+		testPNG(t, color.RGBA{G: 255, A: 255}),
+		testPNG(t, color.RGBA{B: 255, A: 255}),
+	}
+	c := newTestController(t, func(cfg *config.Config) {
+		// Each image is within the upload limit, but all of them are not
+		// within the batch limit.
+		cfg.MaxUploadBytes = int64(len(images[0])) * 2
+		cfg.MaxBatchBytes = int64(len(images[0])) * 3
+	})
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	form.WriteField("author", "tester")
+	for _, img := range images {
+		part, err := form.CreateFormFile("image", "photo.png")
+		if err != nil {
+			t.Fatal(err)
+		}
+		part.Write(img)
+	}
+	form.Close()
+	r := httptest.NewRequest("POST", "/posts/batch", &body)
+	r.Header.Set("Content-Type", form.FormDataContentType())
+	w := httptest.NewRecorder()
+	c.PostBatchCreate(w, r)
+	if w.Code != http.StatusRequestEntityTooLarge || !strings.Contains(w.Body.String(), "batch limit") {
+		t.Fatalf("PostBatchCreate = %d %q, want 413 for the batch limit", w.Code, w.Body.String())
+	}
+	if posts, _ := c.datastore.FindAllPosts(); len(posts) != 0 {
+		t.Errorf("%d posts were created from a batch that was too large", len(posts))
+	}
+}
@@ -0,0 +1,280 @@
+package controllers
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"github.com/gorilla/mux"
+	"github.com/mattgibbs/photopost/config"
+	"github.com/mattgibbs/photopost/model"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DeviceController registers display devices, such as photo frames, and
+// picks what each one shows next from its profile.
+type DeviceController struct {
+	posts         *PostController
+	configuration *config.Store
+}
+
+func NewDeviceController(posts *PostController, configuration *config.Store) *DeviceController {
+	c := new(DeviceController)
+	c.posts = posts
+	c.configuration = configuration
+	return c
+}
+
+var errDeviceToken = errorWithStatus(http.StatusUnauthorized, "A valid device token is required.")
+
+// PairedDevice is a device along with its pairing token, which is only ever
+// shown when it is issued.
+type PairedDevice struct {
+	*model.Device
+	Token string `json:"token"`
+}
+
+// deviceRequest is the body of a request to register or change a device.
+// Fields that are left out keep their current values.
+type deviceRequest struct {
+	Name    *string              `json:"name"`
+	Profile *model.DeviceProfile `json:"profile"`
+}
+
+// newDeviceToken makes a pairing token and the hash of it that is stored.
+func newDeviceToken() (string, string, error) {
+	var token [32]byte
+	if _, err := rand.Read(token[:]); err != nil {
+		return "", "", err
+	}
+	value := hex.EncodeToString(token[:])
+	return value, hashDeviceToken(value), nil
+}
+
+func hashDeviceToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// defaultDeviceProfile is the profile of a device registered without one:
+// every photo, shuffled and faded in, at the configured interval.
+func defaultDeviceProfile() model.DeviceProfile {
+	return model.DeviceProfile{Order: model.OrderShuffle, Transition: "fade"}
+}
+
+// readDeviceRequest applies the body of a request to device, tidying up the
+// profile's tags and authors, and checks the result.
+func readDeviceRequest(w http.ResponseWriter, r *http.Request, device *model.Device) error {
+	var req deviceRequest
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64<<10))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&req); err != nil {
+		return errorWithStatus(http.StatusBadRequest, "could not read the device: %s", err)
+	}
+	if req.Name != nil {
+		device.Name = strings.TrimSpace(*req.Name)
+	}
+	if req.Profile != nil {
+		device.Profile = *req.Profile
+		defaults := defaultDeviceProfile()
+		device.Profile.Order = firstNonEmpty(device.Profile.Order, defaults.Order)
+		device.Profile.Transition = firstNonEmpty(device.Profile.Transition, defaults.Transition)
+	}
+	device.Profile.Tags = parseTags(device.Profile.Tags)
+	device.Profile.Authors = parseTags(device.Profile.Authors)
+	if device.Name == "" {
+		return errorWithStatus(http.StatusBadRequest, "a device must have a name")
+	}
+	if err := device.Profile.Validate(); err != nil {
+		return errorWithStatus(http.StatusBadRequest, "%s", err)
+	}
+	return nil
+}
+
+// findDevice looks up the device named by the "id" route variable.
+func (c *DeviceController) findDevice(r *http.Request) (*model.Device, error) {
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		return nil, errorWithStatus(http.StatusBadRequest, "%s", err)
+	}
+	device, err := c.posts.datastore.FindDevice(id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, errorWithStatus(http.StatusNotFound, "no device with ID %d", id)
+	}
+	return device, err
+}
+
+func (c *DeviceController) DeviceIndex(w http.ResponseWriter, r *http.Request) {
+	devices, err := c.posts.datastore.FindAllDevices()
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Error while fetching devices", "err", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, r, http.StatusOK, devices)
+}
+
+func (c *DeviceController) DeviceShow(w http.ResponseWriter, r *http.Request) {
+	device, err := c.findDevice(r)
+	if err != nil {
+		http.Error(w, err.Error(), statusForError(err))
+		return
+	}
+	writeJSON(w, r, http.StatusOK, device)
+}
+
+// DeviceCreate registers a device and issues its pairing token.
+func (c *DeviceController) DeviceCreate(w http.ResponseWriter, r *http.Request) {
+	device := &model.Device{Profile: defaultDeviceProfile()}
+	if err := readDeviceRequest(w, r, device); err != nil {
+		http.Error(w, err.Error(), statusForError(err))
+		return
+	}
+	token, hash, err := newDeviceToken()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	device.TokenHash = hash
+	if _, err := c.posts.datastore.SaveDevice(device); err != nil {
+		slog.ErrorContext(r.Context(), "Error while saving device", "err", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	slog.InfoContext(r.Context(), "Registered device", "device_id", device.Id, "name", device.Name)
+	writeJSON(w, r, http.StatusCreated, PairedDevice{Device: device, Token: token})
+}
+
+// DeviceUpdate changes a device's name or profile.
+func (c *DeviceController) DeviceUpdate(w http.ResponseWriter, r *http.Request) {
+	device, err := c.findDevice(r)
+	if err != nil {
+		http.Error(w, err.Error(), statusForError(err))
+		return
+	}
+	if err := readDeviceRequest(w, r, device); err != nil {
+		http.Error(w, err.Error(), statusForError(err))
+		return
+	}
+	if err := c.posts.datastore.UpdateDevice(device); err != nil {
+		slog.ErrorContext(r.Context(), "Error while updating device", "device_id", device.Id, "err", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, r, http.StatusOK, device)
+}
+
+// DevicePair issues a device a new pairing token, so that the old one no
+// longer works.
+func (c *DeviceController) DevicePair(w http.ResponseWriter, r *http.Request) {
+	device, err := c.findDevice(r)
+	if err != nil {
+		http.Error(w, err.Error(), statusForError(err))
+		return
+	}
+	token, hash, err := newDeviceToken()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	device.TokenHash = hash
+	if err := c.posts.datastore.UpdateDevice(device); err != nil {
+		slog.ErrorContext(r.Context(), "Error while updating device", "device_id", device.Id, "err", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	slog.InfoContext(r.Context(), "Issued new device pairing token", "device_id", device.Id)
+	writeJSON(w, r, http.StatusOK, PairedDevice{Device: device, Token: token})
+}
+
+func (c *DeviceController) DeviceDelete(w http.ResponseWriter, r *http.Request) {
+	device, err := c.findDevice(r)
+	if err != nil {
+		http.Error(w, err.Error(), statusForError(err))
+		return
+	}
+	if err := c.posts.datastore.DeleteDevice(device.Id); err != nil {
+		slog.ErrorContext(r.Context(), "Error while deleting device", "device_id", device.Id, "err", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	slog.InfoContext(r.Context(), "Removed device", "device_id", device.Id, "name", device.Name)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// DeviceNext gives a device the next post to show, chosen by its profile,
+// as JSON. The device proves who it is with its pairing token, as
+// "Authorization: Bearer <token>", which unlike a URL parameter is not
+// written to the request log. The X-Slideshow-Interval and
+// X-Slideshow-Transition headers say how long to show the post for and how
+// to bring it in.
+//
+// During the device's quiet hours there is no post: the response is 204 No
+// Content, with X-Slideshow-Interval set to when to ask again.
+func (c *DeviceController) DeviceNext(w http.ResponseWriter, r *http.Request) {
+	device, err := c.findDevice(r)
+	if err != nil {
+		if statusForError(err) == http.StatusNotFound {
+			// Do not tell which IDs exist without a token.
+			err = errDeviceToken
+		}
+		http.Error(w, err.Error(), statusForError(err))
+		return
+	}
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || subtle.ConstantTimeCompare([]byte(hashDeviceToken(token)), []byte(device.TokenHash)) != 1 {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="photopost device"`)
+		http.Error(w, errDeviceToken.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	cfg := c.configuration.Get()
+	now := time.Now().In(configuredLocation(cfg))
+	w.Header().Set("Cache-Control", "no-store")
+	if quiet, until := device.Profile.Quiet(now); quiet {
+		w.Header().Set("X-Slideshow-Interval", strconv.Itoa(int(until.Sub(now).Seconds())+1))
+		w.Header().Set("X-Slideshow-Quiet-Until", until.Format(time.RFC3339))
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	var id int64
+	filters := device.Profile.Filters()
+	if device.Profile.Order == model.OrderChronological {
+		id, err = c.posts.datastore.NextPostInOrder(device.LastPostTime, device.LastPostId, filters)
+	} else {
+		id, err = c.posts.datastore.NextRandomPost(model.DeviceClient(device.Id), randomWeights(cfg), filters)
+	}
+	if errors.Is(err, model.ErrNoPosts) {
+		http.Error(w, "No photos match the device's profile.", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Error while picking a post for a device", "device_id", device.Id, "err", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	post, err := c.posts.datastore.FindPost(int(id))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err := c.posts.datastore.DeviceShown(device.Id, post.Id, post.PostTime, now); err != nil {
+		slog.ErrorContext(r.Context(), "Error while recording what a device was shown", "device_id", device.Id, "err", err)
+	}
+
+	interval := time.Duration(device.Profile.Interval) * time.Second
+	if interval == 0 {
+		interval = cfg.SlideshowInterval.Duration()
+	}
+	w.Header().Set("X-Slideshow-Interval", strconv.Itoa(int(interval.Seconds())))
+	w.Header().Set("X-Slideshow-Transition", device.Profile.Transition)
+	writeJSON(w, r, http.StatusOK, post)
+}
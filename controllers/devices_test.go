@@ -0,0 +1,132 @@
+package controllers
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/mux"
+	"github.com/mattgibbs/photopost/model"
+	"image/color"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestDeviceNextToken(t *testing.T) {
+	posts := newTestController(t, nil)
+	c := NewDeviceController(posts, posts.configuration)
+	token, hash, err := newDeviceToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+	device := &model.Device{Name: "Kitchen", TokenHash: hash, Profile: defaultDeviceProfile()}
+	if _, err := posts.datastore.SaveDevice(device); err != nil {
+		t.Fatal(err)
+	}
+	next := func(url string, authorization string) int {
+		r := httptest.NewRequest("GET", url, nil)
+		if authorization != "" {
+			r.Header.Set("Authorization", authorization)
+		}
+		r = mux.SetURLVars(r, map[string]string{"id": strconv.FormatInt(device.Id, 10)})
+		w := httptest.NewRecorder()
+		c.DeviceNext(w, r)
+		return w.Code
+	}
+
+	// There are no posts, so a device that is let in gets 404.
+	if code := next("/devices/1/next", "Bearer "+token); code != http.StatusNotFound {
+		t.Errorf("with the token = %d, want 404", code)
+	}
+	if code := next("/devices/1/next", "Bearer wrong"); code != http.StatusUnauthorized {
+		t.Errorf("with the wrong token = %d, want 401", code)
+	}
+	// A token in the URL would be written to the request log.
+	if code := next("/devices/1/next?token="+token, ""); code != http.StatusUnauthorized {
+		t.Errorf("with the token as a parameter = %d, want 401", code)
+	}
+}
+
+// pairTestDevice saves a device with profile, and returns it with its token.
+func pairTestDevice(t *testing.T, posts *PostController, profile model.DeviceProfile) (*model.Device, string) {
+	t.Helper()
+	token, hash, err := newDeviceToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+	device := &model.Device{Name: "Kitchen", TokenHash: hash, Profile: profile}
+	if _, err := posts.datastore.SaveDevice(device); err != nil {
+		t.Fatal(err)
+	}
+	return device, token
+}
+
+func deviceNext(c *DeviceController, device *model.Device, token string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("GET", "/devices/"+strconv.FormatInt(device.Id, 10)+"/next", nil)
+	r.Header.Set("Authorization", "Bearer "+token)
+	r = mux.SetURLVars(r, map[string]string{"id": strconv.FormatInt(device.Id, 10)})
+	w := httptest.NewRecorder()
+	c.DeviceNext(w, r)
+	return w
+}
+
+func TestDeviceNextChronological(t *testing.T) {
+	posts := newTestController(t, nil)
+	c := NewDeviceController(posts, posts.configuration)
+	base := time.Date(2019, 6, 1, 12, 0, 0, 0, time.UTC)
+	// Created newest first, so that the order is not the order of the IDs.
+	var want []string
+	for i, title := range []string{"third", "second", "first"} {
+		createTestPost(t, posts, &model.Post{Title: title, Author: "tester", PostTime: base.Add(time.Duration(2-i) * time.Hour)}, testPNG(t, color.Black))
+		want = append([]string{title}, want...)
+	}
+	want = append(want, "first", "second")
+	profile := defaultDeviceProfile()
+	profile.Order = model.OrderChronological
+	device, token := pairTestDevice(t, posts, profile)
+
+	var got []string
+	for range want {
+		w := deviceNext(c, device, token)
+		if w.Code != http.StatusOK {
+			t.Fatalf("DeviceNext = %d %s", w.Code, w.Body.String())
+		}
+		var post model.Post
+		if err := json.NewDecoder(w.Body).Decode(&post); err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, post.Title)
+	}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("device was shown %q, want %q", got, want)
+	}
+}
+
+func TestDeviceNextQuietHours(t *testing.T) {
+	posts := newTestController(t, nil)
+	c := NewDeviceController(posts, posts.configuration)
+	createTestPost(t, posts, &model.Post{Title: "photo", Author: "tester", PostTime: time.Now()}, testPNG(t, color.Black))
+	// Quiet from an hour ago to an hour from now, which runs past midnight
+	// late in the evening.
+	now := time.Now().In(configuredLocation(posts.configuration.Get()))
+	profile := defaultDeviceProfile()
+	profile.QuietStart = now.Add(-time.Hour).Format("15:04")
+	profile.QuietEnd = now.Add(time.Hour).Format("15:04")
+	device, token := pairTestDevice(t, posts, profile)
+
+	w := deviceNext(c, device, token)
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("DeviceNext in quiet hours = %d, want 204", w.Code)
+	}
+	until, err := time.Parse(time.RFC3339, w.Header().Get("X-Slideshow-Quiet-Until"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if wait := until.Sub(now); wait <= 0 || wait > time.Hour {
+		t.Errorf("quiet until %v, want within the next hour", until)
+	}
+	if interval, err := strconv.Atoi(w.Header().Get("X-Slideshow-Interval")); err != nil || interval <= 0 || interval > 60*60+1 {
+		t.Errorf("X-Slideshow-Interval = %q, want the seconds until the quiet hours end", w.Header().Get("X-Slideshow-Interval"))
+	}
+}
@@ -0,0 +1,316 @@
+package controllers
+
+import (
+	"context"
+	"crypto/sha1"
+	"fmt"
+	"github.com/mattgibbs/photopost/config"
+	"github.com/mattgibbs/photopost/imagehash"
+	"github.com/mattgibbs/photopost/model"
+	"image"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Duplicate policies, chosen per upload with the "duplicates" field.
+const (
+	duplicatesReject = "reject"
+	duplicatesWarn   = "warn"
+	duplicatesAllow  = "allow"
+)
+
+// DuplicateMatch is an existing post whose image is the same as, or looks
+// like, an uploaded one.
+type DuplicateMatch struct {
+	PostId   int64 `json:"postId"`
+	Distance int   `json:"distance"`
+	Exact    bool  `json:"exact"`
+}
+
+// duplicatePolicy reads the "duplicates" field, falling back to the
+// configured default.
+func duplicatePolicy(fields url.Values, cfg *config.Config) (string, error) {
+	policy := fields.Get("duplicates")
+	if policy == "" {
+		return cfg.DuplicatePolicy, nil
+	}
+	switch policy {
+	case duplicatesReject, duplicatesWarn, duplicatesAllow:
+		return policy, nil
+	}
+	return "", errorWithStatus(http.StatusBadRequest, "duplicates must be one of reject, warn or allow.")
+}
+
+// perceptualHash decodes the image file and computes its dHash.
+func perceptualHash(path string) (model.PerceptualHash, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	img, _, err := image.Decode(f)
+	if err != nil {
+		return 0, err
+	}
+	return model.PerceptualHash(imagehash.DHash(img)), nil
+}
+
+// perceptualHash decodes the uploaded image and computes its dHash, once.
+func (u *uploadedImage) perceptualHash() (model.PerceptualHash, error) {
+	if u.phash == nil {
+		hash, err := perceptualHash(u.tempPath)
+		if err != nil {
+			return 0, errorWithStatus(http.StatusUnprocessableEntity, "Uploaded file is not a readable image: %s", err)
+		}
+		u.phash = &hash
+	}
+	return *u.phash, nil
+}
+
+// setImageHashes records the hashes of an uploaded image on its post.
+func setImageHashes(post *model.Post, img *uploadedImage) error {
+	hash, err := img.perceptualHash()
+	if err != nil {
+		return err
+	}
+	post.ContentHash = fmt.Sprintf("%x", img.hash)
+	post.PerceptualHash = &hash
+	return nil
+}
+
+// findDuplicates returns the posts with exactly the same image as post, then
+// those whose image looks the same.
+func (c *PostController) findDuplicates(post *model.Post) ([]DuplicateMatch, error) {
+	matches := []DuplicateMatch{}
+	exact := map[int64]bool{}
+	ids, err := c.datastore.PostIDsForContentHash(post.ContentHash)
+	if err != nil {
+		return nil, err
+	}
+	// Posts whose hashes have not been filled in yet can still be found by
+	// their content addressed filename.
+	byFile, err := c.datastore.PostIDsForImageFile(post.ImageFile)
+	if err != nil {
+		return nil, err
+	}
+	for _, id := range append(ids, byFile...) {
+		if !exact[id] {
+			exact[id] = true
+			matches = append(matches, DuplicateMatch{PostId: id, Exact: true})
+		}
+	}
+	if post.PerceptualHash == nil {
+		return matches, nil
+	}
+	similar, err := c.datastore.FindSimilarPosts(*post.PerceptualHash, c.configuration.Get().NearDuplicateDistance)
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range similar {
+		if !exact[s.Id] {
+			matches = append(matches, DuplicateMatch{PostId: s.Id, Distance: s.Distance})
+		}
+	}
+	return matches, nil
+}
+
+// duplicateError is returned when an upload is rejected because of its
+// duplicates.
+type duplicateError struct {
+	matches []DuplicateMatch
+}
+
+func (e *duplicateError) Error() string {
+	return fmt.Sprintf("Uploaded image duplicates %d existing post(s).", len(e.matches))
+}
+
+// writeCreateError reports an error from createPost, listing the duplicates
+// if that is why the post was rejected.
+func writeCreateError(w http.ResponseWriter, r *http.Request, err error) {
+	if dupErr, ok := err.(*duplicateError); ok {
+		writeJSON(w, r, http.StatusConflict, map[string]interface{}{
+			"error":      dupErr.Error(),
+			"duplicates": dupErr.matches,
+		})
+		return
+	}
+	http.Error(w, err.Error(), statusForError(err))
+}
+
+// setDuplicateHeader lists the duplicates of a post that was created anyway.
+func setDuplicateHeader(w http.ResponseWriter, matches []DuplicateMatch) {
+	for _, m := range matches {
+		w.Header().Add("X-Duplicate-Of", strconv.FormatInt(m.PostId, 10))
+	}
+}
+
+// BackfillHashes computes the content and perceptual hashes of posts saved
+// before duplicate detection existed. It runs until every post has been
+// looked at or ctx is done.
+func (c *PostController) BackfillHashes(ctx context.Context) {
+	const batchSize = 50
+	var afterId int64
+	filled := 0
+	for ctx.Err() == nil {
+		posts, err := c.datastore.PostsMissingHashes(afterId, batchSize)
+		if err != nil {
+			slog.Error("Error while finding posts to hash", "err", err)
+			return
+		}
+		if len(posts) == 0 {
+			break
+		}
+		for _, post := range posts {
+			if ctx.Err() != nil {
+				return
+			}
+			afterId = max(afterId, post.Id)
+			contentHash, err := fileContentHash(post.ImageFile)
+			if err != nil {
+				slog.Warn("Could not hash image", "post_id", post.Id, "file", post.ImageFile, "err", err)
+				continue
+			}
+			hash, err := perceptualHash(post.ImageFile)
+			if err != nil {
+				slog.Warn("Could not hash image", "post_id", post.Id, "file", post.ImageFile, "err", err)
+				continue
+			}
+			if err := c.datastore.UpdatePostHashes(post.Id, contentHash, hash); err != nil {
+				slog.Error("Error while saving image hashes", "post_id", post.Id, "err", err)
+				continue
+			}
+			filled++
+		}
+	}
+	if filled > 0 {
+		slog.Info("Filled in image hashes for existing posts", "posts", filled)
+	}
+}
+
+func fileContentHash(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha1.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
+
+// DuplicateCluster is a group of posts that share an image, or whose images
+// are all within MaxDistance of each other's neighbours.
+type DuplicateCluster struct {
+	PostIds     []int64 `json:"postIds"`
+	Exact       bool    `json:"exact"`
+	MaxDistance int     `json:"maxDistance"`
+}
+
+// DuplicatesReport lists clusters of existing posts with identical images,
+// then clusters of near duplicates. max_distance overrides the configured
+// near duplicate distance.
+func (c *PostController) DuplicatesReport(w http.ResponseWriter, r *http.Request) {
+	maxDistance := c.configuration.Get().NearDuplicateDistance
+	if v := r.FormValue("max_distance"); v != "" {
+		d, err := strconv.Atoi(v)
+		if err != nil || d < 0 || d > 64 {
+			http.Error(w, "max_distance must be between 0 and 64.", http.StatusBadRequest)
+			return
+		}
+		maxDistance = d
+	}
+	start := time.Now()
+	posts, err := c.datastore.FindAllPosts()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Exact duplicates share a content hash, or for posts that have not been
+	// hashed yet, an image file.
+	byContent := map[string][]int64{}
+	for _, post := range posts {
+		key := post.ContentHash
+		if key == "" {
+			key = post.ImageFile
+		}
+		byContent[key] = append(byContent[key], post.Id)
+	}
+	clusters := []DuplicateCluster{}
+	for _, ids := range byContent {
+		if len(ids) > 1 {
+			clusters = append(clusters, DuplicateCluster{PostIds: sortedIds(ids), Exact: true})
+		}
+	}
+
+	// Near duplicates are joined into clusters with a union-find over every
+	// pair of images within maxDistance. Identical images count once.
+	var hashed []*model.Post
+	seenContent := map[string]bool{}
+	for _, post := range posts {
+		if post.PerceptualHash != nil && !seenContent[post.ContentHash] {
+			seenContent[post.ContentHash] = true
+			hashed = append(hashed, post)
+		}
+	}
+	parent := make([]int, len(hashed))
+	for i := range parent {
+		parent[i] = i
+	}
+	var find func(int) int
+	find = func(i int) int {
+		if parent[i] != i {
+			parent[i] = find(parent[i])
+		}
+		return parent[i]
+	}
+	clusterDistance := map[int]int{}
+	for i := range hashed {
+		for j := i + 1; j < len(hashed); j++ {
+			d := imagehash.Distance(uint64(*hashed[i].PerceptualHash), uint64(*hashed[j].PerceptualHash))
+			if d > maxDistance {
+				continue
+			}
+			ri, rj := find(i), find(j)
+			if ri != rj {
+				parent[ri] = rj
+			}
+			root := find(j)
+			clusterDistance[root] = max(d, clusterDistance[ri], clusterDistance[rj])
+		}
+	}
+	groups := map[int][]int64{}
+	for i, post := range hashed {
+		root := find(i)
+		groups[root] = append(groups[root], post.Id)
+	}
+	for root, ids := range groups {
+		if len(ids) > 1 {
+			clusters = append(clusters, DuplicateCluster{PostIds: sortedIds(ids), MaxDistance: clusterDistance[root]})
+		}
+	}
+	sort.SliceStable(clusters, func(i, j int) bool {
+		if clusters[i].Exact != clusters[j].Exact {
+			return clusters[i].Exact
+		}
+		return clusters[i].PostIds[0] < clusters[j].PostIds[0]
+	})
+	slog.InfoContext(r.Context(), "Built duplicates report", "posts", len(posts), "clusters", len(clusters), "duration", time.Since(start))
+	writeJSON(w, r, http.StatusOK, map[string]interface{}{
+		"maxDistance": maxDistance,
+		"clusters":    clusters,
+	})
+}
+
+func sortedIds(ids []int64) []int64 {
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
@@ -0,0 +1,349 @@
+package controllers
+
+import (
+	"archive/zip"
+	"context"
+	"crypto/sha1"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/mattgibbs/photopost/model"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// An export archive is a zip file with every image under images/, stored
+// uncompressed since they are already compressed, followed by manifest.json.
+// Bump exportVersion whenever the manifest changes in a way older versions
+// of ImportArchive could not read.
+const (
+	exportFormat   = "photopost-export"
+	exportVersion  = 1
+	exportManifest = "manifest.json"
+	exportImageDir = "images"
+)
+
+// ExportManifest describes the posts in an export archive, and the SHA-1 and
+// size of each image as it was exported.
+type ExportManifest struct {
+	Format   string                   `json:"format"`
+	Version  int                      `json:"version"`
+	Exported time.Time                `json:"exported"`
+	Posts    []ExportedPost           `json:"posts"`
+	Images   map[string]ExportedImage `json:"images"`
+}
+
+type ExportedPost struct {
+	Id             int64                 `json:"id"`
+	Title          string                `json:"title"`
+	Text           string                `json:"text"`
+	Author         string                `json:"author"`
+	Album          string                `json:"album"`
+	Tags           []string              `json:"tags"`
+	PostTime       time.Time             `json:"postTime"`
+	CreationTime   time.Time             `json:"creationTime"`
+	Image          string                `json:"image"`
+	ContentHash    string                `json:"contentHash,omitempty"`
+	PerceptualHash *model.PerceptualHash `json:"perceptualHash,omitempty"`
+}
+
+type ExportedImage struct {
+	SHA1 string `json:"sha1"`
+	Size int64  `json:"size"`
+}
+
+type ExportReport struct {
+	Posts  int
+	Images int
+}
+
+// ExportArchive writes every post and its image to w as an export archive.
+// A post whose image is missing fails the export, since the archive could
+// not be restored exactly.
+func (c *PostController) ExportArchive(ctx context.Context, w io.Writer) (ExportReport, error) {
+	var report ExportReport
+	posts, err := c.datastore.FindAllPosts()
+	if err != nil {
+		return report, err
+	}
+	sort.Slice(posts, func(i, j int) bool { return posts[i].Id < posts[j].Id })
+	manifest := ExportManifest{
+		Format:   exportFormat,
+		Version:  exportVersion,
+		Exported: time.Now().UTC(),
+		Posts:    make([]ExportedPost, 0, len(posts)),
+		Images:   map[string]ExportedImage{},
+	}
+	archive := zip.NewWriter(w)
+	for _, post := range posts {
+		if err := ctx.Err(); err != nil {
+			return report, err
+		}
+		name := path.Join(exportImageDir, filepath.Base(post.ImageFile))
+		if _, ok := manifest.Images[name]; !ok {
+			image, err := exportImage(archive, name, post.ImageFile)
+			if err != nil {
+				return report, fmt.Errorf("post %d: %w", post.Id, err)
+			}
+			manifest.Images[name] = image
+			report.Images++
+		}
+		manifest.Posts = append(manifest.Posts, ExportedPost{
+			Id:             post.Id,
+			Title:          post.Title,
+			Text:           post.Text,
+			Author:         post.Author,
+			Album:          post.Album,
+			Tags:           post.Tags,
+			PostTime:       post.PostTime.UTC(),
+			CreationTime:   post.CreationTime.UTC(),
+			Image:          name,
+			ContentHash:    post.ContentHash,
+			PerceptualHash: post.PerceptualHash,
+		})
+		report.Posts++
+	}
+	f, err := archive.CreateHeader(&zip.FileHeader{Name: exportManifest, Method: zip.Deflate, Modified: manifest.Exported})
+	if err != nil {
+		return report, err
+	}
+	encoder := json.NewEncoder(f)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(manifest); err != nil {
+		return report, err
+	}
+	return report, archive.Close()
+}
+
+func exportImage(archive *zip.Writer, name string, imageFile string) (ExportedImage, error) {
+	src, err := os.Open(imageFile)
+	if err != nil {
+		return ExportedImage{}, err
+	}
+	defer src.Close()
+	info, err := src.Stat()
+	if err != nil {
+		return ExportedImage{}, err
+	}
+	dst, err := archive.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Store, Modified: info.ModTime()})
+	if err != nil {
+		return ExportedImage{}, err
+	}
+	hash := sha1.New()
+	size, err := io.Copy(io.MultiWriter(dst, hash), src)
+	if err != nil {
+		return ExportedImage{}, err
+	}
+	return ExportedImage{SHA1: fmt.Sprintf("%x", hash.Sum(nil)), Size: size}, nil
+}
+
+// ExportHandler streams an export archive of the whole library.
+func (c *PostController) ExportHandler(w http.ResponseWriter, r *http.Request) {
+	// The server's write timeout is meant for ordinary requests, not for
+	// downloading the whole library.
+	if err := http.NewResponseController(w).SetWriteDeadline(time.Time{}); err != nil {
+		slog.WarnContext(r.Context(), "Could not lift the write deadline for an export", "err", err)
+	}
+	filename := fmt.Sprintf("photopost-export-%s.zip", time.Now().UTC().Format("20060102-150405"))
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+	w.Header().Set("Cache-Control", "no-store")
+	counter := &countingWriter{w: w}
+	report, err := c.ExportArchive(r.Context(), counter)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Error while exporting", "err", err)
+		if counter.n == 0 {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		// The archive has been partly sent, so all that can be done is to
+		// cut it short; the zip will have no central directory.
+		panic(http.ErrAbortHandler)
+	}
+	slog.InfoContext(r.Context(), "Exported library", "posts", report.Posts, "images", report.Images)
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countingWriter) Write(b []byte) (int, error) {
+	n, err := cw.w.Write(b)
+	cw.n += int64(n)
+	return n, err
+}
+
+type RestoreReport struct {
+	Posts         int
+	Images        int
+	ExistingFiles int
+}
+
+// ImportArchive restores an export archive made by ExportArchive: every
+// image is checked against the manifest and stored, and the posts are saved
+// with their original IDs, post times and creation times. Nothing is
+// restored if any post ID is already taken.
+func (c *PostController) ImportArchive(ctx context.Context, archivePath string) (RestoreReport, error) {
+	var report RestoreReport
+	archive, err := zip.OpenReader(archivePath)
+	if err != nil {
+		return report, err
+	}
+	defer archive.Close()
+	manifest, err := readExportManifest(archive)
+	if err != nil {
+		return report, err
+	}
+	uploadsPath := c.configuration.Get().UploadsPath
+
+	posts := make([]*model.Post, 0, len(manifest.Posts))
+	for _, exported := range manifest.Posts {
+		if _, ok := manifest.Images[exported.Image]; !ok {
+			return report, fmt.Errorf("post %d: image %s is not in the manifest", exported.Id, exported.Image)
+		}
+		imageFile, err := archivedImageFile(uploadsPath, exported.Image)
+		if err != nil {
+			return report, fmt.Errorf("post %d: %w", exported.Id, err)
+		}
+		post := &model.Post{
+			Id:             exported.Id,
+			Title:          exported.Title,
+			Text:           exported.Text,
+			Author:         exported.Author,
+			Album:          exported.Album,
+			Tags:           exported.Tags,
+			PostTime:       exported.PostTime,
+			CreationTime:   exported.CreationTime,
+			ImageFile:      imageFile,
+			ContentHash:    exported.ContentHash,
+			PerceptualHash: exported.PerceptualHash,
+		}
+		if valid, validation_err := post.Validate(); !valid {
+			return report, fmt.Errorf("post %d: %w", post.Id, validation_err)
+		}
+		posts = append(posts, post)
+	}
+
+	var created []string
+	removeCreated := func() {
+		for _, imageFile := range created {
+			c.removeUnreferencedImage(ctx, imageFile)
+		}
+	}
+	names := make([]string, 0, len(manifest.Images))
+	for name := range manifest.Images {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if err := ctx.Err(); err != nil {
+			removeCreated()
+			return report, err
+		}
+		imageFile, err := archivedImageFile(uploadsPath, name)
+		if err != nil {
+			removeCreated()
+			return report, err
+		}
+		wasCreated, err := restoreImage(archive, name, manifest.Images[name], imageFile, uploadsPath)
+		if err != nil {
+			removeCreated()
+			return report, fmt.Errorf("image %s: %w", name, err)
+		}
+		if wasCreated {
+			created = append(created, imageFile)
+			report.Images++
+		} else {
+			report.ExistingFiles++
+		}
+	}
+	// The images were stored without holding c.images, since reading them
+	// can take a while, so make sure none was removed as unreferenced
+	// before the posts using them are saved.
+	c.images.RLock()
+	for _, post := range posts {
+		if _, err = os.Stat(post.ImageFile); err != nil {
+			err = fmt.Errorf("post %d: image was removed while restoring, try again: %w", post.Id, err)
+			break
+		}
+	}
+	if err == nil {
+		err = c.datastore.RestorePosts(posts)
+	}
+	c.images.RUnlock()
+	if err != nil {
+		removeCreated()
+		return report, err
+	}
+	report.Posts = len(posts)
+	return report, nil
+}
+
+// archivedImageFile is where an image in an archive is restored to. Names
+// that could escape the uploads directory, or be hidden in it, are refused.
+func archivedImageFile(uploadsPath string, name string) (string, error) {
+	base := path.Base(name)
+	if base == "/" || strings.HasPrefix(base, ".") || strings.ContainsRune(base, filepath.Separator) {
+		return "", fmt.Errorf("image name %q is not allowed", name)
+	}
+	return filepath.Join(uploadsPath, base), nil
+}
+
+func readExportManifest(archive *zip.ReadCloser) (*ExportManifest, error) {
+	f, err := archive.Open(exportManifest)
+	if err != nil {
+		return nil, fmt.Errorf("not a photopost export: %w", err)
+	}
+	defer f.Close()
+	var manifest ExportManifest
+	if err := json.NewDecoder(f).Decode(&manifest); err != nil {
+		return nil, fmt.Errorf("%s: %w", exportManifest, err)
+	}
+	if manifest.Format != exportFormat {
+		return nil, errors.New("not a photopost export")
+	}
+	if manifest.Version < 1 || manifest.Version > exportVersion {
+		return nil, fmt.Errorf("export format version %d is not supported by this version of photopost, which reads up to version %d", manifest.Version, exportVersion)
+	}
+	return &manifest, nil
+}
+
+// restoreImage copies an image out of the archive into the uploads directory
+// under imageFile, checking it against the manifest. created is false if the
+// file was already there.
+func restoreImage(archive *zip.ReadCloser, name string, expected ExportedImage, imageFile string, uploadsPath string) (created bool, err error) {
+	src, err := archive.Open(name)
+	if err != nil {
+		return false, err
+	}
+	defer src.Close()
+	tmp, err := os.CreateTemp(uploadsPath, tempUploadPattern)
+	if err != nil {
+		return false, err
+	}
+	img := &uploadedImage{tempPath: tmp.Name()}
+	defer img.discard()
+	hash := sha1.New()
+	img.size, err = io.Copy(io.MultiWriter(tmp, hash), src)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return false, err
+	}
+	if sum := fmt.Sprintf("%x", hash.Sum(nil)); sum != expected.SHA1 || img.size != expected.Size {
+		return false, errors.New("image does not match the manifest, the archive is corrupt")
+	}
+	return img.store(imageFile)
+}
@@ -0,0 +1,177 @@
+package controllers
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"github.com/mattgibbs/photopost/model"
+	"image/color"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// exportTestLibrary creates a few posts, with a gap in their IDs, and
+// exports them to a file.
+func exportTestLibrary(t *testing.T) (c *PostController, archivePath string) {
+	t.Helper()
+	c = newTestController(t, nil)
+	taken := time.Date(2019, 6, 1, 14, 30, 5, 0, time.UTC)
+	createTestPost(t, c, &model.Post{Title: "beach", Text: "Sand", Author: "Alice", Album: "Summer", Tags: []string{"sea", "sun"}, PostTime: taken}, testPNG(t, color.Black))
+	deleted := createTestPost(t, c, &model.Post{Title: "deleted", Author: "Alice", PostTime: taken}, testPNG(t, color.White))
+	createTestPost(t, c, &model.Post{Title: "fade", Author: "Bob", PostTime: taken.Add(time.Hour)}, gradientPNG(t))
+	createTestPost(t, c, &model.Post{Title: "beach again", Author: "Bob", PostTime: taken.Add(2 * time.Hour)}, testPNG(t, color.Black))
+	if err := c.datastore.DeletePost(deleted); err != nil {
+		t.Fatal(err)
+	}
+
+	archivePath = filepath.Join(t.TempDir(), "export.zip")
+	f, err := os.Create(archivePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	report, err := c.ExportArchive(context.Background(), f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (ExportReport{Posts: 3, Images: 2}); report != want {
+		t.Errorf("export report = %+v, want %+v", report, want)
+	}
+	return c, archivePath
+}
+
+// sortedPosts returns every post, in ID order.
+func sortedPosts(t *testing.T, c *PostController) []*model.Post {
+	t.Helper()
+	posts, err := c.datastore.FindAllPosts()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Slice(posts, func(i, j int) bool { return posts[i].Id < posts[j].Id })
+	return posts
+}
+
+func TestExportArchiveRoundTrip(t *testing.T) {
+	exported, archivePath := exportTestLibrary(t)
+	restored := newTestController(t, nil)
+	report, err := restored.ImportArchive(context.Background(), archivePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (RestoreReport{Posts: 3, Images: 2}); report != want {
+		t.Errorf("restore report = %+v, want %+v", report, want)
+	}
+
+	want, got := sortedPosts(t, exported), sortedPosts(t, restored)
+	if len(got) != len(want) {
+		t.Fatalf("%d posts were restored, want %d", len(got), len(want))
+	}
+	for i := range want {
+		w, g := *want[i], *got[i]
+		wantImage, err := os.ReadFile(w.ImageFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if gotImage, err := os.ReadFile(g.ImageFile); err != nil || !bytes.Equal(gotImage, wantImage) {
+			t.Errorf("post %d: the restored image differs: %v", w.Id, err)
+		}
+		if filepath.Dir(g.ImageFile) != restored.configuration.Get().UploadsPath || filepath.Base(g.ImageFile) != filepath.Base(w.ImageFile) {
+			t.Errorf("post %d: image restored to %s, want %s in the uploads directory", w.Id, g.ImageFile, filepath.Base(w.ImageFile))
+		}
+		if !g.PostTime.Equal(w.PostTime) || !g.CreationTime.Equal(w.CreationTime) {
+			t.Errorf("post %d: times = %v, %v, want %v, %v", w.Id, g.PostTime, g.CreationTime, w.PostTime, w.CreationTime)
+		}
+		w.ImageFile, g.ImageFile = "", ""
+		w.PostTime, g.PostTime, w.CreationTime, g.CreationTime = time.Time{}, time.Time{}, time.Time{}, time.Time{}
+		sort.Strings(w.Tags)
+		sort.Strings(g.Tags)
+		if !reflect.DeepEqual(g, w) {
+			t.Errorf("restored post = %+v, want %+v", g, w)
+		}
+	}
+}
+
+// rewriteArchive copies the archive at path, passing each file through
+// change.
+func rewriteArchive(t *testing.T, path string, change func(name string, data []byte) []byte) string {
+	t.Helper()
+	src, err := zip.OpenReader(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.Close()
+	var buf bytes.Buffer
+	dst := zip.NewWriter(&buf)
+	for _, file := range src.File {
+		r, err := file.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := io.ReadAll(r)
+		r.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		w, err := dst.Create(file.Name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write(change(file.Name, data))
+	}
+	if err := dst.Close(); err != nil {
+		t.Fatal(err)
+	}
+	rewritten := filepath.Join(t.TempDir(), "rewritten.zip")
+	if err := os.WriteFile(rewritten, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return rewritten
+}
+
+func TestImportArchiveRejectsTamperedImage(t *testing.T) {
+	_, archivePath := exportTestLibrary(t)
+	tampered := rewriteArchive(t, archivePath, func(name string, data []byte) []byte {
+		if strings.HasPrefix(name, exportImageDir+"/") {
+			data[len(data)-1] ^= 0xff
+		}
+		return data
+	})
+	restored := newTestController(t, nil)
+	if _, err := restored.ImportArchive(context.Background(), tampered); err == nil || !strings.Contains(err.Error(), "does not match the manifest") {
+		t.Errorf("ImportArchive = %v, want the image refused", err)
+	}
+	if posts := sortedPosts(t, restored); len(posts) != 0 {
+		t.Errorf("%d posts were restored from a corrupt archive", len(posts))
+	}
+	if matches, _ := filepath.Glob(filepath.Join(restored.configuration.Get().UploadsPath, "*.png")); len(matches) > 0 {
+		t.Errorf("images were left behind: %v", matches)
+	}
+}
+
+func TestImportArchiveRejectsTakenID(t *testing.T) {
+	_, archivePath := exportTestLibrary(t)
+	restored := newTestController(t, nil)
+	// The first post of the export gets ID 1, as does this one.
+	existing := createTestPost(t, restored, &model.Post{Title: "already here", Author: "Carol", PostTime: time.Now()}, testPNG(t, color.Gray{Y: 128}))
+	if existing.Id != 1 {
+		t.Fatalf("the existing post has ID %d, want 1", existing.Id)
+	}
+
+	if _, err := restored.ImportArchive(context.Background(), archivePath); err == nil {
+		t.Error("ImportArchive succeeded with a post ID already taken")
+	}
+	posts := sortedPosts(t, restored)
+	if len(posts) != 1 || posts[0].Title != "already here" {
+		t.Errorf("posts = %v, want only the existing one", posts)
+	}
+	matches, _ := filepath.Glob(filepath.Join(restored.configuration.Get().UploadsPath, "*.png"))
+	if len(matches) != 1 || matches[0] != existing.ImageFile {
+		t.Errorf("images = %v, want only the existing post's", matches)
+	}
+}
@@ -0,0 +1,152 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/mattgibbs/photopost/config"
+	"github.com/mattgibbs/photopost/model"
+	"log/slog"
+	"net/http"
+	"os"
+	"runtime"
+	"sync"
+	"time"
+)
+
+const (
+	datastoreCheckTimeout = 2 * time.Second
+	uploadsCheckTimeout   = 2 * time.Second
+)
+
+type BuildInfo struct {
+	Version       string `json:"version"`
+	Commit        string `json:"commit"`
+	GoVersion     string `json:"goVersion"`
+	SchemaVersion int    `json:"schemaVersion"`
+}
+
+type HealthController struct {
+	datastore     model.Datastore
+	configuration *config.Store
+	build         BuildInfo
+	// uploadsCheck is held while the uploads directory is checked, so that
+	// a hung filesystem ties up one goroutine rather than one per request.
+	uploadsCheck sync.Mutex
+}
+
+type checkResult struct {
+	Status   string  `json:"status"`
+	Error    string  `json:"error,omitempty"`
+	Duration float64 `json:"durationMs"`
+}
+
+func NewHealthController(ds model.Datastore, configuration *config.Store, version string, commit string) *HealthController {
+	c := new(HealthController)
+	c.datastore = ds
+	c.configuration = configuration
+	c.build = BuildInfo{
+		Version:   version,
+		Commit:    commit,
+		GoVersion: runtime.Version(),
+	}
+	return c
+}
+
+// Healthz reports that the process is up and serving requests.
+func (c *HealthController) Healthz(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, r, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// Readyz reports whether the server can handle traffic: the datastore must
+// answer and the uploads directory must be writable.
+func (c *HealthController) Readyz(w http.ResponseWriter, r *http.Request) {
+	checks := map[string]checkResult{
+		"datastore": runCheck(r.Context(), datastoreCheckTimeout, c.datastore.Ping),
+		"uploads":   runCheck(r.Context(), uploadsCheckTimeout, c.checkUploadsWritable),
+	}
+	status := http.StatusOK
+	overall := "ok"
+	for name, check := range checks {
+		if check.Status != "ok" {
+			slog.WarnContext(r.Context(), "Readiness check failed", "check", name, "err", check.Error)
+			status = http.StatusServiceUnavailable
+			overall = "unavailable"
+		}
+	}
+	writeJSON(w, r, status, map[string]interface{}{"status": overall, "checks": checks})
+}
+
+// Version reports what build of photopost is running.
+func (c *HealthController) Version(w http.ResponseWriter, r *http.Request) {
+	info := c.build
+	schemaVersion, err := c.datastore.SchemaVersion()
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Error while reading schema version", "err", err)
+	}
+	info.SchemaVersion = schemaVersion
+	writeJSON(w, r, http.StatusOK, info)
+}
+
+// checkUploadsWritable writes a file to the uploads directory. File
+// operations cannot be interrupted, so ctx is checked between them, and an
+// operation that finished after the deadline still fails the check.
+func (c *HealthController) checkUploadsWritable(ctx context.Context) error {
+	if !c.uploadsCheck.TryLock() {
+		return errors.New("an earlier check of the uploads directory has not finished")
+	}
+	defer c.uploadsCheck.Unlock()
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(c.configuration.Get().UploadsPath, ".readyz-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if err := ctx.Err(); err != nil {
+		f.Close()
+		return err
+	}
+	if _, err = f.Write([]byte("ok")); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return ctx.Err()
+}
+
+// runCheck runs check with its own timeout. A check that does not return in
+// time is reported as failed; it is left to finish in the background.
+func runCheck(ctx context.Context, timeout time.Duration, check func(ctx context.Context) error) checkResult {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	start := time.Now()
+	done := make(chan error, 1)
+	go func() {
+		done <- check(ctx)
+	}()
+	var err error
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	result := checkResult{Status: "ok", Duration: float64(time.Since(start).Microseconds()) / 1000}
+	if err != nil {
+		result.Status = "failed"
+		result.Error = err.Error()
+	}
+	return result
+}
+
+func writeJSON(w http.ResponseWriter, r *http.Request, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		slog.ErrorContext(r.Context(), "Error while encoding response", "err", err)
+	}
+}
@@ -0,0 +1,42 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestCheckUploadsWritable(t *testing.T) {
+	posts := newTestController(t, nil)
+	c := NewHealthController(posts.datastore, posts.configuration, "test", "")
+	uploadsPath := posts.configuration.Get().UploadsPath
+	if err := c.checkUploadsWritable(context.Background()); err != nil {
+		t.Errorf("checkUploadsWritable = %v, want success", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := c.checkUploadsWritable(ctx); !errors.Is(err, context.Canceled) {
+		t.Errorf("checkUploadsWritable after the deadline = %v, want it to give up", err)
+	}
+
+	// As if an earlier check were stuck writing to a hung filesystem.
+	c.uploadsCheck.Lock()
+	err := c.checkUploadsWritable(context.Background())
+	c.uploadsCheck.Unlock()
+	if err == nil {
+		t.Error("checkUploadsWritable succeeded while an earlier check was still running")
+	}
+
+	entries, err := os.ReadDir(uploadsPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name(), ".readyz-") {
+			t.Errorf("the check left %s in the uploads directory", entry.Name())
+		}
+	}
+}
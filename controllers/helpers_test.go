@@ -0,0 +1,96 @@
+package controllers
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"github.com/mattgibbs/photopost/config"
+	"github.com/mattgibbs/photopost/model"
+	"image"
+	"image/color"
+	"image/png"
+	"path/filepath"
+	"testing"
+)
+
+// newTestController returns a PostController backed by a new database and
+// uploads directory, with the default configuration changed by configure.
+func newTestController(t *testing.T, configure func(cfg *config.Config)) *PostController {
+	t.Helper()
+	dir := t.TempDir()
+	cfg := config.Default()
+	cfg.UploadsPath = dir
+	cfg.DatabaseURL = filepath.Join(dir, "photopost.db")
+	if configure != nil {
+		configure(&cfg)
+	}
+	datastore := model.NewSQLiteDatastore(cfg.DatabaseURL)
+	t.Cleanup(datastore.Close)
+	return NewPostController(datastore, config.NewStore(&cfg))
+}
+
+// testPNG encodes a small image whose left half is c and right half white,
+// so that images of different colours also have different perceptual
+// hashes.
+func testPNG(t *testing.T, c color.Color) []byte {
+	t.Helper()
+	img := image.NewRGBA(image.Rect(0, 0, 32, 16))
+	for y := 0; y < 16; y++ {
+		for x := 0; x < 32; x++ {
+			if x < 16 {
+				img.Set(x, y, c)
+			} else {
+				img.Set(x, y, color.White)
+			}
+		}
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// gradientPNG encodes a small image that fades from white on the left to
+// black on the right, which is not similar to any image from testPNG.
+func gradientPNG(t *testing.T) []byte {
+	t.Helper()
+	img := image.NewGray(image.Rect(0, 0, 32, 16))
+	for y := 0; y < 16; y++ {
+		for x := 0; x < 32; x++ {
+			img.SetGray(x, y, color.Gray{Y: uint8(255 - x*8)})
+		}
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// failingDatastore fails to save posts, as a database that is locked or on
+// a full disk would.
+type failingDatastore struct {
+	model.Datastore
+}
+
+func (failingDatastore) SavePost(post *model.Post) (int64, error) {
+	return -1, errors.New("database is locked")
+}
+
+// createTestPost posts data as PostCreate would, whatever it duplicates.
+func createTestPost(t *testing.T, c *PostController, post *model.Post, data []byte) *model.Post {
+	t.Helper()
+	img, err := receiveImage(bytes.NewReader(data), "image/png", "photo.png", c.configuration.Get())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer img.discard()
+	if post.Tags == nil {
+		post.Tags = []string{}
+	}
+	if _, err := c.createPost(context.Background(), post, img, duplicatesAllow); err != nil {
+		t.Fatal(err)
+	}
+	return post
+}
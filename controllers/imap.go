@@ -0,0 +1,151 @@
+package controllers
+
+import (
+	"bytes"
+	"context"
+	"github.com/mattgibbs/photopost/config"
+	"github.com/mattgibbs/photopost/imapclient"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// imapTimeout is how long each IMAP command, including fetching a message,
+// may take.
+const imapTimeout = 2 * time.Minute
+
+// imapLiteralSlack is how much larger than maxMailBytes a literal from the
+// IMAP server may be.
+const imapLiteralSlack = 64 << 10
+
+// PollIMAP checks the mailbox in imapURL every imapInterval until ctx is
+// done, turning each unread message into posts with PostsFromMail, just as
+// ServeSMTP does. Messages that were posted are marked as read and moved to
+// imapDoneMailbox. Messages that are rejected (an unknown sender, no images,
+// only duplicates) are marked as read and moved to imapRejectedMailbox, or
+// left in place if it is not set. Messages that fail for any other reason
+// are left unread, to be tried again next time.
+//
+// The settings are read before each check, so reloading the configuration
+// can change the mailbox or turn polling on and off.
+func (c *PostController) PollIMAP(ctx context.Context) {
+	for {
+		cfg := c.configuration.Get()
+		if cfg.IMAPURL != "" {
+			if err := c.pollMailbox(ctx, cfg); err != nil && ctx.Err() == nil {
+				slog.Error("Error while checking mailbox", "url", cfg.IMAPURL, "err", err)
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(cfg.IMAPInterval.Duration()):
+		}
+	}
+}
+
+// imapMailbox splits an imapURL into the server's address, whether to use
+// TLS, and the mailbox, which defaults to INBOX.
+func imapMailbox(imapURL string) (addr string, useTLS bool, mailbox string, err error) {
+	u, err := url.Parse(imapURL)
+	if err != nil {
+		return "", false, "", err
+	}
+	useTLS = u.Scheme == "imaps"
+	port := u.Port()
+	if port == "" {
+		port = "143"
+		if useTLS {
+			port = "993"
+		}
+	}
+	mailbox = strings.TrimPrefix(u.Path, "/")
+	if mailbox == "" {
+		mailbox = "INBOX"
+	}
+	return net.JoinHostPort(u.Hostname(), port), useTLS, mailbox, nil
+}
+
+func (c *PostController) pollMailbox(ctx context.Context, cfg *config.Config) error {
+	addr, useTLS, mailbox, err := imapMailbox(cfg.IMAPURL)
+	if err != nil {
+		return err
+	}
+	client, err := imapclient.Dial(addr, useTLS, imapTimeout)
+	if err != nil {
+		return err
+	}
+	// Messages over maxMailBytes are not fetched, so nothing larger needs to
+	// be read, give or take the odd header the server adds.
+	client.MaxLiteral = int(cfg.MaxMailBytes) + imapLiteralSlack
+	defer client.Logout()
+	if err := client.Login(cfg.IMAPUsername, cfg.IMAPPassword); err != nil {
+		return err
+	}
+	for _, box := range []string{cfg.IMAPDoneMailbox, cfg.IMAPRejectedMailbox} {
+		if box != "" {
+			if err := client.Create(box); err != nil {
+				return err
+			}
+		}
+	}
+	if err := client.Select(mailbox); err != nil {
+		return err
+	}
+	uids, err := client.SearchUnseen()
+	if err != nil {
+		return err
+	}
+	for _, uid := range uids {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := c.postMailboxMessage(ctx, cfg, client, uid); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// postMailboxMessage posts one message and files it away. The error is only
+// for problems with the connection; problems with the message are logged.
+func (c *PostController) postMailboxMessage(ctx context.Context, cfg *config.Config, client *imapclient.Client, uid uint32) error {
+	size, err := client.Size(uid)
+	if err != nil {
+		return err
+	}
+	var report MailReport
+	if size > cfg.MaxMailBytes {
+		err = errorWithStatus(http.StatusRequestEntityTooLarge, "the message is larger than the %d byte limit", cfg.MaxMailBytes)
+	} else {
+		var data []byte
+		data, err = client.Fetch(uid)
+		if err != nil {
+			return err
+		}
+		report, err = c.PostsFromMail(ctx, bytes.NewReader(data))
+	}
+	if err == nil {
+		slog.InfoContext(ctx, "Posted photos from mailbox", "uid", uid, "posts", report.Posts, "duplicates", report.Duplicates)
+		if err := client.MarkSeen(uid); err != nil {
+			return err
+		}
+		return client.Move(uid, cfg.IMAPDoneMailbox)
+	}
+	reason, permanent := mailRejected(err)
+	if !permanent {
+		slog.ErrorContext(ctx, "Could not post photos from mailbox, will try again", "uid", uid, "err", err)
+		return nil
+	}
+	slog.WarnContext(ctx, "Rejected message in mailbox", "uid", uid, "reason", reason)
+	if err := client.MarkSeen(uid); err != nil {
+		return err
+	}
+	if cfg.IMAPRejectedMailbox != "" {
+		return client.Move(uid, cfg.IMAPRejectedMailbox)
+	}
+	return nil
+}
@@ -0,0 +1,90 @@
+package controllers
+
+import (
+	"context"
+	"github.com/mattgibbs/photopost/config"
+	"github.com/mattgibbs/photopost/imapclient"
+	"github.com/mattgibbs/photopost/imapclient/imaptest"
+	"image/color"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestPostMailboxMessage(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		sender   string
+		rejected string
+		// broken makes posting fail for a reason that is not the
+		// message's fault, and failSave makes saving the post fail.
+		broken   bool
+		failSave bool
+		// mailbox is where the message should end up, and seen whether it
+		// should be marked as read.
+		mailbox string
+		seen    bool
+		posts   int
+	}{
+		{name: "done", sender: "alice@example.com", rejected: "Rejected", mailbox: "Photopost", seen: true, posts: 1},
+		{name: "rejected", sender: "mallory@example.com", rejected: "Rejected", mailbox: "Rejected", seen: true},
+		{name: "rejected without a mailbox", sender: "mallory@example.com", mailbox: "INBOX", seen: true},
+		{name: "left unread", sender: "alice@example.com", rejected: "Rejected", broken: true, mailbox: "INBOX"},
+		{name: "left unread after a database error", sender: "alice@example.com", rejected: "Rejected", failSave: true, mailbox: "INBOX"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestController(t, func(cfg *config.Config) {
+				cfg.MailSenders = map[string]string{"alice@example.com": "Alice"}
+				cfg.IMAPDoneMailbox = "Photopost"
+				cfg.IMAPRejectedMailbox = tt.rejected
+				if tt.broken {
+					cfg.UploadsPath = filepath.Join(cfg.UploadsPath, "missing")
+				}
+			})
+			if tt.failSave {
+				c.datastore = failingDatastore{c.datastore}
+			}
+			cfg := c.configuration.Get()
+			server := imaptest.NewServer("MOVE")
+			defer server.Close()
+			uid := server.Add("INBOX", []byte(photoMail(tt.sender, testPNG(t, color.Black))))
+
+			client, err := imapclient.Dial(server.Addr, false, 5*time.Second)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer client.Close()
+			if err := client.Login("photos", "secret"); err != nil {
+				t.Fatal(err)
+			}
+			for _, box := range []string{cfg.IMAPDoneMailbox, cfg.IMAPRejectedMailbox} {
+				if box != "" {
+					if err := client.Create(box); err != nil {
+						t.Fatal(err)
+					}
+				}
+			}
+			if err := client.Select("INBOX"); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := c.postMailboxMessage(context.Background(), cfg, client, uid); err != nil {
+				t.Fatalf("postMailboxMessage: %s", err)
+			}
+			messages, _ := server.Mailbox(tt.mailbox)
+			if len(messages) != 1 {
+				t.Fatalf("%s has %d messages, want the message", tt.mailbox, len(messages))
+			}
+			if messages[0].Seen != tt.seen {
+				t.Errorf("seen = %t, want %t", messages[0].Seen, tt.seen)
+			}
+			posts, err := c.datastore.FindAllPosts()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(posts) != tt.posts {
+				t.Errorf("%d posts were created, want %d", len(posts), tt.posts)
+			}
+		})
+	}
+}
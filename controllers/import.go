@@ -0,0 +1,383 @@
+package controllers
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/mattgibbs/photopost/config"
+	"github.com/mattgibbs/photopost/exif"
+	"github.com/mattgibbs/photopost/model"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ImportOptions control ImportDirectory and ImportTakeout. Author, Album and
+// Tags apply to every imported post unless its sidecar says otherwise.
+type ImportOptions struct {
+	Workers    int
+	DryRun     bool
+	Duplicates string
+	Author     string
+	Album      string
+	Tags       []string
+}
+
+type ImportReport struct {
+	Files      int
+	Created    int
+	Duplicates int
+	Skipped    int
+	Failed     int
+	// Resumed is the number of files skipped because an earlier, interrupted
+	// run had already imported them.
+	Resumed int
+}
+
+// importSidecar describes a photo. For ImportDirectory it is read from the
+// optional JSON file named after the photo with ".json" either added
+// ("IMG_1234.jpg.json") or replacing its extension ("IMG_1234.json"), or
+// else from an XMP sidecar ("IMG_1234.xmp") such as Apple Photos exports.
+type importSidecar struct {
+	Title    string   `json:"title"`
+	Text     string   `json:"text"`
+	Author   string   `json:"author"`
+	Album    string   `json:"album"`
+	Tags     []string `json:"tags"`
+	PostTime string   `json:"postTime"`
+}
+
+// importItem is one file to import, from a directory or an archive. open may
+// be called more than once.
+type importItem struct {
+	name     string
+	modTime  time.Time
+	open     func() (io.ReadCloser, error)
+	describe func() (importSidecar, error)
+}
+
+// importRun is the state shared by the workers of one import.
+type importRun struct {
+	opts    ImportOptions
+	policy  string
+	out     io.Writer
+	journal *importJournal
+
+	// saving is held while a post is checked for duplicates and saved, so
+	// that two copies of an image in the tree are not both created.
+	saving sync.Mutex
+	seen   map[string]string
+
+	mu     sync.Mutex
+	report ImportReport
+}
+
+// ImportDirectory creates a post for every image in the tree under dir, the
+// same way PostCreate would, writing a line to out for each file. Each post's
+// title comes from its sidecar or its filename, and its post time from the
+// sidecar, the photo's EXIF date or the file's modification time. Duplicates
+// are handled with opts.Duplicates, which defaults to "reject" so that
+// importing a tree twice is harmless. With opts.DryRun, nothing is saved.
+func (c *PostController) ImportDirectory(ctx context.Context, dir string, opts ImportOptions, out io.Writer) (ImportReport, error) {
+	var items []importItem
+	err := filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if strings.HasPrefix(entry.Name(), ".") && path != dir {
+			if entry.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !entry.Type().IsRegular() || isSidecarFile(path) {
+			return nil
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		items = append(items, importItem{
+			name:     path,
+			modTime:  info.ModTime(),
+			open:     func() (io.ReadCloser, error) { return os.Open(path) },
+			describe: func() (importSidecar, error) { return readSidecar(path) },
+		})
+		return nil
+	})
+	if err != nil {
+		return ImportReport{}, err
+	}
+	return c.importItems(ctx, items, opts, nil, out)
+}
+
+// importItems imports items with opts.Workers workers. Items already in the
+// journal are skipped, and each item that is imported, or found to be a
+// duplicate, is added to it.
+func (c *PostController) importItems(ctx context.Context, items []importItem, opts ImportOptions, journal *importJournal, out io.Writer) (ImportReport, error) {
+	if opts.Duplicates == "" {
+		opts.Duplicates = duplicatesReject
+	}
+	policy, err := duplicatePolicy(url.Values{"duplicates": {opts.Duplicates}}, c.configuration.Get())
+	if err != nil {
+		return ImportReport{}, err
+	}
+	if opts.Workers < 1 {
+		opts.Workers = 1
+	}
+	run := &importRun{opts: opts, policy: policy, out: out, journal: journal, seen: map[string]string{}}
+	jobs := make(chan importItem)
+	var workers sync.WaitGroup
+	for i := 0; i < opts.Workers; i++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			for item := range jobs {
+				c.importFile(ctx, run, item)
+			}
+		}()
+	}
+feed:
+	for _, item := range items {
+		if journal.done(item.name) {
+			run.mu.Lock()
+			run.report.Resumed++
+			run.mu.Unlock()
+			continue
+		}
+		select {
+		case jobs <- item:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(jobs)
+	workers.Wait()
+	return run.report, ctx.Err()
+}
+
+func (run *importRun) record(counter *int, format string, args ...interface{}) {
+	run.mu.Lock()
+	defer run.mu.Unlock()
+	run.report.Files++
+	*counter++
+	fmt.Fprintf(run.out, format+"\n", args...)
+}
+
+// finish records an item as dealt with, so that resuming the import skips
+// it. Failed items are not finished, and are retried.
+func (run *importRun) finish(item importItem) {
+	if run.opts.DryRun {
+		return
+	}
+	if err := run.journal.add(item.name); err != nil {
+		slog.Error("Error while recording imported file", "file", item.name, "err", err)
+	}
+}
+
+// importFile imports one file, recording the outcome in run.
+func (c *PostController) importFile(ctx context.Context, run *importRun, item importItem) {
+	cfg := c.configuration.Get()
+	src, err := item.open()
+	if err != nil {
+		run.record(&run.report.Failed, "failed: %s: %s", item.name, err)
+		return
+	}
+	defer src.Close()
+	reader := bufio.NewReaderSize(src, 512)
+	contentType, err := sniffContentType(reader)
+	if err != nil {
+		run.record(&run.report.Failed, "failed: %s: %s", item.name, err)
+		return
+	}
+	if !validateImageFile(contentType, cfg.AllowedTypes) {
+		run.record(&run.report.Skipped, "skipped: %s: %s is not an allowed image type", item.name, contentType)
+		return
+	}
+	post, err := importPost(item, run.opts, configuredLocation(cfg))
+	if err != nil {
+		run.record(&run.report.Failed, "failed: %s: %s", item.name, err)
+		return
+	}
+	img, err := receiveImage(reader, contentType, item.name, cfg)
+	if err != nil {
+		run.record(&run.report.Failed, "failed: %s: %s", item.name, err)
+		return
+	}
+	defer img.discard()
+	// Decoding the image is the slow part, so do it before taking the lock.
+	if _, err := img.perceptualHash(); err != nil {
+		run.record(&run.report.Failed, "failed: %s: %s", item.name, err)
+		return
+	}
+
+	run.saving.Lock()
+	defer run.saving.Unlock()
+	contentHash := fmt.Sprintf("%x", img.hash)
+	if first, ok := run.seen[contentHash]; ok && run.policy != duplicatesAllow {
+		run.record(&run.report.Duplicates, "duplicate: %s: same image as %s", item.name, first)
+		run.finish(item)
+		return
+	}
+	var duplicates []DuplicateMatch
+	if run.opts.DryRun {
+		duplicates, err = c.checkNewPost(ctx, post, img, run.policy)
+	} else {
+		duplicates, err = c.createPost(ctx, post, img, run.policy)
+	}
+	var dupErr *duplicateError
+	if errors.As(err, &dupErr) {
+		run.record(&run.report.Duplicates, "duplicate: %s: %s", item.name, describeDuplicates(dupErr.matches))
+		run.finish(item)
+		return
+	}
+	if err != nil {
+		run.record(&run.report.Failed, "failed: %s: %s", item.name, err)
+		return
+	}
+	run.seen[contentHash] = item.name
+	run.finish(item)
+	note := ""
+	if len(duplicates) > 0 {
+		note = fmt.Sprintf(" (%s)", describeDuplicates(duplicates))
+	}
+	if run.opts.DryRun {
+		run.record(&run.report.Created, "would create: %s%s", item.name, note)
+		return
+	}
+	slog.DebugContext(ctx, "Imported image", "file", item.name, "post_id", post.Id)
+	run.record(&run.report.Created, "created: %s: post %d%s", item.name, post.Id, note)
+}
+
+// importPost builds the post for an image from its sidecar, the import
+// options and the filename. Its post time is taken from the sidecar, the
+// photo's EXIF date or the file's modification time, in that order. EXIF
+// dates without an offset are read in loc.
+func importPost(item importItem, opts ImportOptions, loc *time.Location) (*model.Post, error) {
+	sidecar, err := item.describe()
+	if err != nil {
+		return nil, err
+	}
+	fields := url.Values{}
+	fields.Set("title", firstNonEmpty(sidecar.Title, titleFromFilename(item.name)))
+	fields.Set("text", sidecar.Text)
+	fields.Set("author", firstNonEmpty(sidecar.Author, opts.Author))
+	fields.Set("album", firstNonEmpty(sidecar.Album, opts.Album))
+	fields["tags"] = append(append([]string{}, opts.Tags...), sidecar.Tags...)
+	fields.Set("postTime", sidecar.PostTime)
+	post, err := postFromFields(fields)
+	if err != nil {
+		return nil, err
+	}
+	if post.PostTime.IsZero() {
+		post.PostTime = item.modTime
+		if src, err := item.open(); err == nil {
+			if taken, err := exif.DateTaken(src, loc); err == nil {
+				post.PostTime = taken
+			}
+			src.Close()
+		}
+	}
+	return post, nil
+}
+
+// sidecarNames lists the files that may be the sidecar of an image, JSON
+// ones first since they take precedence.
+func sidecarNames(path string) (jsonNames []string, xmpNames []string) {
+	stem := strings.TrimSuffix(path, filepath.Ext(path))
+	return []string{path + ".json", stem + ".json"}, []string{stem + ".xmp", stem + ".XMP", path + ".xmp"}
+}
+
+// readSidecar reads the sidecar of an image, if it has one.
+func readSidecar(path string) (importSidecar, error) {
+	var sidecar importSidecar
+	jsonNames, xmpNames := sidecarNames(path)
+	for _, name := range jsonNames {
+		data, err := os.ReadFile(name)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return sidecar, err
+		}
+		if err := json.Unmarshal(data, &sidecar); err != nil {
+			return sidecar, fmt.Errorf("sidecar %s: %w", name, err)
+		}
+		return sidecar, nil
+	}
+	for _, name := range xmpNames {
+		sidecar, err := readXMPSidecar(name)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return sidecar, fmt.Errorf("sidecar %s: %w", name, err)
+		}
+		return sidecar, nil
+	}
+	return sidecar, nil
+}
+
+func isSidecarFile(path string) bool {
+	ext := filepath.Ext(path)
+	return strings.EqualFold(ext, ".json") || strings.EqualFold(ext, ".xmp")
+}
+
+// titleFromFilename turns "2019-06-01_beach-day.jpg" into
+// "2019-06-01 beach-day".
+func titleFromFilename(path string) string {
+	name := filepath.Base(path)
+	name = strings.TrimSuffix(name, filepath.Ext(name))
+	return strings.TrimSpace(strings.ReplaceAll(name, "_", " "))
+}
+
+// configuredLocation returns the configured time zone, or the server's if
+// it cannot be loaded.
+func configuredLocation(cfg *config.Config) *time.Location {
+	loc, err := time.LoadLocation(cfg.TimeZone)
+	if err != nil {
+		return time.Local
+	}
+	return loc
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, v := range values {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// sniffContentType detects the type of a file from its first bytes, as a
+// browser would, rather than trusting its extension. The bytes are only
+// peeked at, so r still starts at the beginning of the file.
+func sniffContentType(r *bufio.Reader) (string, error) {
+	head, err := r.Peek(512)
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+	return http.DetectContentType(head), nil
+}
+
+func describeDuplicates(matches []DuplicateMatch) string {
+	var parts []string
+	for _, m := range matches {
+		if m.Exact {
+			parts = append(parts, fmt.Sprintf("same image as post %d", m.PostId))
+		} else {
+			parts = append(parts, fmt.Sprintf("looks like post %d (distance %d)", m.PostId, m.Distance))
+		}
+	}
+	return strings.Join(parts, ", ")
+}
@@ -0,0 +1,158 @@
+package controllers
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"github.com/mattgibbs/photopost/config"
+	"image/color"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+)
+
+// writeFiles writes files, named relative to dir, creating directories as
+// needed.
+func writeFiles(t *testing.T, dir string, files map[string][]byte) {
+	t.Helper()
+	for name, data := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, data, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestImportDirectory(t *testing.T) {
+	c := newTestController(t, nil)
+	dir := t.TempDir()
+	black := testPNG(t, color.Black)
+	writeFiles(t, dir, map[string][]byte{
+		"beach.png": black,
+		// The JSON sidecar takes precedence over the XMP one.
+		"beach.png.json": []byte(`{"title": "From JSON", "tags": ["json"]}`),
+		"beach.xmp":      []byte(`<x:xmpmeta xmlns:x="adobe:ns:meta/"><rdf:RDF xmlns:rdf="http://www.w3.org/1999/02/22-rdf-syntax-ns#"><rdf:Description xmlns:dc="http://purl.org/dc/elements/1.1/"><dc:title><rdf:Alt><rdf:li>From XMP</rdf:li></rdf:Alt></dc:title></rdf:Description></rdf:RDF></x:xmpmeta>`),
+		"2019/fade.png":  gradientPNG(t),
+		"2019/fade.xmp":  []byte(`<rdf:RDF xmlns:rdf="http://www.w3.org/1999/02/22-rdf-syntax-ns#"><rdf:Description xmlns:dc="http://purl.org/dc/elements/1.1/"><dc:title><rdf:Alt><rdf:li>Fade</rdf:li></rdf:Alt></dc:title></rdf:Description></rdf:RDF>`),
+		"copy/beach.png": black,
+		"notes.txt":      []byte("not a photo"),
+		".trash/old.png": black,
+	})
+
+	var out bytes.Buffer
+	report, err := c.ImportDirectory(context.Background(), dir, ImportOptions{DryRun: true, Author: "Importer", Workers: 2}, &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := ImportReport{Files: 4, Created: 2, Duplicates: 1, Skipped: 1}
+	if report != want {
+		t.Errorf("dry run report = %+v, want %+v\n%s", report, want, out.String())
+	}
+	if posts, _ := c.datastore.FindAllPosts(); len(posts) != 0 {
+		t.Errorf("the dry run created %d posts", len(posts))
+	}
+	if matches, _ := filepath.Glob(filepath.Join(c.configuration.Get().UploadsPath, "*.png")); len(matches) > 0 {
+		t.Errorf("the dry run stored images: %v", matches)
+	}
+
+	out.Reset()
+	report, err = c.ImportDirectory(context.Background(), dir, ImportOptions{Author: "Importer", Workers: 2}, &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report != want {
+		t.Errorf("report = %+v, want %+v\n%s", report, want, out.String())
+	}
+	posts, err := c.datastore.FindAllPosts()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var titles []string
+	for _, post := range posts {
+		titles = append(titles, post.Title)
+		if post.Author != "Importer" {
+			t.Errorf("post %q is by %q, want the import's author", post.Title, post.Author)
+		}
+	}
+	sort.Strings(titles)
+	if len(titles) != 2 || titles[0] != "Fade" || titles[1] != "From JSON" {
+		t.Errorf("titles = %q, want the sidecars' titles", titles)
+	}
+
+	// Importing the tree again creates nothing.
+	out.Reset()
+	report, err = c.ImportDirectory(context.Background(), dir, ImportOptions{Author: "Importer"}, &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (ImportReport{Files: 4, Duplicates: 3, Skipped: 1}); report != want {
+		t.Errorf("second report = %+v, want %+v\n%s", report, want, out.String())
+	}
+}
+
+func TestImportDirectoryWorkers(t *testing.T) {
+	c := newTestController(t, nil)
+	dir := t.TempDir()
+	files := map[string][]byte{}
+	for i := 0; i < 20; i++ {
+		files[filepath.Join(string(rune('a'+i%4)), string(rune('a'+i))+".png")] = testPNG(t, color.Black)
+	}
+	writeFiles(t, dir, files)
+
+	report, err := c.ImportDirectory(context.Background(), dir, ImportOptions{Author: "Importer", Duplicates: duplicatesAllow, Workers: 8}, io.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (ImportReport{Files: 20, Created: 20}); report != want {
+		t.Errorf("report = %+v, want %+v", report, want)
+	}
+	if posts, _ := c.datastore.FindAllPosts(); len(posts) != 20 {
+		t.Errorf("%d posts were created, want 20", len(posts))
+	}
+}
+
+// exifJPEG returns the start of a JPEG file whose EXIF DateTime is date.
+func exifJPEG(date string) []byte {
+	tiff := []byte("MM\x00\x2a\x00\x00\x00\x08\x00\x01")
+	tiff = binary.BigEndian.AppendUint16(tiff, 0x0132)
+	tiff = binary.BigEndian.AppendUint16(tiff, 2)
+	tiff = binary.BigEndian.AppendUint32(tiff, uint32(len(date)+1))
+	tiff = binary.BigEndian.AppendUint32(tiff, 8+2+12+4)
+	tiff = append(tiff, 0, 0, 0, 0)
+	tiff = append(append(tiff, date...), 0)
+	app1 := append([]byte("Exif\x00\x00"), tiff...)
+	jpeg := []byte{0xff, 0xd8, 0xff, 0xe1}
+	jpeg = binary.BigEndian.AppendUint16(jpeg, uint16(len(app1)+2))
+	return append(append(jpeg, app1...), 0xff, 0xd9)
+}
+
+func TestImportPostTimeZone(t *testing.T) {
+	loc, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skip(err)
+	}
+	c := newTestController(t, func(cfg *config.Config) {
+		cfg.TimeZone = "America/New_York"
+	})
+	item := importItem{
+		name:    "photo.jpg",
+		modTime: time.Now(),
+		open: func() (io.ReadCloser, error) {
+			return io.NopCloser(bytes.NewReader(exifJPEG("2019:06:01 14:30:05"))), nil
+		},
+		describe: func() (importSidecar, error) { return importSidecar{}, nil },
+	}
+	post, err := importPost(item, ImportOptions{Author: "Importer"}, configuredLocation(c.configuration.Get()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := time.Date(2019, 6, 1, 14, 30, 5, 0, loc); !post.PostTime.Equal(want) {
+		t.Errorf("post time = %v, want %v in the configured time zone", post.PostTime, want)
+	}
+}
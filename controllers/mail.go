@@ -0,0 +1,358 @@
+package controllers
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"github.com/mattgibbs/photopost/config"
+	"github.com/mattgibbs/photopost/exif"
+	"github.com/mattgibbs/photopost/model"
+	"github.com/mattgibbs/photopost/smtpd"
+	"html"
+	"io"
+	"log/slog"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/http"
+	"net/mail"
+	"net/textproto"
+	"net/url"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// maxMailParts stops a message with a huge number of tiny MIME parts from
+// being worked through.
+const maxMailParts = 100
+
+var (
+	errMailSenderNotAllowed = errorWithStatus(http.StatusForbidden, "the sender is not allowed to post by email")
+	errMailNoImages         = errorWithStatus(http.StatusUnprocessableEntity, "the message has no image attachments")
+)
+
+// MailReport lists the posts created from an email, and how many of its
+// images were left out as duplicates.
+type MailReport struct {
+	Posts      []int64
+	Duplicates int
+}
+
+// mailSubmission is what is kept of an email: who sent it, its subject and
+// text, and its images, which have been received into temporary files.
+type mailSubmission struct {
+	from    *mail.Address
+	date    time.Time
+	subject string
+	text    string
+	html    string
+	images  []*uploadedImage
+	parts   int
+}
+
+func (m *mailSubmission) discard() {
+	for _, img := range m.images {
+		img.discard()
+	}
+}
+
+// PostsFromMail creates a post for every image attached to an email, titled
+// with its subject and with its body as the text. The sender, from the
+// From header, must be listed in mailSenders, which gives the author of the
+// posts. Each post's time is the photo's EXIF date if it has one, or else
+// the date of the message. Images that duplicate existing posts are handled
+// with the configured duplicatePolicy.
+func (c *PostController) PostsFromMail(ctx context.Context, r io.Reader) (MailReport, error) {
+	var report MailReport
+	cfg := c.configuration.Get()
+	msg, err := mail.ReadMessage(io.LimitReader(r, cfg.MaxMailBytes))
+	if err != nil {
+		return report, errorWithStatus(http.StatusBadRequest, "could not read the message: %s", err)
+	}
+	from, err := msg.Header.AddressList("From")
+	if err != nil || len(from) != 1 {
+		return report, errorWithStatus(http.StatusBadRequest, "the message must have one From address")
+	}
+	author, ok := mailSender(cfg, from[0])
+	if !ok {
+		return report, errMailSenderNotAllowed
+	}
+
+	submission := &mailSubmission{from: from[0], subject: decodeMailHeader(msg.Header.Get("Subject"))}
+	defer submission.discard()
+	if date, err := msg.Header.Date(); err == nil {
+		submission.date = date
+	}
+	if err := readMailPart(submission, textproto.MIMEHeader(msg.Header), msg.Body, cfg); err != nil {
+		return report, err
+	}
+	if len(submission.images) == 0 {
+		return report, errMailNoImages
+	}
+	text := submission.text
+	if text == "" && submission.html != "" {
+		text = htmlToText(submission.html)
+	}
+	text = stripSignature(text)
+
+	policy, err := duplicatePolicy(url.Values{}, cfg)
+	if err != nil {
+		return report, err
+	}
+	// The error returned is the first one, unless a later one is worth
+	// trying again for, which must not be hidden by one that is not.
+	var firstErr error
+	keepErr := func(err error) {
+		if firstErr == nil {
+			firstErr = err
+		} else if _, permanent := mailRejected(err); !permanent {
+			if _, permanent := mailRejected(firstErr); permanent {
+				firstErr = err
+			}
+		}
+	}
+	for _, img := range submission.images {
+		post := &model.Post{
+			Title:  firstNonEmpty(submission.subject, titleFromFilename(img.filename)),
+			Text:   text,
+			Author: author,
+			Tags:   []string{},
+		}
+		post.PostTime = submission.date
+		if f, err := os.Open(img.tempPath); err == nil {
+			if taken, err := exif.DateTaken(f, configuredLocation(cfg)); err == nil {
+				post.PostTime = taken
+			}
+			f.Close()
+		}
+		_, err := c.createPost(ctx, post, img, policy)
+		var dupErr *duplicateError
+		if errors.As(err, &dupErr) {
+			slog.InfoContext(ctx, "Emailed image duplicates existing posts, not posted", "from", submission.from.Address, "filename", img.filename, "duplicates", describeDuplicates(dupErr.matches))
+			report.Duplicates++
+			keepErr(err)
+			continue
+		}
+		if err != nil {
+			slog.WarnContext(ctx, "Could not post emailed image", "from", submission.from.Address, "filename", img.filename, "err", err)
+			keepErr(err)
+			continue
+		}
+		report.Posts = append(report.Posts, post.Id)
+	}
+	// The message counts as delivered if anything in it was posted, since
+	// sending it again would only post those images twice.
+	if len(report.Posts) == 0 {
+		return report, firstErr
+	}
+	slog.InfoContext(ctx, "Created posts from email", "from", submission.from.Address, "posts", report.Posts, "duplicates", report.Duplicates)
+	return report, nil
+}
+
+// mailSender looks the sender up in mailSenders, ignoring case. A sender
+// listed without a name posts as the name in their From header, or else
+// their address.
+func mailSender(cfg *config.Config, from *mail.Address) (string, bool) {
+	for address, author := range cfg.MailSenders {
+		if strings.EqualFold(address, from.Address) {
+			return firstNonEmpty(author, from.Name, from.Address), true
+		}
+	}
+	return "", false
+}
+
+// readMailPart reads one MIME part of a message, and the parts inside it.
+// The first plain text and HTML parts that are not attachments are kept as
+// the text, and images are received like uploads.
+func readMailPart(m *mailSubmission, header textproto.MIMEHeader, body io.Reader, cfg *config.Config) error {
+	m.parts++
+	if m.parts > maxMailParts {
+		return errorWithStatus(http.StatusUnprocessableEntity, "the message has more than %d parts", maxMailParts)
+	}
+	mediaType, params, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil {
+		mediaType, params = "text/plain", map[string]string{}
+	}
+	if strings.HasPrefix(mediaType, "multipart/") {
+		reader := multipart.NewReader(body, params["boundary"])
+		for {
+			// NextRawPart, since the transfer encoding is undone below for
+			// the top level body too.
+			part, err := reader.NextRawPart()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return errorWithStatus(http.StatusBadRequest, "could not read the message: %s", err)
+			}
+			if err := readMailPart(m, part.Header, part, cfg); err != nil {
+				return err
+			}
+		}
+	}
+
+	switch strings.ToLower(header.Get("Content-Transfer-Encoding")) {
+	case "base64":
+		// The decoder skips the line breaks.
+		body = base64.NewDecoder(base64.StdEncoding, body)
+	case "quoted-printable":
+		body = quotedprintable.NewReader(body)
+	}
+	disposition, dispositionParams, _ := mime.ParseMediaType(header.Get("Content-Disposition"))
+	filename := firstNonEmpty(dispositionParams["filename"], params["name"])
+	attachment := disposition == "attachment" || filename != ""
+
+	switch {
+	case mediaType == "text/plain" && !attachment && m.text == "":
+		text, err := io.ReadAll(io.LimitReader(body, 1<<20))
+		if err != nil {
+			return err
+		}
+		m.text = strings.TrimSpace(strings.ReplaceAll(string(text), "\r\n", "\n"))
+	case mediaType == "text/html" && !attachment && m.html == "":
+		text, err := io.ReadAll(io.LimitReader(body, 1<<20))
+		if err != nil {
+			return err
+		}
+		m.html = string(text)
+	case strings.HasPrefix(mediaType, "image/") || mediaType == "application/octet-stream":
+		// Trust the image's contents rather than its declared type, which
+		// mail clients often get wrong.
+		reader := bufio.NewReaderSize(body, 512)
+		contentType, err := sniffContentType(reader)
+		if err != nil {
+			return err
+		}
+		if !validateImageFile(contentType, cfg.AllowedTypes) {
+			slog.Debug("Skipping email attachment that is not an allowed image", "filename", filename, "type", contentType)
+			return nil
+		}
+		img, err := receiveImage(reader, contentType, path.Base(filename), cfg)
+		if err != nil {
+			return err
+		}
+		m.images = append(m.images, img)
+	}
+	return nil
+}
+
+// decodeMailHeader decodes RFC 2047 encoded words, as in
+// "=?UTF-8?Q?Gr=C3=BC=C3=9Fe?=".
+func decodeMailHeader(value string) string {
+	decoded, err := new(mime.WordDecoder).DecodeHeader(value)
+	if err != nil {
+		return strings.TrimSpace(value)
+	}
+	return strings.TrimSpace(decoded)
+}
+
+var (
+	htmlBreaks = regexp.MustCompile(`(?i)<br\s*/?>|</p>|</div>`)
+	htmlTags   = regexp.MustCompile(`(?s)<style.*?</style>|<script.*?</script>|<[^>]*>`)
+	blankLines = regexp.MustCompile(`\n\s*\n\s*\n+`)
+)
+
+// htmlToText makes plain text of an HTML body, for mail clients that send
+// no plain text part.
+func htmlToText(body string) string {
+	text := htmlBreaks.ReplaceAllString(body, "\n")
+	text = htmlTags.ReplaceAllString(text, "")
+	text = html.UnescapeString(text)
+	var lines []string
+	for _, line := range strings.Split(text, "\n") {
+		lines = append(lines, strings.TrimSpace(line))
+	}
+	return strings.TrimSpace(blankLines.ReplaceAllString(strings.Join(lines, "\n"), "\n\n"))
+}
+
+// stripSignature removes a signature that follows the standard "-- "
+// separator line, and phone mail footers such as "Sent from my iPhone".
+func stripSignature(text string) string {
+	lines := strings.Split(text, "\n")
+	for i, line := range lines {
+		if line == "-- " || line == "--" || strings.HasPrefix(line, "Sent from my ") {
+			lines = lines[:i]
+			break
+		}
+	}
+	return strings.TrimSpace(strings.Join(lines, "\n"))
+}
+
+// ServeSMTP receives email on smtpAddr until ctx is done, and turns each
+// message into posts with PostsFromMail. Only mail for smtpRecipients is
+// accepted, if any are listed.
+//
+// The From header of a message is easy to forge, so the listener should only
+// be reachable from a mail server that checks senders (SPF, DKIM) and
+// forwards to it, or from a trusted network.
+func (c *PostController) ServeSMTP(ctx context.Context) {
+	cfg := c.configuration.Get()
+	if cfg.SMTPAddr == "" {
+		return
+	}
+	slog.Info("Receiving mail", "addr", cfg.SMTPAddr)
+	if err := c.smtpServer(cfg).ListenAndServe(ctx); err != nil {
+		slog.Error("SMTP listener stopped", "err", err)
+	}
+}
+
+// smtpServer is the server that receives mail for posting, taking mail for
+// the configured smtpRecipients only, if there are any.
+func (c *PostController) smtpServer(cfg *config.Config) *smtpd.Server {
+	return &smtpd.Server{
+		Addr:     cfg.SMTPAddr,
+		Hostname: cfg.SMTPHostname,
+		MaxSize:  cfg.MaxMailBytes,
+		Timeout:  5 * time.Minute,
+		AcceptRecipient: func(address string) error {
+			recipients := c.configuration.Get().SMTPRecipients
+			if len(recipients) == 0 {
+				return nil
+			}
+			for _, recipient := range recipients {
+				if strings.EqualFold(recipient, address) {
+					return nil
+				}
+			}
+			return &smtpd.Error{Code: 550, Message: "No such mailbox"}
+		},
+		Handler: c.receiveMail,
+	}
+}
+
+// receiveMail creates the posts for a message received over SMTP. Problems
+// with the message itself are permanent failures, so that it is bounced
+// back to the sender rather than retried.
+func (c *PostController) receiveMail(ctx context.Context, envelope *smtpd.Envelope) error {
+	report, err := c.PostsFromMail(ctx, bytes.NewReader(envelope.Data))
+	if err == nil {
+		slog.DebugContext(ctx, "Received mail", "envelope_from", envelope.From, "remote", envelope.RemoteAddr, "posts", len(report.Posts))
+		return nil
+	}
+	if reason, permanent := mailRejected(err); permanent {
+		return &smtpd.Error{Code: 554, Message: fmt.Sprintf("Not posted: %s", reason)}
+	}
+	slog.ErrorContext(ctx, "Error while posting emailed photos", "remote", envelope.RemoteAddr, "err", err)
+	return err
+}
+
+// mailRejected reports whether an error from PostsFromMail is the message's
+// fault, so that trying it again would not help, and gives the reason. Only
+// problems with the message are given 4xx statuses; a failure to save the
+// posts is a 500, and the message is tried again.
+func mailRejected(err error) (reason string, permanent bool) {
+	var dupErr *duplicateError
+	if errors.As(err, &dupErr) {
+		return "these photos have already been posted", true
+	}
+	if status := statusForError(err); status >= 400 && status < 500 {
+		return err.Error(), true
+	}
+	return "", false
+}
@@ -0,0 +1,144 @@
+package controllers
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"github.com/mattgibbs/photopost/config"
+	"github.com/mattgibbs/photopost/smtpd"
+	"image/color"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"strings"
+	"testing"
+	"time"
+)
+
+// photoMail is a message from sender with images attached.
+func photoMail(sender string, images ...[]byte) string {
+	var attachments strings.Builder
+	for i, img := range images {
+		fmt.Fprintf(&attachments, "--BOUNDARY\r\n"+
+			"Content-Type: image/png\r\n"+
+			"Content-Disposition: attachment; filename=beach%d.png\r\n"+
+			"Content-Transfer-Encoding: base64\r\n"+
+			"\r\n"+
+			"%s\r\n", i, base64.StdEncoding.EncodeToString(img))
+	}
+	return fmt.Sprintf("From: %s\r\n"+
+		"To: photos@example.com\r\n"+
+		"Subject: Beach day\r\n"+
+		"Date: Mon, 02 Jan 2006 15:04:05 -0700\r\n"+
+		"MIME-Version: 1.0\r\n"+
+		"Content-Type: multipart/mixed; boundary=BOUNDARY\r\n"+
+		"\r\n"+
+		"--BOUNDARY\r\n"+
+		"Content-Type: text/plain\r\n"+
+		"\r\n"+
+		".A line that has to be dot-stuffed\r\n"+
+		"%s"+
+		"--BOUNDARY--\r\n", sender, attachments.String())
+}
+
+func TestReceiveMailOverSMTP(t *testing.T) {
+	c := newTestController(t, func(cfg *config.Config) {
+		cfg.MailSenders = map[string]string{"alice@example.com": "Alice"}
+		cfg.SMTPRecipients = []string{"photos@example.com"}
+	})
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	server := c.smtpServer(c.configuration.Get())
+	done := make(chan error, 1)
+	go func() { done <- server.Serve(ctx, l) }()
+	defer func() {
+		cancel()
+		<-done
+	}()
+	for server.ListenAddr() == nil {
+		time.Sleep(time.Millisecond)
+	}
+	addr := server.ListenAddr().String()
+
+	send := func(from string, to string, msg string) error {
+		client, err := smtp.Dial(addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer client.Close()
+		if err := client.Mail(from); err != nil {
+			return err
+		}
+		if err := client.Rcpt(to); err != nil {
+			return err
+		}
+		w, err := client.Data()
+		if err != nil {
+			return err
+		}
+		if _, err := w.Write([]byte(msg)); err != nil {
+			return err
+		}
+		return w.Close()
+	}
+	replyCode := func(err error) int {
+		var protoErr *textproto.Error
+		if errors.As(err, &protoErr) {
+			return protoErr.Code
+		}
+		return 0
+	}
+
+	if err := send("alice@example.com", "photos@example.com", photoMail("Alice <alice@example.com>", testPNG(t, color.Black))); err != nil {
+		t.Fatalf("mail from an allowed sender: %s", err)
+	}
+	posts, err := c.datastore.FindAllPosts()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(posts) != 1 {
+		t.Fatalf("%d posts were created, want 1", len(posts))
+	}
+	if posts[0].Title != "Beach day" || posts[0].Author != "Alice" {
+		t.Errorf("post = %q by %q", posts[0].Title, posts[0].Author)
+	}
+	if !strings.HasPrefix(posts[0].Text, ".A line") {
+		t.Errorf("text = %q, want the dot-stuffed line restored", posts[0].Text)
+	}
+
+	err = send("mallory@example.com", "photos@example.com", photoMail("Mallory <mallory@example.com>", testPNG(t, color.Gray{Y: 128})))
+	if replyCode(err) != 554 {
+		t.Errorf("mail from an unknown sender = %v, want 554", err)
+	}
+	err = send("alice@example.com", "someone@example.com", photoMail("Alice <alice@example.com>", testPNG(t, color.White)))
+	if replyCode(err) != 550 {
+		t.Errorf("mail for an unknown recipient = %v, want 550", err)
+	}
+	if posts, _ := c.datastore.FindAllPosts(); len(posts) != 1 {
+		t.Errorf("%d posts after the rejected messages, want 1", len(posts))
+	}
+}
+
+func TestReceiveMailDatabaseError(t *testing.T) {
+	c := newTestController(t, func(cfg *config.Config) {
+		cfg.MailSenders = map[string]string{"alice@example.com": "Alice"}
+		cfg.DuplicatePolicy = "reject"
+	})
+	posted := testPNG(t, color.Black)
+	if err := c.receiveMail(context.Background(), &smtpd.Envelope{Data: []byte(photoMail("alice@example.com", posted))}); err != nil {
+		t.Fatal(err)
+	}
+	c.datastore = failingDatastore{c.datastore}
+
+	// One image has been posted already, which alone would bounce the
+	// message, but the other could not be saved, so it must be sent again.
+	err := c.receiveMail(context.Background(), &smtpd.Envelope{Data: []byte(photoMail("alice@example.com", posted, gradientPNG(t)))})
+	var smtpErr *smtpd.Error
+	if err == nil || errors.As(err, &smtpErr) {
+		t.Errorf("receiveMail = %v, want an error that is sent as 451", err)
+	}
+}
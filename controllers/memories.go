@@ -0,0 +1,141 @@
+package controllers
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/mattgibbs/photopost/config"
+	"github.com/mattgibbs/photopost/model"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// memories are the posts from the same day in earlier years as a date, or,
+// when there are none, from within window days of it.
+type memories struct {
+	exact  model.PostTimeRangesFilter
+	nearby model.PostTimeRangesFilter
+	window int
+}
+
+// memoriesFor works out the memories of the day given by the "date"
+// parameter, as 2006-01-02 or 2006-Jan-02, or else of today. Days run from
+// midnight to midnight in the "tz" parameter's time zone if there is one,
+// and otherwise in timeZone.
+func (c *PostController) memoriesFor(r *http.Request, cfg *config.Config) (*memories, error) {
+	zone := firstNonEmpty(r.FormValue("tz"), cfg.TimeZone)
+	loc, err := time.LoadLocation(zone)
+	if err != nil {
+		return nil, errorWithStatus(http.StatusBadRequest, "tz %q is not a known time zone.", zone)
+	}
+	day := time.Now().In(loc)
+	if date := r.FormValue("date"); date != "" {
+		day, err = time.ParseInLocation("2006-01-02", date, loc)
+		if err != nil {
+			day, err = time.ParseInLocation("2006-Jan-02", date, loc)
+		}
+		if err != nil {
+			return nil, errorWithStatus(http.StatusBadRequest, "date must be in 2006-01-02 or 2006-Jan-02 format.")
+		}
+	}
+	oldest, err := c.datastore.OldestPostTime()
+	if err != nil {
+		return nil, err
+	}
+	m := &memories{window: cfg.MemoriesWindowDays}
+	if !oldest.IsZero() {
+		m.exact.Ranges = memoryRanges(day, 0, oldest.In(loc).Year())
+		m.nearby.Ranges = memoryRanges(day, m.window, oldest.In(loc).Year())
+	}
+	return m, nil
+}
+
+// memoryRanges gives the day of day's month and day in every year before
+// it, back to firstYear, widened by window days either side. Days are taken
+// in day's location, so they follow its daylight saving changes. February 29
+// falls on February 28 in other years, and February 28 in a year without a
+// leap day takes in February 29 of leap years, so that leap day photos still
+// come up.
+func memoryRanges(day time.Time, window int, firstYear int) []model.TimeRange {
+	month, date := day.Month(), day.Day()
+	takesLeapDay := month == time.February && date == 28 && !isLeapYear(day.Year())
+	var ranges []model.TimeRange
+	for year := day.Year() - 1; year >= firstYear; year-- {
+		d := date
+		if month == time.February && date == 29 && !isLeapYear(year) {
+			d = 28
+		}
+		start := time.Date(year, month, d, 0, 0, 0, 0, day.Location())
+		days := 1
+		if takesLeapDay && isLeapYear(year) {
+			days = 2
+		}
+		ranges = append(ranges, model.TimeRange{
+			Start: start.AddDate(0, 0, -window),
+			End:   start.AddDate(0, 0, days+window),
+		})
+	}
+	return ranges
+}
+
+func isLeapYear(year int) bool {
+	return year%4 == 0 && (year%100 != 0 || year%400 == 0)
+}
+
+// withFilter adds a filter to a copy of filters.
+func withFilter(filters []interface{}, filter interface{}) []interface{} {
+	return append(filters[:len(filters):len(filters)], filter)
+}
+
+// PostMemories lists the posts taken on the same month and day as a date in
+// earlier years, newest first, which can be narrowed with the same filters
+// as PostIndex. If there are none, it falls back to the posts within
+// memoriesWindowDays of that day. The X-Memories-Window header gives the
+// number of days either side that were used.
+func (c *PostController) PostMemories(w http.ResponseWriter, r *http.Request) {
+	filters, err := postFilters(r)
+	if err != nil {
+		http.Error(w, err.Error(), statusForError(err))
+		return
+	}
+	m, err := c.memoriesFor(r, c.configuration.Get())
+	if err != nil {
+		http.Error(w, err.Error(), statusForError(err))
+		return
+	}
+	window := 0
+	posts, err := c.datastore.FindPostsWithFilters(withFilter(filters, m.exact))
+	if err == nil && len(posts) == 0 && m.window > 0 {
+		window = m.window
+		posts, err = c.datastore.FindPostsWithFilters(withFilter(filters, m.nearby))
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Error while fetching memories", "err", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if posts == nil {
+		posts = []*model.Post{}
+	}
+	w.Header().Set("X-Memories-Window", strconv.Itoa(window))
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(posts); err != nil {
+		slog.ErrorContext(r.Context(), "Error while encoding memories", "err", err)
+	}
+}
+
+// nextMemory picks the next post in a client's shuffle from the memories of
+// a day, falling back to the nearby days when there are none.
+func (c *PostController) nextMemory(r *http.Request, client string, cfg *config.Config, filters []interface{}) (int64, error) {
+	m, err := c.memoriesFor(r, cfg)
+	if err != nil {
+		return 0, err
+	}
+	id, err := c.datastore.NextRandomPost(client, randomWeights(cfg), withFilter(filters, m.exact))
+	if errors.Is(err, model.ErrNoPosts) && m.window > 0 {
+		id, err = c.datastore.NextRandomPost(client, randomWeights(cfg), withFilter(filters, m.nearby))
+	}
+	return id, err
+}
@@ -0,0 +1,145 @@
+package controllers
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMemoryRanges(t *testing.T) {
+	loc, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skip(err)
+	}
+	date := func(year int, month time.Month, day int) time.Time {
+		return time.Date(year, month, day, 0, 0, 0, 0, loc)
+	}
+	type span struct{ start, end time.Time }
+	for _, tt := range []struct {
+		name      string
+		day       time.Time
+		window    int
+		firstYear int
+		want      []span
+	}{
+		{
+			name:      "same day in earlier years",
+			day:       time.Date(2024, time.June, 15, 18, 30, 0, 0, loc),
+			firstYear: 2022,
+			want: []span{
+				{date(2023, time.June, 15), date(2023, time.June, 16)},
+				{date(2022, time.June, 15), date(2022, time.June, 16)},
+			},
+		},
+		{
+			name:      "no earlier years",
+			day:       date(2024, time.June, 15),
+			firstYear: 2024,
+		},
+		{
+			name:      "leap day falls on February 28",
+			day:       date(2024, time.February, 29),
+			firstYear: 2019,
+			want: []span{
+				{date(2023, time.February, 28), date(2023, time.March, 1)},
+				{date(2022, time.February, 28), date(2022, time.March, 1)},
+				{date(2021, time.February, 28), date(2021, time.March, 1)},
+				{date(2020, time.February, 29), date(2020, time.March, 1)},
+				{date(2019, time.February, 28), date(2019, time.March, 1)},
+			},
+		},
+		{
+			name:      "February 28 without a leap day takes in leap days",
+			day:       date(2023, time.February, 28),
+			firstYear: 2019,
+			want: []span{
+				{date(2022, time.February, 28), date(2022, time.March, 1)},
+				{date(2021, time.February, 28), date(2021, time.March, 1)},
+				{date(2020, time.February, 28), date(2020, time.March, 1)},
+				{date(2019, time.February, 28), date(2019, time.March, 1)},
+			},
+		},
+		{
+			name:      "February 28 with a leap day does not",
+			day:       date(2024, time.February, 28),
+			firstYear: 2020,
+			want: []span{
+				{date(2023, time.February, 28), date(2023, time.March, 1)},
+				{date(2022, time.February, 28), date(2022, time.March, 1)},
+				{date(2021, time.February, 28), date(2021, time.March, 1)},
+				{date(2020, time.February, 28), date(2020, time.February, 29)},
+			},
+		},
+		{
+			name:      "window across the end of February",
+			day:       date(2024, time.March, 1),
+			window:    3,
+			firstYear: 2020,
+			want: []span{
+				{date(2023, time.February, 26), date(2023, time.March, 5)},
+				{date(2022, time.February, 26), date(2022, time.March, 5)},
+				{date(2021, time.February, 26), date(2021, time.March, 5)},
+				{date(2020, time.February, 27), date(2020, time.March, 5)},
+			},
+		},
+		{
+			name:      "window across the new year",
+			day:       date(2024, time.January, 1),
+			window:    2,
+			firstYear: 2023,
+			want: []span{
+				{date(2022, time.December, 30), date(2023, time.January, 4)},
+			},
+		},
+		{
+			name:      "leap day window",
+			day:       date(2024, time.February, 29),
+			window:    1,
+			firstYear: 2022,
+			want: []span{
+				{date(2023, time.February, 27), date(2023, time.March, 2)},
+				{date(2022, time.February, 27), date(2022, time.March, 2)},
+			},
+		},
+		{
+			// Clocks went forward on March 12, 2023.
+			name:      "daylight saving change",
+			day:       date(2024, time.March, 12),
+			firstYear: 2023,
+			want: []span{
+				{date(2023, time.March, 12), date(2023, time.March, 13)},
+			},
+		},
+		{
+			// Clocks went back on November 6, 2022.
+			name:      "window over a daylight saving change",
+			day:       date(2023, time.November, 5),
+			window:    1,
+			firstYear: 2022,
+			want: []span{
+				{date(2022, time.November, 4), date(2022, time.November, 7)},
+			},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			ranges := memoryRanges(tt.day, tt.window, tt.firstYear)
+			if len(ranges) != len(tt.want) {
+				t.Fatalf("%d ranges, want %d: %v", len(ranges), len(tt.want), ranges)
+			}
+			for i, r := range ranges {
+				if !r.Start.Equal(tt.want[i].start) || !r.End.Equal(tt.want[i].end) {
+					t.Errorf("range %d = %v to %v, want %v to %v", i, r.Start, r.End, tt.want[i].start, tt.want[i].end)
+				}
+			}
+		})
+	}
+
+	// Days follow the zone's clock, so they are not all 24 hours long.
+	ranges := memoryRanges(date(2024, time.March, 12), 0, 2023)
+	if length := ranges[0].End.Sub(ranges[0].Start); length != 23*time.Hour {
+		t.Errorf("March 12, 2023 in New York lasted %s, want 23h", length)
+	}
+	ranges = memoryRanges(date(2023, time.November, 6), 0, 2022)
+	if length := ranges[0].End.Sub(ranges[0].Start); length != 25*time.Hour {
+		t.Errorf("November 6, 2022 in New York lasted %s, want 25h", length)
+	}
+}
@@ -1,34 +1,40 @@
 package controllers
 
 import (
-	"crypto/sha1"
+	"bufio"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/gorilla/mux"
 	"github.com/mattgibbs/photopost/config"
+	"github.com/mattgibbs/photopost/metrics"
 	"github.com/mattgibbs/photopost/model"
 	"io"
-	"io/ioutil"
-	"log"
+	"log/slog"
 	"math/rand"
-	"mime"
-	"mime/multipart"
 	"net/http"
+	"net/url"
+	"os"
 	"os/exec"
 	"path/filepath"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 )
 
-var allowed_file_types = [...]string{"image/jpeg", "image/gif", "image/png"}
-
 type PostController struct {
 	datastore     model.Datastore
-	configuration *config.Config
+	configuration *config.Store
+	// images is held for reading from when an image is stored until the
+	// post using it is saved, and for writing while an image is checked for
+	// posts using it and removed, so that an image cannot be removed from
+	// under a post that is about to use it.
+	images sync.RWMutex
 }
 
-func NewPostController(ds model.Datastore, configuration *config.Config) *PostController {
+func NewPostController(ds model.Datastore, configuration *config.Store) *PostController {
 	c := new(PostController)
 	c.datastore = ds
 	c.configuration = configuration
@@ -36,7 +42,9 @@ func NewPostController(ds model.Datastore, configuration *config.Config) *PostCo
 	return c
 }
 
-func (c *PostController) PostIndex(w http.ResponseWriter, r *http.Request) {
+// postFilters reads the filters PostIndex and PostRandom share from the
+// query parameters.
+func postFilters(r *http.Request) ([]interface{}, error) {
 	var filters []interface{}
 	start_time := r.FormValue("start_time")
 	end_time := r.FormValue("end_time")
@@ -47,15 +55,13 @@ func (c *PostController) PostIndex(w http.ResponseWriter, r *http.Request) {
 		if start_time != "" {
 			etf.Newer_than, err = time.Parse(shortForm, start_time)
 			if err != nil {
-				http.Error(w, "start_time must be in 2006-Jan-02 format.", http.StatusBadRequest)
-				return
+				return nil, errorWithStatus(http.StatusBadRequest, "start_time must be in 2006-Jan-02 format.")
 			}
 		}
 		if end_time != "" {
 			etf.Older_than, err = time.Parse(shortForm, end_time)
 			if err != nil {
-				http.Error(w, "end_time must be in 2006-Jan-02 format.", http.StatusBadRequest)
-				return
+				return nil, errorWithStatus(http.StatusBadRequest, "end_time must be in 2006-Jan-02 format.")
 			}
 		}
 		filters = append(filters, etf)
@@ -66,17 +72,37 @@ func (c *PostController) PostIndex(w http.ResponseWriter, r *http.Request) {
 		filters = append(filters, titleFilter)
 	}
 
+	if author := r.FormValue("author"); author != "" {
+		filters = append(filters, model.AuthorFilter{Matching: author})
+	}
+
+	if album := r.FormValue("album"); album != "" {
+		filters = append(filters, model.AlbumFilter{Matching: album})
+	}
+
+	if tags := parseTags(r.Form["tag"]); len(tags) > 0 {
+		filters = append(filters, model.TagFilter{Tags: tags})
+	}
+	return filters, nil
+}
+
+func (c *PostController) PostIndex(w http.ResponseWriter, r *http.Request) {
+	filters, err := postFilters(r)
+	if err != nil {
+		http.Error(w, err.Error(), statusForError(err))
+		return
+	}
+
 	posts, err := c.datastore.FindPostsWithFilters(filters)
 	if err != nil {
-		log.Fatalf("Error while fetching entries: %s", err)
+		slog.ErrorContext(r.Context(), "Error while fetching entries", "err", err)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
 	w.WriteHeader(http.StatusOK)
 	if err := json.NewEncoder(w).Encode(posts); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		panic(err)
+		slog.ErrorContext(r.Context(), "Error while encoding entries", "err", err)
 	}
 }
 
@@ -90,22 +116,54 @@ func (c *PostController) PostShow(w http.ResponseWriter, r *http.Request) {
 	c.showPostWithID(w, r, postid)
 }
 
+// PostRandom shows the next post in the requesting client's shuffle,
+// picked from the posts that match the same filters as PostIndex. See
+// randomClient and NextRandomPost. With source=memories, it picks from the
+// memories of a day instead, as listed by PostMemories.
 func (c *PostController) PostRandom(w http.ResponseWriter, r *http.Request) {
-	//Get the list of all ids
-	ids, err := c.datastore.PostIDs()
+	filters, err := postFilters(r)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		panic(err)
+		http.Error(w, err.Error(), statusForError(err))
 		return
 	}
-
-	if ids == nil || len(ids) == 0 {
+	client, err := randomClient(w, r)
+	if err != nil {
+		http.Error(w, err.Error(), statusForError(err))
+		return
+	}
+	cfg := c.configuration.Get()
+	var id int64
+	source := r.FormValue("source")
+	switch source {
+	case "":
+		id, err = c.datastore.NextRandomPost(client, randomWeights(cfg), filters)
+	case "memories":
+		id, err = c.nextMemory(r, client, cfg, filters)
+	default:
+		http.Error(w, "source must be empty or memories.", http.StatusBadRequest)
+		return
+	}
+	if errors.Is(err, model.ErrNoPosts) {
+		if source == "memories" {
+			http.Error(w, "No photos from this day in earlier years.", http.StatusNotFound)
+			return
+		}
+		if len(filters) > 0 {
+			http.Error(w, "No photos match the filters.", http.StatusNotFound)
+			return
+		}
 		http.Error(w, "Database has no photos.", http.StatusInternalServerError)
 		return
 	}
-
-	id := int(ids[rand.Intn(len(ids))])
-	c.showPostWithID(w, r, id)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Error while picking a random post", "err", err)
+		http.Error(w, err.Error(), statusForError(err))
+		return
+	}
+	interval := cfg.SlideshowInterval.Duration()
+	w.Header().Set("X-Slideshow-Interval", strconv.Itoa(int(interval.Seconds())))
+	w.Header().Set("Cache-Control", "no-store")
+	c.showPostWithID(w, r, int(id))
 }
 
 func (c *PostController) showPostWithID(w http.ResponseWriter, r *http.Request, id int) {
@@ -118,97 +176,168 @@ func (c *PostController) showPostWithID(w http.ResponseWriter, r *http.Request,
 	w.WriteHeader(http.StatusOK)
 	err = json.NewEncoder(w).Encode(post)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		panic(err)
+		slog.ErrorContext(r.Context(), "Error while encoding post", "post_id", id, "err", err)
 	}
 }
 
-func validateImageFile(fh *multipart.FileHeader) bool {
-	isAllowedType := false
-	for i := range allowed_file_types {
-		if fh.Header.Get("Content-Type") == allowed_file_types[i] {
-			isAllowedType = true
-		}
+// removeUnreferencedImage deletes an image that was stored for a post that
+// then failed to save, unless another post has started using it meanwhile.
+// The caller must not hold c.images.
+func (c *PostController) removeUnreferencedImage(ctx context.Context, imageFilename string) {
+	c.images.Lock()
+	defer c.images.Unlock()
+	ids, err := c.datastore.PostIDsForImageFile(imageFilename)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error while checking image references, leaving image in place", "file", imageFilename, "err", err)
+		return
 	}
-	return isAllowedType
-}
-
-func (c *PostController) filenameForImageFile(fBytes *[]byte, fh *multipart.FileHeader) (string, error) {
-	imageHash := sha1.New()
-	imageHash.Write(*fBytes)
-	hashBytes := imageHash.Sum(nil)
-	fileExtensions, mimeErr := mime.ExtensionsByType(fh.Header.Get("Content-Type"))
-	if mimeErr != nil {
-		return "", mimeErr
+	if len(ids) > 0 {
+		return
 	}
-	if fileExtensions == nil {
-		return "", errors.New("Could not determine file extension for uploaded image.")
+	if err := os.Remove(imageFilename); err != nil {
+		slog.ErrorContext(ctx, "Error while removing unreferenced image", "file", imageFilename, "err", err)
 	}
-
-	return filepath.Join(c.configuration.UploadsPath, fmt.Sprintf("%x%s", hashBytes, fileExtensions[0])), nil
 }
 
 func (c *PostController) PostCreate(w http.ResponseWriter, r *http.Request) {
-	r.ParseMultipartForm(10 << 20) //Limit to 10 MB file size
-	f, fh, err := r.FormFile("image")
+	cfg := c.configuration.Get()
+	fields, img, err := readUploadForm(w, r, cfg)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		http.Error(w, err.Error(), statusForError(err))
 		return
 	}
-	defer f.Close()
-	log.Printf("Saving a new file: %s with size %+v and type %+v", fh.Filename, fh.Size, fh.Header)
-	isAllowedType := validateImageFile(fh)
-	if isAllowedType == false {
-		http.Error(w, "Uploaded image is not an allowed file type.", http.StatusUnprocessableEntity)
+	if img == nil {
+		http.Error(w, "An image is required.", http.StatusBadRequest)
 		return
 	}
-	fBytes, err := ioutil.ReadAll(io.LimitReader(f, 10<<20))
+	defer img.discard()
+	slog.InfoContext(r.Context(), "Saving a new file", "filename", img.filename, "size", img.size, "content_type", img.contentType)
+	post, err := postFromFields(fields)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		http.Error(w, err.Error(), statusForError(err))
 		return
 	}
-	imageFilename, err := c.filenameForImageFile(&fBytes, fh)
+	policy, err := duplicatePolicy(fields, cfg)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		http.Error(w, err.Error(), statusForError(err))
+		return
+	}
+	duplicates, err := c.createPost(r.Context(), post, img, policy)
+	if err != nil {
+		writeCreateError(w, r, err)
 		return
 	}
+	setDuplicateHeader(w, duplicates)
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.Header().Set("Location", fmt.Sprintf("posts/%v", post.Id))
+	w.WriteHeader(http.StatusCreated)
+	err = json.NewEncoder(w).Encode(post)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Error while encoding post", "post_id", post.Id, "err", err)
+	}
+}
+
+// postFromFields builds a new post from the title, text, author and
+// postTime form fields.
+func postFromFields(fields url.Values) (*model.Post, error) {
 	var post model.Post
-	post.Title = r.FormValue("title")
-	post.Text = r.FormValue("text")
-	post.ImageFile = imageFilename
-	post.Author = r.FormValue("author")
-	if len(r.FormValue("postTime")) > 0 {
-		postTimeString := r.FormValue("postTime")
+	post.Title = fields.Get("title")
+	post.Text = fields.Get("text")
+	post.Author = fields.Get("author")
+	post.Album = fields.Get("album")
+	post.Tags = parseTags(fields["tags"])
+	if len(fields.Get("postTime")) > 0 {
+		postTimeString := fields.Get("postTime")
 		t, err := time.Parse(time.RFC3339, postTimeString)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
-			return
+			return nil, &statusError{status: http.StatusUnprocessableEntity, err: err}
 		}
 		post.PostTime = t
 	}
-	valid, validation_err := post.Validate()
-	if !valid {
-		http.Error(w, validation_err.Error(), http.StatusUnprocessableEntity)
-		return
+	return &post, nil
+}
+
+// parseTags accepts tags as repeated fields, comma separated lists, or both.
+func parseTags(values []string) []string {
+	tags := []string{}
+	seen := map[string]bool{}
+	for _, value := range values {
+		for _, tag := range strings.Split(value, ",") {
+			tag = strings.TrimSpace(tag)
+			if tag != "" && !seen[tag] {
+				seen[tag] = true
+				tags = append(tags, tag)
+			}
+		}
 	}
-	err = ioutil.WriteFile(imageFilename, fBytes, 0644)
+	return tags
+}
+
+// createPost stores img under its content addressed name and saves post
+// with that image. Every new post goes through here, whichever way its image
+// was uploaded. On error, img has not been stored and the caller still owns
+// it.
+//
+// The post is checked with checkNewPost first, and the duplicates it finds
+// are returned.
+func (c *PostController) createPost(ctx context.Context, post *model.Post, img *uploadedImage, policy string) ([]DuplicateMatch, error) {
+	duplicates, err := c.checkNewPost(ctx, post, img, policy)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+		return nil, err
 	}
-	new_post_id, err := c.datastore.SavePost(&post)
+	c.images.RLock()
+	created, err := img.store(post.ImageFile)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
-		return
+		c.images.RUnlock()
+		return nil, err
 	}
-	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
-	w.Header().Set("Location", fmt.Sprintf("posts/%v", new_post_id))
-	w.WriteHeader(http.StatusCreated)
-	err = json.NewEncoder(w).Encode(&post)
+	_, err = c.datastore.SavePost(post)
+	c.images.RUnlock()
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+		if created {
+			c.removeUnreferencedImage(ctx, post.ImageFile)
+		}
+		// The post was checked above, so this is the database's fault and
+		// not the upload's.
+		return nil, err
+	}
+	metrics.ObserveUpload(img.contentType, img.size)
+	return duplicates, nil
+}
+
+// checkNewPost fills in the image file and hashes of a post for img and
+// validates it, without storing anything.
+//
+// Unless policy is "allow", posts with the same or a similar image are looked
+// up too. A "reject" policy fails with a *duplicateError listing them; with
+// "warn" they are returned.
+func (c *PostController) checkNewPost(ctx context.Context, post *model.Post, img *uploadedImage, policy string) ([]DuplicateMatch, error) {
+	imageFilename, err := img.storedFilename(c.configuration.Get().UploadsPath)
+	if err != nil {
+		return nil, err
+	}
+	post.ImageFile = imageFilename
+	valid, validation_err := post.Validate()
+	if !valid {
+		return nil, &statusError{status: http.StatusUnprocessableEntity, err: validation_err}
 	}
+	if err := setImageHashes(post, img); err != nil {
+		return nil, err
+	}
+	if policy == duplicatesAllow {
+		return nil, nil
+	}
+	duplicates, err := c.findDuplicates(post)
+	if err != nil {
+		return nil, err
+	}
+	if len(duplicates) > 0 {
+		slog.InfoContext(ctx, "Uploaded image duplicates existing posts", "policy", policy, "duplicates", len(duplicates))
+		if policy == duplicatesReject {
+			return nil, &duplicateError{matches: duplicates}
+		}
+	}
+	return duplicates, nil
 }
 
 func (c *PostController) PostUpdate(w http.ResponseWriter, r *http.Request) {
@@ -223,40 +352,43 @@ func (c *PostController) PostUpdate(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, err.Error(), http.StatusNotFound)
 		return
 	}
-	r.ParseMultipartForm(10 << 20) //Limit to 10 MB file size
-	f, fh, err := r.FormFile("image")
-	var fBytes []byte
+	cfg := c.configuration.Get()
+	fields, img, err := readUploadForm(w, r, cfg)
+	if err != nil {
+		http.Error(w, err.Error(), statusForError(err))
+		return
+	}
+	defer img.discard()
 	var imageFilename string
-	if err == nil {
-		defer f.Close()
-		isAllowedType := validateImageFile(fh)
-		if isAllowedType == false {
-			http.Error(w, "Uploaded image is not an allowed file type.", http.StatusUnprocessableEntity)
-			return
-		}
-		fBytes, err = ioutil.ReadAll(io.LimitReader(f, 10<<20))
+	if img != nil {
+		imageFilename, err = img.storedFilename(cfg.UploadsPath)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
-		imageFilename, err = c.filenameForImageFile(&fBytes, fh)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+		post.ImageFile = imageFilename
+		if err := setImageHashes(post, img); err != nil {
+			http.Error(w, err.Error(), statusForError(err))
 			return
 		}
-		post.ImageFile = imageFilename
 	}
-	if len(r.FormValue("title")) > 0 {
-		post.Title = r.FormValue("title")
+	if len(fields.Get("title")) > 0 {
+		post.Title = fields.Get("title")
+	}
+	if len(fields.Get("text")) > 0 {
+		post.Text = fields.Get("text")
+	}
+	if len(fields.Get("author")) > 0 {
+		post.Author = fields.Get("author")
 	}
-	if len(r.FormValue("text")) > 0 {
-		post.Text = r.FormValue("text")
+	if _, ok := fields["album"]; ok {
+		post.Album = fields.Get("album")
 	}
-	if len(r.FormValue("author")) > 0 {
-		post.Author = r.FormValue("author")
+	if _, ok := fields["tags"]; ok {
+		post.Tags = parseTags(fields["tags"])
 	}
-	if len(r.FormValue("postTime")) > 0 {
-		postTimeString := r.FormValue("postTime")
+	if len(fields.Get("postTime")) > 0 {
+		postTimeString := fields.Get("postTime")
 		t, err := time.Parse(time.RFC3339, postTimeString)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
@@ -270,25 +402,34 @@ func (c *PostController) PostUpdate(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, validation_err.Error(), http.StatusUnprocessableEntity)
 		return
 	}
-	if len(fBytes) > 0 && len(imageFilename) > 0 {
-		err = ioutil.WriteFile(imageFilename, fBytes, 0644)
+	created := false
+	c.images.RLock()
+	if img != nil {
+		created, err = img.store(imageFilename)
 		if err != nil {
+			c.images.RUnlock()
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
 	}
 
 	err = c.datastore.UpdatePost(post)
+	c.images.RUnlock()
 	if err != nil {
+		if created {
+			c.removeUnreferencedImage(r.Context(), imageFilename)
+		}
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	if img != nil {
+		metrics.ObserveUpload(img.contentType, img.size)
+	}
 	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
 	w.WriteHeader(http.StatusOK)
 	err = json.NewEncoder(w).Encode(post)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+		slog.ErrorContext(r.Context(), "Error while encoding post", "post_id", post.Id, "err", err)
 	}
 }
 
@@ -306,6 +447,8 @@ func (c *PostController) PostDelete(w http.ResponseWriter, r *http.Request) {
 	}
 	err = c.datastore.DeletePost(post)
 	if err != nil {
+		metrics.DeleteFailed()
+		slog.ErrorContext(r.Context(), "Error while deleting post", "post_id", post.Id, "err", err)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
@@ -313,6 +456,60 @@ func (c *PostController) PostDelete(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusNoContent)
 }
 
+// rotatedImage writes a copy of an image, turned by degrees, to a temporary
+// file in the uploads directory. The image itself is left alone: its name is
+// the hash of its contents, and other posts may be using it.
+func rotatedImage(imageFile string, degrees string, cfg *config.Config) (*uploadedImage, error) {
+	src, err := os.Open(imageFile)
+	if err != nil {
+		return nil, err
+	}
+	defer src.Close()
+	tmp, err := os.CreateTemp(cfg.UploadsPath, tempUploadPattern)
+	if err != nil {
+		return nil, err
+	}
+	_, err = io.Copy(tmp, src)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		if output, runErr := exec.Command("mogrify", "-rotate", degrees, tmp.Name()).CombinedOutput(); runErr != nil {
+			err = fmt.Errorf("mogrify: %w: %s", runErr, strings.TrimSpace(string(output)))
+		}
+	}
+	var contentType string
+	if err == nil {
+		contentType, err = syncAndSniff(tmp.Name())
+	}
+	var img *uploadedImage
+	if err == nil {
+		img, err = imageFromFile(tmp.Name(), contentType, filepath.Base(imageFile), cfg)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return nil, err
+	}
+	return img, nil
+}
+
+// syncAndSniff flushes a file that was written by another program to disk,
+// and detects its type.
+func syncAndSniff(path string) (string, error) {
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	if err := f.Sync(); err != nil {
+		return "", err
+	}
+	return sniffContentType(bufio.NewReader(f))
+}
+
+// PostRotate turns a post's image a quarter turn, clockwise for a positive
+// direction. The rotated image is stored under its own content addressed
+// name, like an upload.
 func (c *PostController) PostRotate(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	postid, err := strconv.Atoi(vars["postid"])
@@ -336,17 +533,52 @@ func (c *PostController) PostRotate(w http.ResponseWriter, r *http.Request) {
 	} else {
 		directionArg = "-90"
 	}
-	cmd := exec.Command("mogrify", "-rotate", directionArg, post.ImageFile)
-	err = cmd.Run()
+	cfg := c.configuration.Get()
+	img, err := rotatedImage(post.ImageFile, directionArg, cfg)
 	if err != nil {
+		metrics.RotateFailed()
+		slog.ErrorContext(r.Context(), "Error while rotating image", "post_id", post.Id, "err", err)
+		http.Error(w, err.Error(), statusForError(err))
+		return
+	}
+	defer img.discard()
+	imageFilename, err := img.storedFilename(cfg.UploadsPath)
+	if err == nil {
+		err = setImageHashes(post, img)
+	}
+	if err != nil {
+		metrics.RotateFailed()
+		http.Error(w, err.Error(), statusForError(err))
+		return
+	}
+	c.images.RLock()
+	created, err := img.store(imageFilename)
+	if err != nil {
+		c.images.RUnlock()
+		metrics.RotateFailed()
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	original := post.ImageFile
+	post.ImageFile = imageFilename
+	err = c.datastore.UpdatePost(post)
+	c.images.RUnlock()
+	if err != nil {
+		metrics.RotateFailed()
+		if created {
+			c.removeUnreferencedImage(r.Context(), imageFilename)
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	// Other posts may still be showing the image the right way up.
+	if original != imageFilename {
+		c.removeUnreferencedImage(r.Context(), original)
+	}
 	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
 	w.WriteHeader(http.StatusOK)
 	err = json.NewEncoder(w).Encode(post)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+		slog.ErrorContext(r.Context(), "Error while encoding post", "post_id", post.Id, "err", err)
 	}
 }
@@ -0,0 +1,139 @@
+package controllers
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"fmt"
+	"github.com/gorilla/mux"
+	"github.com/mattgibbs/photopost/metrics"
+	"github.com/mattgibbs/photopost/model"
+	"image/color"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// fakeMogrify puts a mogrify on the PATH that "rotates" an image by
+// replacing it with rotated.
+func fakeMogrify(t *testing.T, rotated []byte) {
+	t.Helper()
+	dir := t.TempDir()
+	result := filepath.Join(dir, "rotated.png")
+	if err := os.WriteFile(result, rotated, 0644); err != nil {
+		t.Fatal(err)
+	}
+	script := fmt.Sprintf("#!/bin/sh\n# mogrify -rotate <degrees> <file>\ncp %q \"$3\"\n", result)
+	if err := os.WriteFile(filepath.Join(dir, "mogrify"), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+}
+
+func rotate(t *testing.T, c *PostController, id int64) *model.Post {
+	t.Helper()
+	r := httptest.NewRequest("POST", fmt.Sprintf("/posts/%d/rotate?direction=1", id), nil)
+	r = mux.SetURLVars(r, map[string]string{"postid": fmt.Sprint(id)})
+	w := httptest.NewRecorder()
+	c.PostRotate(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("rotating post %d: %d %s", id, w.Code, w.Body.String())
+	}
+	post, err := c.datastore.FindPost(int(id))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return post
+}
+
+func TestPostRotateStoresNewImage(t *testing.T) {
+	c := newTestController(t, nil)
+	uploads := c.configuration.Get().UploadsPath
+	original, rotated := testPNG(t, color.Black), testPNG(t, color.RGBA{R: 255, A: 255})
+	originalFile := filepath.Join(uploads, fmt.Sprintf("%x.png", sha1.Sum(original)))
+	if err := os.WriteFile(originalFile, original, 0644); err != nil {
+		t.Fatal(err)
+	}
+	var ids []int64
+	for _, title := range []string{"first", "second"} {
+		id, err := c.datastore.SavePost(&model.Post{Title: title, Author: "tester", ImageFile: originalFile, PostTime: time.Now(), Tags: []string{}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	fakeMogrify(t, rotated)
+
+	post := rotate(t, c, ids[0])
+	rotatedFile := filepath.Join(uploads, fmt.Sprintf("%x.png", sha1.Sum(rotated)))
+	if post.ImageFile != rotatedFile {
+		t.Errorf("rotated post's image is %s, want %s", post.ImageFile, rotatedFile)
+	}
+	if post.ContentHash != fmt.Sprintf("%x", sha1.Sum(rotated)) || post.PerceptualHash == nil {
+		t.Errorf("rotated post's hashes were not updated: %q %v", post.ContentHash, post.PerceptualHash)
+	}
+	if data, err := os.ReadFile(originalFile); err != nil || string(data) != string(original) {
+		t.Errorf("the image the other post uses was changed or removed: %v", err)
+	}
+	other, err := c.datastore.FindPost(int(ids[1]))
+	if err != nil || other.ImageFile != originalFile {
+		t.Errorf("the other post's image was changed: %v %v", other, err)
+	}
+
+	// Once no post uses the original, it is removed.
+	rotate(t, c, ids[1])
+	if _, err := os.Stat(originalFile); !os.IsNotExist(err) {
+		t.Errorf("unused original image was left behind: %v", err)
+	}
+	if matches, _ := filepath.Glob(filepath.Join(uploads, tempUploadPattern)); len(matches) > 0 {
+		t.Errorf("temporary files were left behind: %v", matches)
+	}
+}
+
+// uploadsCounted is the photopost_uploads_total count for PNG images.
+func uploadsCounted(t *testing.T) float64 {
+	t.Helper()
+	families, err := metrics.Registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, family := range families {
+		if family.GetName() != "photopost_uploads_total" {
+			continue
+		}
+		for _, metric := range family.GetMetric() {
+			for _, label := range metric.GetLabel() {
+				if label.GetName() == "mime_type" && label.GetValue() == "image/png" {
+					return metric.GetCounter().GetValue()
+				}
+			}
+		}
+	}
+	return 0
+}
+
+func TestCreatePostCountsSavedUploads(t *testing.T) {
+	c := newTestController(t, nil)
+	before := uploadsCounted(t)
+	createTestPost(t, c, &model.Post{Title: "photo", Author: "tester", PostTime: time.Now()}, testPNG(t, color.Black))
+	if counted := uploadsCounted(t) - before; counted != 1 {
+		t.Errorf("%v uploads counted for a saved post, want 1", counted)
+	}
+
+	c.datastore = failingDatastore{c.datastore}
+	img, err := receiveImage(bytes.NewReader(gradientPNG(t)), "image/png", "photo.png", c.configuration.Get())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer img.discard()
+	before = uploadsCounted(t)
+	if _, err := c.createPost(context.Background(), &model.Post{Title: "photo", Author: "tester", PostTime: time.Now(), Tags: []string{}}, img, duplicatesAllow); err == nil {
+		t.Fatal("createPost succeeded with a failing database")
+	}
+	if counted := uploadsCounted(t) - before; counted != 0 {
+		t.Errorf("%v uploads counted for a post that was not saved, want none", counted)
+	}
+}
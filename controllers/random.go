@@ -0,0 +1,80 @@
+package controllers
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"github.com/mattgibbs/photopost/config"
+	"github.com/mattgibbs/photopost/model"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"time"
+)
+
+// randomClientCookie remembers a browser's shuffle when it does not give a
+// device ID.
+const randomClientCookie = "photopost_client"
+
+var clientIdPattern = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,64}$`)
+
+// randomClient identifies the slideshow asking for a random post, so that
+// each has its own shuffle: by its "device" parameter if it has one, or
+// else by a cookie, which is set if the client does not have one yet.
+func randomClient(w http.ResponseWriter, r *http.Request) (string, error) {
+	if device := r.FormValue("device"); device != "" {
+		if !clientIdPattern.MatchString(device) {
+			return "", errorWithStatus(http.StatusBadRequest, "device must be 1 to 64 letters, digits, '.', '_', ':' or '-'.")
+		}
+		return "device:" + device, nil
+	}
+	if cookie, err := r.Cookie(randomClientCookie); err == nil && clientIdPattern.MatchString(cookie.Value) {
+		return "cookie:" + cookie.Value, nil
+	}
+	var id [16]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		return "", err
+	}
+	value := hex.EncodeToString(id[:])
+	http.SetCookie(w, &http.Cookie{
+		Name:     randomClientCookie,
+		Value:    value,
+		Path:     "/",
+		MaxAge:   int((365 * 24 * time.Hour).Seconds()),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	return "cookie:" + value, nil
+}
+
+func randomWeights(cfg *config.Config) model.RandomWeights {
+	return model.RandomWeights{
+		Favorites:    cfg.RandomFavoriteWeight,
+		FavoriteTag:  cfg.RandomFavoriteTag,
+		Recent:       cfg.RandomRecentWeight,
+		RecentWithin: cfg.RandomRecentWithin.Duration(),
+		Unseen:       cfg.RandomUnseenWeight,
+	}
+}
+
+// ForgetIdleShuffles removes the shuffles of slideshow clients that have not
+// asked for a post within randomClientExpiry, every interval until ctx is
+// done.
+func (c *PostController) ForgetIdleShuffles(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		expiry := c.configuration.Get().RandomClientExpiry.Duration()
+		forgotten, err := c.datastore.ForgetRandomClients(time.Now().Add(-expiry))
+		if err != nil {
+			slog.Error("Error while removing idle slideshow shuffles", "err", err)
+		} else if forgotten > 0 {
+			slog.Info("Removed idle slideshow shuffles", "clients", forgotten)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package controllers
+
+import (
+	"fmt"
+	"github.com/gorilla/mux"
+	"github.com/mattgibbs/photopost/model"
+	"log/slog"
+	"net/http"
+	"strconv"
+)
+
+// maxSimilarLimit caps how many similar posts one request can return.
+const maxSimilarLimit = 200
+
+// SimilarResult is a post that looks like the one searched for, Distance
+// bits away from it.
+type SimilarResult struct {
+	Distance int         `json:"distance"`
+	Post     *model.Post `json:"post"`
+}
+
+// PostSimilar lists the posts whose images look like a post's, closest
+// first. max_distance (0-64) defaults to the configured near duplicate
+// distance, and limit (default 20) caps the number of results.
+func (c *PostController) PostSimilar(w http.ResponseWriter, r *http.Request) {
+	postid, err := strconv.Atoi(mux.Vars(r)["postid"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	maxDistance := c.configuration.Get().NearDuplicateDistance
+	if v := r.FormValue("max_distance"); v != "" {
+		maxDistance, err = strconv.Atoi(v)
+		if err != nil || maxDistance < 0 || maxDistance > 64 {
+			http.Error(w, "max_distance must be between 0 and 64.", http.StatusBadRequest)
+			return
+		}
+	}
+	limit := 20
+	if v := r.FormValue("limit"); v != "" {
+		limit, err = strconv.Atoi(v)
+		if err != nil || limit < 1 || limit > maxSimilarLimit {
+			http.Error(w, fmt.Sprintf("limit must be between 1 and %d.", maxSimilarLimit), http.StatusBadRequest)
+			return
+		}
+	}
+	post, err := c.datastore.FindPost(postid)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if post.PerceptualHash == nil {
+		http.Error(w, "This post's image has not been hashed yet.", http.StatusConflict)
+		return
+	}
+	similar, err := c.datastore.FindSimilarPosts(*post.PerceptualHash, maxDistance)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Error while finding similar posts", "post_id", post.Id, "err", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	var ids []int64
+	distances := map[int64]int{}
+	for _, s := range similar {
+		if s.Id == post.Id {
+			continue
+		}
+		if len(ids) == limit {
+			break
+		}
+		ids = append(ids, s.Id)
+		distances[s.Id] = s.Distance
+	}
+	results := []SimilarResult{}
+	if len(ids) > 0 {
+		posts, err := c.datastore.FindPostsWithFilters([]interface{}{model.PostIdFilter{PostIds: ids}})
+		if err != nil {
+			slog.ErrorContext(r.Context(), "Error while fetching similar posts", "post_id", post.Id, "err", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		byId := map[int64]*model.Post{}
+		for _, p := range posts {
+			byId[p.Id] = p
+		}
+		// Keep the closest first order; skip posts deleted in the meantime.
+		for _, id := range ids {
+			if p, ok := byId[id]; ok {
+				results = append(results, SimilarResult{Distance: distances[id], Post: p})
+			}
+		}
+	}
+	writeJSON(w, r, http.StatusOK, results)
+}
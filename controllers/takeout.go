@@ -0,0 +1,336 @@
+package controllers
+
+import (
+	"archive/zip"
+	"bufio"
+	"context"
+	"crypto/sha1"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// takeoutSidecar is the JSON file Google Takeout writes next to each photo.
+// Its geoData is not imported, since posts have no location.
+type takeoutSidecar struct {
+	Title          string           `json:"title"`
+	Description    string           `json:"description"`
+	PhotoTakenTime takeoutTimestamp `json:"photoTakenTime"`
+	CreationTime   takeoutTimestamp `json:"creationTime"`
+	People         []struct {
+		Name string `json:"name"`
+	} `json:"people"`
+}
+
+type takeoutTimestamp struct {
+	Timestamp string `json:"timestamp"`
+}
+
+func (t takeoutTimestamp) time() (time.Time, bool) {
+	seconds, err := strconv.ParseInt(t.Timestamp, 10, 64)
+	if err != nil || seconds <= 0 {
+		return time.Time{}, false
+	}
+	return time.Unix(seconds, 0), true
+}
+
+// takeoutMaxSidecarName is how long Takeout lets a sidecar's name get before
+// it truncates it, without the ".json".
+const takeoutMaxSidecarName = 46
+
+// takeoutYearFolder matches the folders Takeout puts photos that are not in
+// an album in.
+var takeoutYearFolder = regexp.MustCompile(`^Photos from \d{4}$`)
+
+// takeoutCopyNumber matches the "(1)" Takeout adds to the second photo with a
+// name, which it puts after the extension in the sidecar's name instead.
+var takeoutCopyNumber = regexp.MustCompile(`^(.*)(\(\d+\))(\.[^.]*)?$`)
+
+// ImportTakeout imports the photos in a Google Takeout export, either a zip
+// file or an extracted directory. Each photo's title, description, time taken
+// and people (as tags) come from its sidecar, and each album folder becomes
+// an album. Photos that are not in an album get opts.Album.
+//
+// The files that have been dealt with are recorded in a journal in the
+// uploads directory, so that an interrupted import can be run again and
+// carry on where it stopped. The journal is removed once an import completes
+// without failures.
+func (c *PostController) ImportTakeout(ctx context.Context, source string, opts ImportOptions, out io.Writer) (ImportReport, error) {
+	fsys, closeSource, err := openTakeout(source)
+	if err != nil {
+		return ImportReport{}, err
+	}
+	defer closeSource()
+	items, err := takeoutItems(fsys, source)
+	if err != nil {
+		return ImportReport{}, err
+	}
+	journalPath, err := takeoutJournalPath(c.configuration.Get().UploadsPath, source)
+	if err != nil {
+		return ImportReport{}, err
+	}
+	journal, err := openImportJournal(journalPath)
+	if err != nil {
+		return ImportReport{}, err
+	}
+	report, err := c.importItems(ctx, items, opts, journal, out)
+	if closeErr := journal.close(); err == nil {
+		err = closeErr
+	}
+	if err == nil && report.Failed == 0 && !opts.DryRun {
+		os.Remove(journalPath)
+	}
+	return report, err
+}
+
+// openTakeout opens a Takeout zip file or directory as a file system.
+func openTakeout(source string) (fs.FS, func() error, error) {
+	info, err := os.Stat(source)
+	if err != nil {
+		return nil, nil, err
+	}
+	if info.IsDir() {
+		return os.DirFS(source), func() error { return nil }, nil
+	}
+	archive, err := zip.OpenReader(source)
+	if err != nil {
+		return nil, nil, err
+	}
+	return archive, archive.Close, nil
+}
+
+// takeoutItems lists the photos in a Takeout export along with their
+// sidecars and albums.
+func takeoutItems(fsys fs.FS, source string) ([]importItem, error) {
+	sidecars := map[string][]string{}
+	var photos []string
+	err := fs.WalkDir(fsys, ".", func(name string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if strings.HasPrefix(entry.Name(), ".") && name != "." {
+			if entry.IsDir() {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		if !entry.Type().IsRegular() {
+			return nil
+		}
+		if strings.EqualFold(path.Ext(name), ".json") {
+			dir := path.Dir(name)
+			sidecars[dir] = append(sidecars[dir], path.Base(name))
+		} else {
+			photos = append(photos, name)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	albums := map[string]string{}
+	var items []importItem
+	for _, name := range photos {
+		name := name
+		dir := path.Dir(name)
+		album, ok := albums[dir]
+		if !ok {
+			album = takeoutAlbum(fsys, dir)
+			albums[dir] = album
+		}
+		sidecar := matchTakeoutSidecar(path.Base(name), sidecars[dir])
+		var modTime time.Time
+		if info, err := fs.Stat(fsys, name); err == nil {
+			modTime = info.ModTime()
+		}
+		items = append(items, importItem{
+			name:    name,
+			modTime: modTime,
+			open:    func() (io.ReadCloser, error) { return fsys.Open(name) },
+			describe: func() (importSidecar, error) {
+				return readTakeoutSidecar(fsys, name, sidecar, album)
+			},
+		})
+	}
+	slog.Info("Read Takeout export", "source", source, "photos", len(items), "albums", len(albums))
+	return items, nil
+}
+
+// takeoutAlbum names the album for a folder: the title in its metadata.json,
+// or else the folder's name. Year folders and the top level are not albums.
+func takeoutAlbum(fsys fs.FS, dir string) string {
+	if data, err := fs.ReadFile(fsys, path.Join(dir, "metadata.json")); err == nil {
+		var metadata struct {
+			Title string `json:"title"`
+		}
+		if json.Unmarshal(data, &metadata) == nil && metadata.Title != "" {
+			return metadata.Title
+		}
+	}
+	name := path.Base(dir)
+	if dir == "." || name == "Google Photos" || name == "Takeout" || takeoutYearFolder.MatchString(name) {
+		return ""
+	}
+	return name
+}
+
+// matchTakeoutSidecar finds the sidecar of a photo among the JSON files in
+// its folder. Besides "IMG_1.jpg.json", Takeout uses
+// "IMG_1.jpg.supplemental-metadata.json", truncates long names, moves copy
+// numbers ("IMG_1(1).jpg" is described by "IMG_1.jpg(1).json") and has
+// edited photos ("IMG_1-edited.jpg") share the original's sidecar.
+func matchTakeoutSidecar(photo string, sidecars []string) string {
+	ext := path.Ext(photo)
+	if stem := strings.TrimSuffix(photo, ext); strings.HasSuffix(stem, "-edited") {
+		photo = strings.TrimSuffix(stem, "-edited") + ext
+	}
+	copyNumber := ""
+	if m := takeoutCopyNumber.FindStringSubmatch(photo); m != nil {
+		photo, copyNumber = m[1]+m[3], m[2]
+	}
+	var best string
+	bestScore := 0
+	for _, sidecar := range sidecars {
+		stem := strings.TrimSuffix(sidecar, path.Ext(sidecar))
+		if !strings.HasSuffix(stem, copyNumber) {
+			continue
+		}
+		stem = strings.TrimSuffix(stem, copyNumber)
+		score := 0
+		switch {
+		case stem == photo:
+			score = 4
+		case stem == photo+".supplemental-metadata":
+			score = 3
+		case len(stem) > len(photo) && strings.HasPrefix(photo+".supplemental-metadata", stem):
+			score = 2
+		case len(stem)+len(copyNumber) >= takeoutMaxSidecarName && strings.HasPrefix(photo, stem):
+			score = 1
+		case stem == strings.TrimSuffix(photo, path.Ext(photo)):
+			score = 1
+		}
+		if score > bestScore {
+			best, bestScore = sidecar, score
+		}
+	}
+	return best
+}
+
+// readTakeoutSidecar maps a photo's Takeout sidecar, if it has one, onto the
+// post fields.
+func readTakeoutSidecar(fsys fs.FS, name string, sidecarName string, album string) (importSidecar, error) {
+	sidecar := importSidecar{Album: album}
+	if sidecarName == "" {
+		return sidecar, nil
+	}
+	sidecarPath := path.Join(path.Dir(name), sidecarName)
+	data, err := fs.ReadFile(fsys, sidecarPath)
+	if err != nil {
+		return sidecar, err
+	}
+	var takeout takeoutSidecar
+	if err := json.Unmarshal(data, &takeout); err != nil {
+		return sidecar, fmt.Errorf("sidecar %s: %w", sidecarPath, err)
+	}
+	// The title is usually just the original filename.
+	if takeout.Title != "" && takeout.Title != path.Base(name) {
+		sidecar.Title = takeout.Title
+	}
+	sidecar.Text = takeout.Description
+	if taken, ok := takeout.PhotoTakenTime.time(); ok {
+		sidecar.PostTime = taken.Format(time.RFC3339)
+	} else if created, ok := takeout.CreationTime.time(); ok {
+		sidecar.PostTime = created.Format(time.RFC3339)
+	}
+	for _, person := range takeout.People {
+		if person.Name != "" {
+			sidecar.Tags = append(sidecar.Tags, person.Name)
+		}
+	}
+	return sidecar, nil
+}
+
+// takeoutJournalPath names the journal for an import source, from its
+// absolute path.
+func takeoutJournalPath(uploadsPath string, source string) (string, error) {
+	abs, err := filepath.Abs(source)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(uploadsPath, fmt.Sprintf(".import-%x.journal", sha1.Sum([]byte(abs)))), nil
+}
+
+// importJournal is an append only list of the files an import has dealt
+// with, one per line. A nil journal records nothing.
+type importJournal struct {
+	mu       sync.Mutex
+	file     *os.File
+	finished map[string]bool
+}
+
+func openImportJournal(path string) (*importJournal, error) {
+	j := &importJournal{finished: map[string]bool{}}
+	if f, err := os.Open(path); err == nil {
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			j.finished[scanner.Text()] = true
+		}
+		err = scanner.Err()
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+		if len(j.finished) > 0 {
+			slog.Info("Resuming import", "journal", path, "finished", len(j.finished))
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	j.file = f
+	return j, nil
+}
+
+func (j *importJournal) done(name string) bool {
+	if j == nil {
+		return false
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.finished[name]
+}
+
+// add records name, syncing so that it is not imported again after a crash.
+func (j *importJournal) add(name string) error {
+	if j == nil {
+		return nil
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.finished[name] = true
+	if _, err := fmt.Fprintln(j.file, name); err != nil {
+		return err
+	}
+	return j.file.Sync()
+}
+
+func (j *importJournal) close() error {
+	if j == nil {
+		return nil
+	}
+	return j.file.Close()
+}
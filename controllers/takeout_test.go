@@ -0,0 +1,113 @@
+package controllers
+
+import (
+	"bytes"
+	"context"
+	"image/color"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestMatchTakeoutSidecar(t *testing.T) {
+	long := "PXL_20230601_143005123.NIGHT.PORTRAIT-01.COVER~2.jpg"
+	for _, tt := range []struct {
+		name     string
+		photo    string
+		sidecars []string
+		want     string
+	}{
+		{"exact", "IMG_1.jpg", []string{"IMG_1.jpg.json"}, "IMG_1.jpg.json"},
+		{"supplemental metadata", "IMG_1.jpg", []string{"IMG_1.jpg.supplemental-metadata.json"}, "IMG_1.jpg.supplemental-metadata.json"},
+		{"truncated supplemental metadata", "IMG_1.jpg", []string{"IMG_1.jpg.supplemental-me.json"}, "IMG_1.jpg.supplemental-me.json"},
+		{"exact before supplemental metadata", "IMG_1.jpg", []string{"IMG_1.jpg.supplemental-metadata.json", "IMG_1.jpg.json"}, "IMG_1.jpg.json"},
+		{"without the extension", "IMG_1.jpg", []string{"IMG_1.json"}, "IMG_1.json"},
+		{"truncated name", long, []string{long[:takeoutMaxSidecarName] + ".json"}, long[:takeoutMaxSidecarName] + ".json"},
+		{"short name is not truncated", "IMG_1.jpg", []string{"IMG_.json"}, ""},
+		{"moved copy number", "IMG_1(1).jpg", []string{"IMG_1.jpg.json", "IMG_1.jpg(1).json"}, "IMG_1.jpg(1).json"},
+		{"original of a copy", "IMG_1.jpg", []string{"IMG_1.jpg(1).json", "IMG_1.jpg.json"}, "IMG_1.jpg.json"},
+		{"copy number with supplemental metadata", "IMG_1(2).jpg", []string{"IMG_1.jpg.supplemental-metadata.json", "IMG_1.jpg.supplemental-metadata(2).json"}, "IMG_1.jpg.supplemental-metadata(2).json"},
+		{"edited", "IMG_1-edited.jpg", []string{"IMG_1.jpg.json"}, "IMG_1.jpg.json"},
+		{"edited copy", "IMG_1(1)-edited.jpg", []string{"IMG_1.jpg.json", "IMG_1.jpg(1).json"}, "IMG_1.jpg(1).json"},
+		{"other photo", "IMG_2.jpg", []string{"IMG_1.jpg.json", "metadata.json"}, ""},
+		{"longer name", "IMG_1.jpg", []string{"IMG_10.jpg.json"}, ""},
+		{"no sidecars", "IMG_1.jpg", nil, ""},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := matchTakeoutSidecar(tt.photo, tt.sidecars); got != tt.want {
+				t.Errorf("matchTakeoutSidecar(%q, %q) = %q, want %q", tt.photo, tt.sidecars, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestImportTakeoutResumes(t *testing.T) {
+	c := newTestController(t, nil)
+	source := filepath.Join(t.TempDir(), "Takeout")
+	photos := filepath.Join(source, "Google Photos")
+	writeFiles(t, photos, map[string][]byte{
+		"Photos from 2019/IMG_1.png":                  testPNG(t, color.Black),
+		"Photos from 2019/IMG_1.png.json":             []byte(`{"title": "IMG_1.png", "description": "Beach", "photoTakenTime": {"timestamp": "1559399405"}, "people": [{"name": "Alice"}]}`),
+		"Summer/metadata.json":                        []byte(`{"title": "Summer 2019"}`),
+		"Summer/IMG_2.png":                            gradientPNG(t),
+		"Summer/IMG_2.png.supplemental-metadata.json": []byte(`{"title": "Sunset"}`),
+		"Summer/IMG_3.png":                            testPNG(t, color.White)[:40],
+	})
+	opts := ImportOptions{Author: "Importer", Duplicates: duplicatesAllow}
+
+	// The broken photo fails, so the journal is kept for the next run.
+	var out bytes.Buffer
+	report, err := c.ImportTakeout(context.Background(), source, opts, &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (ImportReport{Files: 3, Created: 2, Failed: 1}); report != want {
+		t.Errorf("first report = %+v, want %+v\n%s", report, want, out.String())
+	}
+	journalPath, err := takeoutJournalPath(c.configuration.Get().UploadsPath, source)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(journalPath); err != nil {
+		t.Fatalf("the journal of the failed import was not kept: %s", err)
+	}
+
+	writeFiles(t, photos, map[string][]byte{"Summer/IMG_3.png": testPNG(t, color.White)})
+	out.Reset()
+	report, err = c.ImportTakeout(context.Background(), source, opts, &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (ImportReport{Files: 1, Created: 1, Resumed: 2}); report != want {
+		t.Errorf("resumed report = %+v, want %+v\n%s", report, want, out.String())
+	}
+	if _, err := os.Stat(journalPath); !os.IsNotExist(err) {
+		t.Errorf("the journal was not removed after the import completed: %v", err)
+	}
+
+	posts, err := c.datastore.FindAllPosts()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(posts) != 3 {
+		t.Fatalf("%d posts, want one for each photo", len(posts))
+	}
+	byTitle := map[string]int{}
+	for i, post := range posts {
+		byTitle[post.Title] = i
+	}
+	if i, ok := byTitle["IMG 1"]; !ok {
+		t.Errorf("no post titled from the filename IMG_1.png")
+	} else if post := posts[i]; post.Text != "Beach" || post.Album != "" || len(post.Tags) != 1 || post.Tags[0] != "Alice" || !post.PostTime.Equal(time.Unix(1559399405, 0)) {
+		t.Errorf("IMG_1.png's post = %q in %q tagged %q at %v, want its sidecar's", post.Text, post.Album, post.Tags, post.PostTime)
+	}
+	if i, ok := byTitle["Sunset"]; !ok {
+		t.Errorf("no post titled from IMG_2.png's supplemental metadata")
+	} else if posts[i].Album != "Summer 2019" {
+		t.Errorf("IMG_2.png's album = %q, want the folder's title", posts[i].Album)
+	}
+	if i, ok := byTitle["IMG 3"]; !ok || posts[i].Album != "Summer 2019" {
+		t.Errorf("IMG_3.png was not imported into its folder's album on the second run")
+	}
+}
@@ -0,0 +1,446 @@
+package controllers
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gorilla/mux"
+	"github.com/mattgibbs/photopost/config"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TusController implements resumable uploads with the tus protocol
+// (https://tus.io/protocols/resumable-upload), with the creation,
+// expiration and termination extensions. The post fields are sent as
+// Upload-Metadata (title, text, author, postTime, duplicates, filename and
+// filetype). When the last byte arrives the upload is turned into a post
+// exactly as PostCreate would, and the new post's ID is returned in X-Post-ID.
+//
+// Partial uploads are kept in a hidden directory inside the uploads
+// directory, so that a completed upload can be stored with a rename.
+type TusController struct {
+	posts         *PostController
+	configuration *config.Store
+	// locks holds a lock for each upload that has requests in progress.
+	locksMu sync.Mutex
+	locks   map[string]*tusLock
+}
+
+// tusLock is the lock for one upload, and the number of requests holding
+// or waiting for it, so that it can be dropped once there are none.
+type tusLock struct {
+	sync.Mutex
+	users int
+}
+
+const (
+	tusVersion     = "1.0.0"
+	tusExtensions  = "creation,expiration,termination"
+	tusDir         = ".tus"
+	tusContentType = "application/offset+octet-stream"
+)
+
+var tusIDPattern = regexp.MustCompile(`^[0-9a-f]{32}$`)
+
+// tusUpload is the state of a resumable upload, stored as JSON next to its
+// data. The current offset is the size of the data file, which is synced
+// after every PATCH.
+type tusUpload struct {
+	ID       string            `json:"id"`
+	Length   int64             `json:"length"`
+	Metadata map[string]string `json:"metadata"`
+	Created  time.Time         `json:"created"`
+	Expires  time.Time         `json:"expires"`
+}
+
+func NewTusController(posts *PostController, configuration *config.Store) *TusController {
+	c := new(TusController)
+	c.posts = posts
+	c.configuration = configuration
+	c.locks = map[string]*tusLock{}
+	return c
+}
+
+func (c *TusController) dir() string {
+	return filepath.Join(c.configuration.Get().UploadsPath, tusDir)
+}
+
+func (c *TusController) dataPath(id string) string {
+	return filepath.Join(c.dir(), id)
+}
+
+func (c *TusController) infoPath(id string) string {
+	return filepath.Join(c.dir(), id+".json")
+}
+
+// lock serializes requests for one upload, so that two PATCHes can't append
+// at the same time. The lock is forgotten when the last request for the
+// upload is done with it, so finished, deleted and made up uploads do not
+// leave locks behind.
+func (c *TusController) lock(id string) func() {
+	c.locksMu.Lock()
+	l := c.locks[id]
+	if l == nil {
+		l = new(tusLock)
+		c.locks[id] = l
+	}
+	l.users++
+	c.locksMu.Unlock()
+	l.Lock()
+	return func() {
+		l.Unlock()
+		c.locksMu.Lock()
+		defer c.locksMu.Unlock()
+		l.users--
+		if l.users == 0 {
+			delete(c.locks, id)
+		}
+	}
+}
+
+// checkVersion sets the Tus-Resumable header and rejects clients that speak
+// another version of the protocol.
+func checkVersion(w http.ResponseWriter, r *http.Request) bool {
+	w.Header().Set("Tus-Resumable", tusVersion)
+	if r.Header.Get("Tus-Resumable") != tusVersion {
+		w.Header().Set("Tus-Version", tusVersion)
+		http.Error(w, "Unsupported tus version.", http.StatusPreconditionFailed)
+		return false
+	}
+	return true
+}
+
+// TusOptions describes the server's tus support.
+func (c *TusController) TusOptions(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Tus-Resumable", tusVersion)
+	w.Header().Set("Tus-Version", tusVersion)
+	w.Header().Set("Tus-Extension", tusExtensions)
+	w.Header().Set("Tus-Max-Size", strconv.FormatInt(c.configuration.Get().MaxUploadBytes, 10))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// TusCreate starts a new upload. The post fields are validated now, so a
+// client finds out about a missing title before sending the image.
+func (c *TusController) TusCreate(w http.ResponseWriter, r *http.Request) {
+	if !checkVersion(w, r) {
+		return
+	}
+	cfg := c.configuration.Get()
+	if r.Header.Get("Upload-Defer-Length") != "" {
+		http.Error(w, "Upload-Defer-Length is not supported.", http.StatusBadRequest)
+		return
+	}
+	length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length < 0 {
+		http.Error(w, "Upload-Length must be a non-negative integer.", http.StatusBadRequest)
+		return
+	}
+	if length > cfg.MaxUploadBytes {
+		http.Error(w, fmt.Sprintf("Upload is larger than the %d byte limit.", cfg.MaxUploadBytes), http.StatusRequestEntityTooLarge)
+		return
+	}
+	metadata, err := parseTusMetadata(r.Header.Get("Upload-Metadata"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !validateImageFile(metadata["filetype"], cfg.AllowedTypes) {
+		http.Error(w, "Uploaded image is not an allowed file type.", http.StatusUnprocessableEntity)
+		return
+	}
+	post, err := postFromFields(metadataFields(metadata))
+	if err != nil {
+		http.Error(w, err.Error(), statusForError(err))
+		return
+	}
+	post.ImageFile = "pending"
+	if valid, validation_err := post.Validate(); !valid {
+		http.Error(w, validation_err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	if _, err := duplicatePolicy(metadataFields(metadata), cfg); err != nil {
+		http.Error(w, err.Error(), statusForError(err))
+		return
+	}
+
+	if err := os.MkdirAll(c.dir(), 0755); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	now := time.Now()
+	upload := tusUpload{
+		ID:       newUploadID(),
+		Length:   length,
+		Metadata: metadata,
+		Created:  now,
+		Expires:  now.Add(cfg.ResumableUploadExpiry.Duration()),
+	}
+	data, err := os.OpenFile(c.dataPath(upload.ID), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	data.Close()
+	if err := c.writeInfo(&upload); err != nil {
+		os.Remove(c.dataPath(upload.ID))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	slog.InfoContext(r.Context(), "Created resumable upload", "upload_id", upload.ID, "length", length, "filename", metadata["filename"])
+	w.Header().Set("Location", "uploads/"+upload.ID)
+	w.Header().Set("Upload-Expires", upload.Expires.UTC().Format(http.TimeFormat))
+	w.WriteHeader(http.StatusCreated)
+}
+
+// TusHead reports how much of an upload the server has.
+func (c *TusController) TusHead(w http.ResponseWriter, r *http.Request) {
+	if !checkVersion(w, r) {
+		return
+	}
+	id := mux.Vars(r)["uploadid"]
+	defer c.lock(id)()
+	upload, offset, err := c.load(id)
+	if err != nil {
+		http.Error(w, err.Error(), statusForError(err))
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+	w.Header().Set("Upload-Length", strconv.FormatInt(upload.Length, 10))
+	w.Header().Set("Upload-Expires", upload.Expires.UTC().Format(http.TimeFormat))
+	w.WriteHeader(http.StatusOK)
+}
+
+// TusPatch appends to an upload at the offset the client says it is at.
+// The upload is turned into a post once it is complete.
+func (c *TusController) TusPatch(w http.ResponseWriter, r *http.Request) {
+	if !checkVersion(w, r) {
+		return
+	}
+	if r.Header.Get("Content-Type") != tusContentType {
+		http.Error(w, "Content-Type must be "+tusContentType+".", http.StatusUnsupportedMediaType)
+		return
+	}
+	id := mux.Vars(r)["uploadid"]
+	defer c.lock(id)()
+	upload, offset, err := c.load(id)
+	if err != nil {
+		http.Error(w, err.Error(), statusForError(err))
+		return
+	}
+	clientOffset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil {
+		http.Error(w, "Upload-Offset must be an integer.", http.StatusBadRequest)
+		return
+	}
+	if clientOffset != offset {
+		http.Error(w, fmt.Sprintf("Upload-Offset %d does not match the current offset %d.", clientOffset, offset), http.StatusConflict)
+		return
+	}
+
+	data, err := os.OpenFile(c.dataPath(id), os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	// Keep whatever arrived before the connection dropped, that is the
+	// point of a resumable upload. Anything past Upload-Length is an error.
+	r.Body = http.MaxBytesReader(w, r.Body, upload.Length-offset)
+	written, copyErr := io.Copy(data, r.Body)
+	syncErr := data.Sync()
+	closeErr := data.Close()
+	offset += written
+	w.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+	w.Header().Set("Upload-Expires", upload.Expires.UTC().Format(http.TimeFormat))
+	if copyErr != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(copyErr, &maxBytesErr) {
+			http.Error(w, "Upload is longer than its Upload-Length.", http.StatusRequestEntityTooLarge)
+			return
+		}
+		slog.WarnContext(r.Context(), "Resumable upload interrupted", "upload_id", id, "offset", offset, "err", copyErr)
+		http.Error(w, copyErr.Error(), http.StatusBadRequest)
+		return
+	}
+	if syncErr != nil || closeErr != nil {
+		http.Error(w, errors.Join(syncErr, closeErr).Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if offset == upload.Length {
+		postID, duplicates, err := c.complete(r.Context(), upload)
+		if err != nil {
+			writeCreateError(w, r, err)
+			return
+		}
+		setDuplicateHeader(w, duplicates)
+		w.Header().Set("X-Post-ID", strconv.FormatInt(postID, 10))
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// TusDelete abandons an upload.
+func (c *TusController) TusDelete(w http.ResponseWriter, r *http.Request) {
+	if !checkVersion(w, r) {
+		return
+	}
+	id := mux.Vars(r)["uploadid"]
+	defer c.lock(id)()
+	if _, _, err := c.load(id); err != nil {
+		http.Error(w, err.Error(), statusForError(err))
+		return
+	}
+	c.remove(id)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// complete creates the post for a finished upload. The upload is removed
+// whether or not that works: if the image is rejected, resending it won't
+// help.
+func (c *TusController) complete(ctx context.Context, upload *tusUpload) (int64, []DuplicateMatch, error) {
+	defer c.remove(upload.ID)
+	img, err := imageFromFile(c.dataPath(upload.ID), upload.Metadata["filetype"], upload.Metadata["filename"], c.configuration.Get())
+	if err != nil {
+		return 0, nil, err
+	}
+	post, err := postFromFields(metadataFields(upload.Metadata))
+	if err != nil {
+		return 0, nil, err
+	}
+	policy, err := duplicatePolicy(metadataFields(upload.Metadata), c.configuration.Get())
+	if err != nil {
+		return 0, nil, err
+	}
+	slog.InfoContext(ctx, "Saving a new file", "filename", img.filename, "size", img.size, "content_type", img.contentType, "upload_id", upload.ID)
+	duplicates, err := c.posts.createPost(ctx, post, img, policy)
+	if err != nil {
+		return 0, nil, err
+	}
+	return post.Id, duplicates, nil
+}
+
+// load returns an upload and its current offset. Expired uploads are gone.
+func (c *TusController) load(id string) (*tusUpload, int64, error) {
+	if !tusIDPattern.MatchString(id) {
+		return nil, 0, errorWithStatus(http.StatusNotFound, "Upload not found.")
+	}
+	b, err := os.ReadFile(c.infoPath(id))
+	if os.IsNotExist(err) {
+		return nil, 0, errorWithStatus(http.StatusNotFound, "Upload not found.")
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	var upload tusUpload
+	if err := json.Unmarshal(b, &upload); err != nil {
+		return nil, 0, err
+	}
+	if time.Now().After(upload.Expires) {
+		c.remove(id)
+		return nil, 0, errorWithStatus(http.StatusGone, "Upload has expired.")
+	}
+	info, err := os.Stat(c.dataPath(id))
+	if err != nil {
+		return nil, 0, err
+	}
+	return &upload, info.Size(), nil
+}
+
+func (c *TusController) writeInfo(upload *tusUpload) error {
+	b, err := json.Marshal(upload)
+	if err != nil {
+		return err
+	}
+	tmp := c.infoPath(upload.ID) + ".tmp"
+	if err := os.WriteFile(tmp, b, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, c.infoPath(upload.ID))
+}
+
+func (c *TusController) remove(id string) {
+	os.Remove(c.infoPath(id))
+	os.Remove(c.dataPath(id))
+}
+
+// ExpireUploads deletes expired partial uploads every interval until ctx is
+// done.
+func (c *TusController) ExpireUploads(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		c.expireUploads()
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (c *TusController) expireUploads() {
+	infos, err := filepath.Glob(filepath.Join(c.dir(), "*.json"))
+	if err != nil {
+		slog.Error("Error while listing resumable uploads", "err", err)
+		return
+	}
+	for _, info := range infos {
+		id := strings.TrimSuffix(filepath.Base(info), ".json")
+		unlock := c.lock(id)
+		// load removes the upload if it has expired.
+		_, _, err := c.load(id)
+		unlock()
+		if status := statusForError(err); err != nil && (status == http.StatusGone || status == http.StatusNotFound) {
+			slog.Info("Removed expired resumable upload", "upload_id", id)
+		}
+	}
+}
+
+// parseTusMetadata decodes an Upload-Metadata header: comma separated pairs
+// of a key and a base64 encoded value.
+func parseTusMetadata(header string) (map[string]string, error) {
+	metadata := map[string]string{}
+	for _, pair := range strings.Split(header, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		key, encoded, _ := strings.Cut(pair, " ")
+		value, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+		if err != nil {
+			return nil, fmt.Errorf("Upload-Metadata value for %q is not valid base64.", key)
+		}
+		metadata[key] = string(value)
+	}
+	return metadata, nil
+}
+
+func newUploadID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+func metadataFields(metadata map[string]string) url.Values {
+	fields := url.Values{}
+	for key, value := range metadata {
+		fields.Set(key, value)
+	}
+	return fields
+}
@@ -0,0 +1,70 @@
+package controllers
+
+import (
+	"bytes"
+	"encoding/base64"
+	"github.com/gorilla/mux"
+	"image/color"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"strconv"
+	"testing"
+)
+
+func tusRequest(method string, id string, body []byte) *http.Request {
+	r := httptest.NewRequest(method, "/posts/uploads/"+id, bytes.NewReader(body))
+	r.Header.Set("Tus-Resumable", tusVersion)
+	if id != "" {
+		r = mux.SetURLVars(r, map[string]string{"uploadid": id})
+	}
+	return r
+}
+
+func createTusUpload(t *testing.T, c *TusController, length int) string {
+	t.Helper()
+	b64 := base64.StdEncoding.EncodeToString
+	r := tusRequest("POST", "", nil)
+	r.Header.Set("Upload-Length", strconv.Itoa(length))
+	r.Header.Set("Upload-Metadata", "filename "+b64([]byte("a.png"))+",filetype "+b64([]byte("image/png"))+
+		",title "+b64([]byte("Resumed"))+",author "+b64([]byte("tester")))
+	w := httptest.NewRecorder()
+	c.TusCreate(w, r)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("TusCreate: %d %s", w.Code, w.Body.String())
+	}
+	return path.Base(w.Header().Get("Location"))
+}
+
+func TestTusLocksAreForgotten(t *testing.T) {
+	posts := newTestController(t, nil)
+	c := NewTusController(posts, posts.configuration)
+	image := testPNG(t, color.Black)
+
+	finished := createTusUpload(t, c, len(image))
+	r := tusRequest("PATCH", finished, image)
+	r.Header.Set("Content-Type", tusContentType)
+	r.Header.Set("Upload-Offset", "0")
+	w := httptest.NewRecorder()
+	c.TusPatch(w, r)
+	if w.Code != http.StatusNoContent || w.Header().Get("X-Post-ID") == "" {
+		t.Fatalf("TusPatch: %d %s", w.Code, w.Body.String())
+	}
+
+	deleted := createTusUpload(t, c, len(image))
+	w = httptest.NewRecorder()
+	c.TusDelete(w, tusRequest("DELETE", deleted, nil))
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("TusDelete: %d %s", w.Code, w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	c.TusHead(w, tusRequest("HEAD", "0123456789abcdef0123456789abcdef", nil))
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("TusHead of an unknown upload: %d", w.Code)
+	}
+
+	if len(c.locks) != 0 {
+		t.Errorf("%d upload locks were left behind", len(c.locks))
+	}
+}
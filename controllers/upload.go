@@ -0,0 +1,340 @@
+package controllers
+
+import (
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"github.com/mattgibbs/photopost/config"
+	"github.com/mattgibbs/photopost/model"
+	"image"
+	// The decoders for config.ImageTypes.
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+	"io/fs"
+	"log/slog"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// multipartOverhead is allowed on top of maxUploadBytes for the multipart
+// boundaries and the text fields sent along with the image.
+const multipartOverhead = 1 << 20
+
+// maxFieldBytes caps a single text field of an upload form.
+const maxFieldBytes = 64 << 10
+
+// tempUploadPattern names uploads that have not been stored yet. They live in
+// the uploads directory so that storing them is an atomic rename.
+const tempUploadPattern = ".upload-*"
+
+// statusError is an error that carries the HTTP status it should be
+// reported with.
+type statusError struct {
+	status int
+	err    error
+}
+
+func (e *statusError) Error() string {
+	return e.err.Error()
+}
+
+func (e *statusError) Unwrap() error {
+	return e.err
+}
+
+func errorWithStatus(status int, format string, args ...interface{}) error {
+	return &statusError{status: status, err: fmt.Errorf(format, args...)}
+}
+
+// statusForError returns the HTTP status for err, defaulting to 500.
+func statusForError(err error) int {
+	var se *statusError
+	if errors.As(err, &se) {
+		return se.status
+	}
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		return http.StatusRequestEntityTooLarge
+	}
+	return http.StatusInternalServerError
+}
+
+// uploadedImage is an image that has been streamed to a temporary file in
+// the uploads directory. The file is moved to its content addressed name by
+// store, or deleted by discard.
+type uploadedImage struct {
+	tempPath    string
+	hash        []byte
+	size        int64
+	contentType string
+	filename    string
+	phash       *model.PerceptualHash
+}
+
+// discard removes the temporary file, if it has not been stored.
+func (u *uploadedImage) discard() {
+	if u != nil && u.tempPath != "" {
+		os.Remove(u.tempPath)
+		u.tempPath = ""
+	}
+}
+
+// storedFilename is the content addressed path the image is stored under:
+// the SHA-1 of its contents, plus an extension for its type.
+func (u *uploadedImage) storedFilename(uploadsPath string) (string, error) {
+	fileExtensions, mimeErr := mime.ExtensionsByType(u.contentType)
+	if mimeErr != nil {
+		return "", mimeErr
+	}
+	if fileExtensions == nil {
+		return "", errors.New("Could not determine file extension for uploaded image.")
+	}
+	return filepath.Join(uploadsPath, fmt.Sprintf("%x%s", u.hash, fileExtensions[0])), nil
+}
+
+// store renames the temporary file to its content addressed name. The
+// temporary file has already been synced, and it is in the same directory,
+// so the rename is atomic: after a crash the final name refers either to
+// nothing or to the complete image.
+//
+// An image already stored under the name is replaced all the same, since it
+// may have been left incomplete by a crash before renames were used; the
+// new file has the same contents, so posts using the name see no change.
+// created is false in that case.
+//
+// The caller holds PostController.images for reading until the post using
+// the image is saved.
+func (u *uploadedImage) store(filename string) (created bool, err error) {
+	_, statErr := os.Stat(filename)
+	created = errors.Is(statErr, fs.ErrNotExist)
+	if err := os.Chmod(u.tempPath, 0644); err != nil {
+		return false, err
+	}
+	if err := os.Rename(u.tempPath, filename); err != nil {
+		return false, err
+	}
+	u.tempPath = ""
+	return created, syncDir(filepath.Dir(filename))
+}
+
+// syncDir flushes a directory entry change, such as a rename, to disk.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// RemoveStaleUploads deletes temporary upload files older than maxAge that
+// were left behind by a crash or a killed process.
+func RemoveStaleUploads(uploadsPath string, maxAge time.Duration) error {
+	matches, err := filepath.Glob(filepath.Join(uploadsPath, tempUploadPattern))
+	if err != nil {
+		return err
+	}
+	for _, path := range matches {
+		info, err := os.Stat(path)
+		if err != nil || time.Since(info.ModTime()) < maxAge {
+			continue
+		}
+		slog.Info("Removing stale temporary upload", "file", path)
+		if err := os.Remove(path); err != nil {
+			slog.Error("Error while removing stale temporary upload", "file", path, "err", err)
+		}
+	}
+	return nil
+}
+
+// readUploadForm streams a multipart upload form. Text fields are returned
+// in the url.Values, and the "image" part is streamed to a temporary file
+// while it is hashed, so the image is never held in memory. The request body
+// is capped so an oversized upload fails while it is being read.
+//
+// The returned image is nil if the form had no image; otherwise the caller
+// must store or discard it. Requests that are not multipart are parsed as
+// ordinary forms.
+func readUploadForm(w http.ResponseWriter, r *http.Request, cfg *config.Config) (url.Values, *uploadedImage, error) {
+	r.Body = http.MaxBytesReader(w, r.Body, cfg.MaxUploadBytes+multipartOverhead)
+	reader, err := r.MultipartReader()
+	if errors.Is(err, http.ErrNotMultipart) {
+		if err := r.ParseForm(); err != nil {
+			return nil, nil, errorWithStatus(statusForError(err), "Could not parse form: %s", err)
+		}
+		return r.Form, nil, nil
+	}
+	if err != nil {
+		return nil, nil, errorWithStatus(http.StatusBadRequest, "Could not parse upload form: %s", err)
+	}
+	fields := r.URL.Query()
+	var img *uploadedImage
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			img.discard()
+			return nil, nil, uploadReadError(err, cfg)
+		}
+		if part.FormName() == "image" && part.FileName() != "" {
+			if img != nil {
+				img.discard()
+				return nil, nil, errorWithStatus(http.StatusBadRequest, "Only one image can be uploaded per post.")
+			}
+			img, err = receiveImage(part, part.Header.Get("Content-Type"), part.FileName(), cfg)
+			part.Close()
+			if err != nil {
+				return nil, nil, err
+			}
+			continue
+		}
+		if err := readFormField(part, fields, cfg); err != nil {
+			img.discard()
+			return nil, nil, err
+		}
+	}
+	return fields, img, nil
+}
+
+// readFormField reads a text field of a multipart form into fields.
+func readFormField(part *multipart.Part, fields url.Values, cfg *config.Config) error {
+	defer part.Close()
+	value, err := io.ReadAll(io.LimitReader(part, maxFieldBytes+1))
+	if err != nil {
+		return uploadReadError(err, cfg)
+	}
+	if len(value) > maxFieldBytes {
+		return errorWithStatus(http.StatusRequestEntityTooLarge, "Form field %s is longer than %d bytes.", part.FormName(), maxFieldBytes)
+	}
+	fields.Add(part.FormName(), string(value))
+	return nil
+}
+
+// receiveImage streams one image to a temporary file in the uploads
+// directory, hashing it on the way, and checks it against the configured
+// type, size and pixel limits.
+func receiveImage(src io.Reader, contentType string, filename string, cfg *config.Config) (*uploadedImage, error) {
+	if !validateImageFile(contentType, cfg.AllowedTypes) {
+		return nil, errorWithStatus(http.StatusUnprocessableEntity, "Uploaded image is not an allowed file type.")
+	}
+	tmp, err := os.CreateTemp(cfg.UploadsPath, tempUploadPattern)
+	if err != nil {
+		return nil, err
+	}
+	img := &uploadedImage{tempPath: tmp.Name(), contentType: contentType, filename: filename}
+	imageHash := sha1.New()
+	// Read one byte past the limit so an image that is too large is
+	// rejected rather than silently truncated.
+	img.size, err = io.Copy(io.MultiWriter(tmp, imageHash), io.LimitReader(src, cfg.MaxUploadBytes+1))
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		img.discard()
+		return nil, uploadReadError(err, cfg)
+	}
+	if img.size > cfg.MaxUploadBytes {
+		img.discard()
+		return nil, errorWithStatus(http.StatusRequestEntityTooLarge, "Uploaded image is larger than the %d byte limit.", cfg.MaxUploadBytes)
+	}
+	img.hash = imageHash.Sum(nil)
+	if err := checkImageFileDimensions(img.tempPath, cfg); err != nil {
+		img.discard()
+		return nil, err
+	}
+	return img, nil
+}
+
+// imageFromFile checks an image that was already written to disk, by a
+// resumable upload for example, against the configured limits. The file must
+// be in the uploads directory's file system so that it can be stored with a
+// rename; it is removed if the image is discarded.
+func imageFromFile(path string, contentType string, filename string, cfg *config.Config) (*uploadedImage, error) {
+	if !validateImageFile(contentType, cfg.AllowedTypes) {
+		return nil, errorWithStatus(http.StatusUnprocessableEntity, "Uploaded image is not an allowed file type.")
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	img := &uploadedImage{tempPath: path, contentType: contentType, filename: filename}
+	imageHash := sha1.New()
+	img.size, err = io.Copy(imageHash, f)
+	if err != nil {
+		return nil, err
+	}
+	if img.size > cfg.MaxUploadBytes {
+		return nil, errorWithStatus(http.StatusRequestEntityTooLarge, "Uploaded image is larger than the %d byte limit.", cfg.MaxUploadBytes)
+	}
+	img.hash = imageHash.Sum(nil)
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	if err := checkImageDimensions(f, cfg); err != nil {
+		return nil, err
+	}
+	return img, nil
+}
+
+// uploadReadError reports an error reading an upload from a client, keeping
+// the cause so that callers with their own limits, such as PostBatchCreate,
+// can tell an *http.MaxBytesError apart. Errors reading or writing files,
+// such as a watched file on a network share or the temporary copy, are not
+// the client's fault and are left as they are, to be reported as 500.
+func uploadReadError(err error, cfg *config.Config) error {
+	var pathErr *fs.PathError
+	if errors.As(err, &pathErr) {
+		return err
+	}
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		return errorWithStatus(http.StatusRequestEntityTooLarge, "Upload is larger than the %d byte limit: %w", cfg.MaxUploadBytes, err)
+	}
+	return errorWithStatus(http.StatusBadRequest, "Could not read upload: %w", err)
+}
+
+func checkImageFileDimensions(path string, cfg *config.Config) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return checkImageDimensions(f, cfg)
+}
+
+// checkImageDimensions decodes just the image header and rejects images
+// with more than the configured number of pixels.
+func checkImageDimensions(r io.Reader, cfg *config.Config) error {
+	imageConfig, _, err := image.DecodeConfig(r)
+	if err != nil {
+		return errorWithStatus(http.StatusUnprocessableEntity, "Uploaded file is not a readable image: %s", err)
+	}
+	pixels := int64(imageConfig.Width) * int64(imageConfig.Height)
+	if pixels > cfg.MaxPixels {
+		return errorWithStatus(http.StatusRequestEntityTooLarge, "Uploaded image has %d pixels, more than the %d pixel limit.", pixels, cfg.MaxPixels)
+	}
+	return nil
+}
+
+func validateImageFile(contentType string, allowedTypes []string) bool {
+	isAllowedType := false
+	for i := range allowedTypes {
+		if contentType == allowedTypes[i] {
+			isAllowedType = true
+		}
+	}
+	return isAllowedType
+}
@@ -0,0 +1,77 @@
+package controllers
+
+import (
+	"bytes"
+	"context"
+	"github.com/mattgibbs/photopost/model"
+	"image/color"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestStoreReplacesIncompleteImage(t *testing.T) {
+	c := newTestController(t, nil)
+	cfg := c.configuration.Get()
+	data := testPNG(t, color.Black)
+	img, err := receiveImage(bytes.NewReader(data), "image/png", "photo.png", cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer img.discard()
+	filename, err := img.storedFilename(cfg.UploadsPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// As left by a crash part way through writing the image in place.
+	if err := os.WriteFile(filename, data[:len(data)/2], 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	created, err := img.store(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if created {
+		t.Error("store reported creating an image that was already there")
+	}
+	if stored, err := os.ReadFile(filename); err != nil || !bytes.Equal(stored, data) {
+		t.Errorf("the incomplete image was not replaced: %v", err)
+	}
+}
+
+func TestRemoveUnreferencedImageWaitsForSave(t *testing.T) {
+	c := newTestController(t, nil)
+	cfg := c.configuration.Get()
+	img, err := receiveImage(bytes.NewReader(testPNG(t, color.Black)), "image/png", "photo.png", cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer img.discard()
+	filename, err := img.storedFilename(cfg.UploadsPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// An upload of the image stores it, and before it saves its post,
+	// another request gives up on the same image and removes it.
+	c.images.RLock()
+	if _, err := img.store(filename); err != nil {
+		t.Fatal(err)
+	}
+	removed := make(chan struct{})
+	go func() {
+		c.removeUnreferencedImage(context.Background(), filename)
+		close(removed)
+	}()
+	time.Sleep(20 * time.Millisecond)
+	_, err = c.datastore.SavePost(&model.Post{Title: "photo", Author: "tester", ImageFile: filename, PostTime: time.Now(), Tags: []string{}})
+	c.images.RUnlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-removed
+	if _, err := os.Stat(filename); err != nil {
+		t.Errorf("the image was removed from under the post using it: %v", err)
+	}
+}
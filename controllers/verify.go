@@ -0,0 +1,99 @@
+package controllers
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+type VerifyReport struct {
+	Posts    int
+	Images   int
+	Missing  int
+	Corrupt  int
+	Orphaned int
+	Stale    int
+}
+
+// Problems is the number of posts whose image is missing or corrupt.
+func (r VerifyReport) Problems() int {
+	return r.Missing + r.Corrupt
+}
+
+// VerifyImages recomputes the hash of every post's image and compares it with
+// the content addressed filename, writing a line to out for each missing or
+// corrupt image. Files in the uploads directory that no post refers to, and
+// leftover temporary uploads, are reported too but are not counted as
+// problems.
+func (c *PostController) VerifyImages(out io.Writer) (VerifyReport, error) {
+	var report VerifyReport
+	posts, err := c.datastore.FindAllPosts()
+	if err != nil {
+		return report, err
+	}
+	report.Posts = len(posts)
+	checked := map[string]error{}
+	for _, post := range posts {
+		imageFile := filepath.Clean(post.ImageFile)
+		verifyErr, ok := checked[imageFile]
+		if !ok {
+			verifyErr = verifyImageFile(imageFile)
+			checked[imageFile] = verifyErr
+			report.Images++
+		}
+		switch {
+		case verifyErr == nil:
+		case os.IsNotExist(verifyErr):
+			report.Missing++
+			fmt.Fprintf(out, "missing: post %d: %s\n", post.Id, imageFile)
+		default:
+			report.Corrupt++
+			fmt.Fprintf(out, "corrupt: post %d: %s: %s\n", post.Id, imageFile, verifyErr)
+		}
+	}
+
+	uploadsPath := c.configuration.Get().UploadsPath
+	entries, err := os.ReadDir(uploadsPath)
+	if err != nil {
+		return report, err
+	}
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() {
+			continue
+		}
+		path := filepath.Join(uploadsPath, entry.Name())
+		if matched, _ := filepath.Match(tempUploadPattern, entry.Name()); matched {
+			report.Stale++
+			fmt.Fprintf(out, "stale temporary upload: %s\n", path)
+			continue
+		}
+		if _, ok := checked[filepath.Clean(path)]; !ok && !strings.HasPrefix(entry.Name(), ".") {
+			report.Orphaned++
+			fmt.Fprintf(out, "orphaned: %s\n", path)
+		}
+	}
+	return report, nil
+}
+
+// verifyImageFile checks that the SHA-1 of the file matches its name.
+func verifyImageFile(imageFile string) error {
+	f, err := os.Open(imageFile)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	imageHash := sha1.New()
+	if _, err := io.Copy(imageHash, f); err != nil {
+		return err
+	}
+	name := filepath.Base(imageFile)
+	expected := strings.TrimSuffix(name, filepath.Ext(name))
+	actual := fmt.Sprintf("%x", imageHash.Sum(nil))
+	if actual != expected {
+		return fmt.Errorf("content hash is %s", actual)
+	}
+	return nil
+}
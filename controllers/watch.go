@@ -0,0 +1,354 @@
+package controllers
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/fsnotify/fsnotify"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Watched files are moved into these hidden folders at the top of the watched
+// directory, which are not watched themselves.
+const (
+	watchDoneDir   = ".photopost-done"
+	watchFailedDir = ".photopost-failed"
+)
+
+// watchPollInterval is how often pending files are checked to see whether
+// they have settled.
+const watchPollInterval = time.Second
+
+// watchedFile is a file that has appeared in a watched directory but has not
+// been ingested yet.
+type watchedFile struct {
+	root     string
+	size     int64
+	modTime  time.Time
+	changed  time.Time
+	attempts int
+	retryAt  time.Time
+}
+
+type folderWatcher struct {
+	c       *PostController
+	watcher *fsnotify.Watcher
+	roots   []string
+	pending map[string]*watchedFile
+	// left records the files that were ingested, or gave up on, with the
+	// "leave" action, so that they are not ingested again after a restart.
+	left *importJournal
+}
+
+// WatchFolders turns image files that appear in the configured watchDirs,
+// and the folders in them, into posts until ctx is done, the same way
+// PostCreate would. Files already there when it starts are ingested too.
+//
+// A file is only ingested once its size and modification time have not
+// changed for watchSettle, so that one still being written is not read
+// half way. Failed files are retried watchRetries times, backing off each
+// time, unless the failure is the file's fault (not an image, too large),
+// which no retry will fix. Afterwards the file and its sidecar are dealt with
+// by watchAction: "move" moves them into .photopost-done (or
+// .photopost-failed) in the watched directory, "delete" deletes them (but
+// still moves failed ones to .photopost-failed), and "leave" leaves them
+// where they are.
+func (c *PostController) WatchFolders(ctx context.Context) {
+	cfg := c.configuration.Get()
+	if len(cfg.WatchDirs) == 0 {
+		return
+	}
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		slog.Error("Could not watch folders", "err", err)
+		return
+	}
+	defer watcher.Close()
+	left, err := openImportJournal(filepath.Join(cfg.UploadsPath, ".watch.journal"))
+	if err != nil {
+		slog.Error("Could not watch folders", "err", err)
+		return
+	}
+	defer left.close()
+	w := &folderWatcher{c: c, watcher: watcher, pending: map[string]*watchedFile{}, left: left}
+	for _, dir := range cfg.WatchDirs {
+		root, err := filepath.Abs(dir)
+		if err != nil {
+			slog.Error("Could not watch folder", "dir", dir, "err", err)
+			continue
+		}
+		w.roots = append(w.roots, root)
+		w.addTree(root, root)
+		slog.Info("Watching folder", "dir", root)
+	}
+
+	ticker := time.NewTicker(watchPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case event := <-watcher.Events:
+			w.handle(event)
+		case err := <-watcher.Errors:
+			slog.Error("Error while watching folders", "err", err)
+		case <-ticker.C:
+			w.ingestSettled(ctx)
+		}
+	}
+}
+
+// addTree watches dir and the folders in it, and notes the files already in
+// them.
+func (w *folderWatcher) addTree(root string, dir string) {
+	err := filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if strings.HasPrefix(entry.Name(), ".") && path != root {
+			if entry.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if entry.IsDir() {
+			if err := w.watcher.Add(path); err != nil {
+				slog.Error("Could not watch folder", "dir", path, "err", err)
+			}
+			return nil
+		}
+		w.touch(root, path)
+		return nil
+	})
+	if err != nil {
+		slog.Error("Error while scanning watched folder", "dir", dir, "err", err)
+	}
+}
+
+func (w *folderWatcher) rootOf(path string) (string, bool) {
+	for _, root := range w.roots {
+		if rel, err := filepath.Rel(root, path); err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return root, true
+		}
+	}
+	return "", false
+}
+
+func (w *folderWatcher) handle(event fsnotify.Event) {
+	path := filepath.Clean(event.Name)
+	root, ok := w.rootOf(path)
+	if !ok || strings.HasPrefix(filepath.Base(path), ".") {
+		return
+	}
+	if event.Has(fsnotify.Remove | fsnotify.Rename) {
+		delete(w.pending, path)
+		return
+	}
+	if !event.Has(fsnotify.Create | fsnotify.Write) {
+		return
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return
+	}
+	if info.IsDir() {
+		// A folder that was moved in may already have files in it.
+		w.addTree(root, path)
+		return
+	}
+	w.touch(root, path)
+}
+
+// touch notes that the file at path has appeared or changed.
+func (w *folderWatcher) touch(root string, path string) {
+	if isSidecarFile(path) {
+		return
+	}
+	if f, ok := w.pending[path]; ok {
+		f.changed = time.Now()
+		return
+	}
+	info, err := os.Stat(path)
+	if err != nil || !info.Mode().IsRegular() {
+		return
+	}
+	if w.left.done(watchJournalKey(path, info)) {
+		return
+	}
+	w.pending[path] = &watchedFile{root: root, size: info.Size(), modTime: info.ModTime(), changed: time.Now()}
+}
+
+func watchJournalKey(path string, info fs.FileInfo) string {
+	return fmt.Sprintf("%s\t%d\t%d", path, info.Size(), info.ModTime().UnixNano())
+}
+
+// ingestSettled ingests the pending files that have stopped changing.
+func (w *folderWatcher) ingestSettled(ctx context.Context) {
+	cfg := w.c.configuration.Get()
+	now := time.Now()
+	for path, f := range w.pending {
+		if ctx.Err() != nil {
+			return
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			delete(w.pending, path)
+			continue
+		}
+		if info.Size() != f.size || !info.ModTime().Equal(f.modTime) {
+			f.size, f.modTime, f.changed = info.Size(), info.ModTime(), now
+			continue
+		}
+		if now.Sub(f.changed) < cfg.WatchSettle.Duration() || now.Before(f.retryAt) {
+			continue
+		}
+
+		postId, err := w.c.ingestFile(ctx, path)
+		var dupErr *duplicateError
+		switch {
+		case err == nil:
+			slog.InfoContext(ctx, "Ingested watched file", "file", path, "post_id", postId)
+		case errors.As(err, &dupErr):
+			slog.InfoContext(ctx, "Watched file duplicates existing posts, not ingested", "file", path, "duplicates", describeDuplicates(dupErr.matches))
+		default:
+			f.attempts++
+			if !watchErrorPermanent(err) && f.attempts <= cfg.WatchRetries {
+				backoff := cfg.WatchSettle.Duration() << f.attempts
+				f.retryAt = now.Add(backoff)
+				slog.WarnContext(ctx, "Could not ingest watched file, will retry", "file", path, "attempt", f.attempts, "retry_in", backoff.String(), "err", err)
+				continue
+			}
+			slog.ErrorContext(ctx, "Could not ingest watched file, giving up", "file", path, "attempts", f.attempts, "err", err)
+			w.finish(f, path, info, cfg.WatchAction, watchFailedDir)
+			continue
+		}
+		w.finish(f, path, info, cfg.WatchAction, watchDoneDir)
+	}
+}
+
+// watchErrorPermanent reports whether ingesting a file failed because of
+// what is in it, which trying again will not change. Anything else, such as
+// an I/O error on a network share or a file the scanner still has locked, is
+// worth retrying.
+func watchErrorPermanent(err error) bool {
+	switch statusForError(err) {
+	case http.StatusRequestEntityTooLarge, http.StatusUnsupportedMediaType, http.StatusUnprocessableEntity:
+		return true
+	}
+	return false
+}
+
+// finish applies the post-ingest action to a file and its sidecars, and stops
+// tracking it.
+func (w *folderWatcher) finish(f *watchedFile, path string, info fs.FileInfo, action string, doneDir string) {
+	delete(w.pending, path)
+	jsonNames, xmpNames := sidecarNames(path)
+	files := []string{path}
+	for _, name := range append(jsonNames, xmpNames...) {
+		if _, err := os.Stat(name); err == nil {
+			files = append(files, name)
+		}
+	}
+	if action == "delete" && doneDir == watchFailedDir {
+		// Keep failed files so that they can be looked at.
+		action = "move"
+	}
+	switch action {
+	case "leave":
+		if err := w.left.add(watchJournalKey(path, info)); err != nil {
+			slog.Error("Error while recording watched file", "file", path, "err", err)
+		}
+	case "delete":
+		for _, name := range files {
+			if err := os.Remove(name); err != nil && !errors.Is(err, fs.ErrNotExist) {
+				slog.Error("Could not delete watched file", "file", name, "err", err)
+			}
+		}
+	default:
+		for _, name := range files {
+			// On a case insensitive file system, "a.xmp" and "a.XMP" are
+			// the same sidecar, and it will already have been moved.
+			if err := moveWatchedFile(f.root, name, doneDir); err != nil && !errors.Is(err, fs.ErrNotExist) {
+				slog.Error("Could not move watched file", "file", name, "err", err)
+			}
+		}
+	}
+}
+
+// moveWatchedFile moves a file into dirName at the top of root, keeping the
+// folders it was in and not overwriting anything already there.
+func moveWatchedFile(root string, path string, dirName string) error {
+	rel, err := filepath.Rel(root, path)
+	if err != nil {
+		return err
+	}
+	dst := filepath.Join(root, dirName, rel)
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	ext := filepath.Ext(dst)
+	stem := strings.TrimSuffix(dst, ext)
+	for n := 1; ; n++ {
+		if _, err := os.Lstat(dst); errors.Is(err, fs.ErrNotExist) {
+			break
+		}
+		dst = fmt.Sprintf("%s (%d)%s", stem, n, ext)
+	}
+	return os.Rename(path, dst)
+}
+
+// ingestFile creates a post for the image at path, with its title, time and
+// so on from its sidecar, EXIF data or name as for ImportDirectory, and the
+// configured watchAuthor and watchAlbum. It returns the new post's ID.
+func (c *PostController) ingestFile(ctx context.Context, path string) (int64, error) {
+	cfg := c.configuration.Get()
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0, err
+	}
+	src, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer src.Close()
+	reader := bufio.NewReaderSize(src, 512)
+	contentType, err := sniffContentType(reader)
+	if err != nil {
+		return 0, err
+	}
+	if !validateImageFile(contentType, cfg.AllowedTypes) {
+		return 0, errorWithStatus(http.StatusUnsupportedMediaType, "%s is not an allowed image type", contentType)
+	}
+	item := importItem{
+		name:     path,
+		modTime:  info.ModTime(),
+		open:     func() (io.ReadCloser, error) { return os.Open(path) },
+		describe: func() (importSidecar, error) { return readSidecar(path) },
+	}
+	post, err := importPost(item, ImportOptions{Author: cfg.WatchAuthor, Album: cfg.WatchAlbum}, configuredLocation(cfg))
+	if err != nil {
+		return 0, err
+	}
+	img, err := receiveImage(reader, contentType, filepath.Base(path), cfg)
+	if err != nil {
+		return 0, err
+	}
+	defer img.discard()
+	policy, err := duplicatePolicy(url.Values{}, cfg)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := c.createPost(ctx, post, img, policy); err != nil {
+		return 0, err
+	}
+	return post.Id, nil
+}
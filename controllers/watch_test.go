@@ -0,0 +1,56 @@
+package controllers
+
+import (
+	"bytes"
+	"context"
+	"github.com/mattgibbs/photopost/config"
+	"image/color"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+// failingReader fails like a read from a file on a share that went away.
+type failingReader struct{}
+
+func (failingReader) Read(p []byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: "/mnt/scans/photo.jpg", Err: syscall.EIO}
+}
+
+func TestWatchErrorPermanent(t *testing.T) {
+	cfg := config.Default()
+	cfg.UploadsPath = t.TempDir()
+	_, readErr := receiveImage(io.MultiReader(bytes.NewReader([]byte("\x89PNG")), failingReader{}), "image/png", "photo.png", &cfg)
+	if readErr == nil || watchErrorPermanent(readErr) {
+		t.Errorf("a read error (%v) should be retried", readErr)
+	}
+	_, corruptErr := receiveImage(bytes.NewReader([]byte("\x89PNG not really")), "image/png", "photo.png", &cfg)
+	if corruptErr == nil || !watchErrorPermanent(corruptErr) {
+		t.Errorf("a broken image (%v) should not be retried", corruptErr)
+	}
+	_, typeErr := receiveImage(bytes.NewReader(nil), "text/plain", "notes.txt", &cfg)
+	if typeErr == nil || !watchErrorPermanent(typeErr) {
+		t.Errorf("a file of the wrong type (%v) should not be retried", typeErr)
+	}
+}
+
+func TestWatchRetriesDatabaseErrors(t *testing.T) {
+	c := newTestController(t, func(cfg *config.Config) {
+		cfg.WatchAuthor = "Scanner"
+	})
+	c.datastore = failingDatastore{c.datastore}
+	path := filepath.Join(t.TempDir(), "scan.png")
+	if err := os.WriteFile(path, testPNG(t, color.Black), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	_, err := c.ingestFile(context.Background(), path)
+	if err == nil || watchErrorPermanent(err) {
+		t.Errorf("a failure to save the post (%v) should be retried", err)
+	}
+	if matches, _ := filepath.Glob(filepath.Join(c.configuration.Get().UploadsPath, "*.png")); len(matches) > 0 {
+		t.Errorf("the image was left in the uploads directory: %v", matches)
+	}
+}
@@ -0,0 +1,87 @@
+package controllers
+
+import (
+	"encoding/xml"
+	"errors"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+// xmpDescription holds the fields of an XMP sidecar, as written by Apple
+// Photos ("Export IPTC as XMP") and Lightroom, that map onto a post.
+// Properties can be written as elements or as attributes.
+type xmpDescription struct {
+	Title                []string `xml:"title>Alt>li"`
+	Description          []string `xml:"description>Alt>li"`
+	Subject              []string `xml:"subject>Bag>li"`
+	DateCreated          string   `xml:"DateCreated"`
+	DateCreatedAttr      string   `xml:"DateCreated,attr"`
+	DateTimeOriginal     string   `xml:"DateTimeOriginal"`
+	DateTimeOriginalAttr string   `xml:"DateTimeOriginal,attr"`
+}
+
+var xmpDateLayouts = []string{time.RFC3339Nano, "2006-01-02T15:04:05", "2006-01-02T15:04", "2006-01-02"}
+
+// readXMPSidecar reads the title, description, keywords and date of an XMP
+// sidecar into an importSidecar.
+func readXMPSidecar(name string) (importSidecar, error) {
+	var sidecar importSidecar
+	f, err := os.Open(name)
+	if err != nil {
+		return sidecar, err
+	}
+	defer f.Close()
+	// Descriptions can be split over several rdf:Description elements, and
+	// the packet may or may not be wrapped in x:xmpmeta.
+	decoder := xml.NewDecoder(f)
+	var dates []string
+	for {
+		token, err := decoder.Token()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return sidecar, err
+		}
+		start, ok := token.(xml.StartElement)
+		if !ok || start.Name.Local != "Description" {
+			continue
+		}
+		var d xmpDescription
+		if err := decoder.DecodeElement(&d, &start); err != nil {
+			return sidecar, err
+		}
+		if len(d.Title) > 0 && sidecar.Title == "" {
+			sidecar.Title = strings.TrimSpace(d.Title[0])
+		}
+		if len(d.Description) > 0 && sidecar.Text == "" {
+			sidecar.Text = strings.TrimSpace(d.Description[0])
+		}
+		sidecar.Tags = append(sidecar.Tags, d.Subject...)
+		dates = append(dates, d.DateTimeOriginal, d.DateTimeOriginalAttr, d.DateCreated, d.DateCreatedAttr)
+	}
+	for _, date := range dates {
+		if t, ok := parseXMPDate(date); ok {
+			sidecar.PostTime = t.Format(time.RFC3339)
+			break
+		}
+	}
+	return sidecar, nil
+}
+
+// parseXMPDate parses an XMP date, which has a time zone only if the camera
+// or application knew it.
+func parseXMPDate(value string) (time.Time, bool) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return time.Time{}, false
+	}
+	for _, layout := range xmpDateLayouts {
+		if t, err := time.ParseInLocation(layout, value, time.Local); err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
@@ -0,0 +1,169 @@
+// Package exif reads the few EXIF fields photopost needs from JPEG files,
+// without decoding the image.
+package exif
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"strings"
+	"time"
+)
+
+// ErrNoDate is returned when an image has no EXIF date.
+var ErrNoDate = errors.New("exif: no date in image")
+
+const (
+	tagDateTime           = 0x0132
+	tagExifIFD            = 0x8769
+	tagDateTimeOriginal   = 0x9003
+	tagDateTimeDigitized  = 0x9004
+	tagOffsetTimeOriginal = 0x9011
+
+	typeASCII = 2
+	typeLong  = 4
+
+	dateLayout = "2006:01:02 15:04:05"
+)
+
+// DateTaken returns when a JPEG photo was taken: DateTimeOriginal, then
+// DateTimeDigitized, then DateTime. EXIF dates have no time zone unless
+// the camera also recorded OffsetTimeOriginal, so they are otherwise read in
+// loc.
+func DateTaken(r io.Reader, loc *time.Location) (time.Time, error) {
+	segment, err := exifSegment(bufio.NewReader(r))
+	if err != nil {
+		return time.Time{}, err
+	}
+	t, err := parseTIFF(segment)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return t.date(loc)
+}
+
+// exifSegment returns the TIFF data of the APP1 Exif segment, which comes
+// before the image data.
+func exifSegment(r *bufio.Reader) ([]byte, error) {
+	var soi [2]byte
+	if _, err := io.ReadFull(r, soi[:]); err != nil || soi != [2]byte{0xff, 0xd8} {
+		return nil, errors.New("exif: not a JPEG file")
+	}
+	for {
+		var marker [4]byte
+		if _, err := io.ReadFull(r, marker[:2]); err != nil {
+			return nil, err
+		}
+		if marker[0] != 0xff {
+			return nil, errors.New("exif: malformed JPEG marker")
+		}
+		// Start of scan or end of image: the metadata is over.
+		if marker[1] == 0xda || marker[1] == 0xd9 {
+			return nil, ErrNoDate
+		}
+		if _, err := io.ReadFull(r, marker[2:]); err != nil {
+			return nil, err
+		}
+		length := int(binary.BigEndian.Uint16(marker[2:])) - 2
+		if length < 0 {
+			return nil, errors.New("exif: malformed JPEG segment")
+		}
+		data := make([]byte, length)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return nil, err
+		}
+		if marker[1] == 0xe1 && bytes.HasPrefix(data, []byte("Exif\x00\x00")) {
+			return data[6:], nil
+		}
+	}
+}
+
+type tiff struct {
+	data  []byte
+	order binary.ByteOrder
+	tags  map[uint16]string
+}
+
+func parseTIFF(data []byte) (*tiff, error) {
+	if len(data) < 8 {
+		return nil, errors.New("exif: short TIFF header")
+	}
+	t := &tiff{data: data, tags: map[uint16]string{}}
+	switch string(data[:2]) {
+	case "II":
+		t.order = binary.LittleEndian
+	case "MM":
+		t.order = binary.BigEndian
+	default:
+		return nil, errors.New("exif: bad TIFF byte order")
+	}
+	ifd0 := t.order.Uint32(data[4:])
+	exifIFD, err := t.readIFD(ifd0)
+	if err != nil {
+		return nil, err
+	}
+	if exifIFD != 0 {
+		if _, err := t.readIFD(exifIFD); err != nil {
+			return nil, err
+		}
+	}
+	return t, nil
+}
+
+// readIFD records the date tags of one IFD and returns the offset of the
+// Exif IFD, if this IFD points to one.
+func (t *tiff) readIFD(offset uint32) (uint32, error) {
+	if uint64(offset)+2 > uint64(len(t.data)) {
+		return 0, errors.New("exif: IFD out of range")
+	}
+	count := int(t.order.Uint16(t.data[offset:]))
+	var exifIFD uint32
+	for i := 0; i < count; i++ {
+		start := uint64(offset) + 2 + uint64(i)*12
+		if start+12 > uint64(len(t.data)) {
+			return 0, errors.New("exif: IFD entry out of range")
+		}
+		entry := t.data[start : start+12]
+		tag := t.order.Uint16(entry)
+		typ := t.order.Uint16(entry[2:])
+		n := t.order.Uint32(entry[4:])
+		switch {
+		case tag == tagExifIFD && typ == typeLong:
+			exifIFD = t.order.Uint32(entry[8:])
+		case typ == typeASCII && (tag == tagDateTime || tag == tagDateTimeOriginal || tag == tagDateTimeDigitized || tag == tagOffsetTimeOriginal):
+			value := entry[8:12]
+			if n > 4 {
+				valueOffset := uint64(t.order.Uint32(entry[8:]))
+				if valueOffset+uint64(n) > uint64(len(t.data)) {
+					continue
+				}
+				value = t.data[valueOffset : valueOffset+uint64(n)]
+			} else {
+				value = value[:n]
+			}
+			t.tags[tag] = strings.TrimRight(string(value), "\x00 ")
+		}
+	}
+	return exifIFD, nil
+}
+
+func (t *tiff) date(loc *time.Location) (time.Time, error) {
+	for _, tag := range []uint16{tagDateTimeOriginal, tagDateTimeDigitized, tagDateTime} {
+		value, ok := t.tags[tag]
+		if !ok {
+			continue
+		}
+		if offset, ok := t.tags[tagOffsetTimeOriginal]; ok && tag == tagDateTimeOriginal {
+			if parsed, err := time.Parse(dateLayout+"-07:00", value+offset); err == nil {
+				return parsed, nil
+			}
+		}
+		// Cameras without a clock set write blank or zero dates.
+		if parsed, err := time.ParseInLocation(dateLayout, value, loc); err == nil && parsed.Year() > 1900 {
+			return parsed, nil
+		}
+	}
+	return time.Time{}, ErrNoDate
+}
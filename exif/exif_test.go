@@ -0,0 +1,266 @@
+package exif
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"testing"
+	"time"
+)
+
+// entry is an ASCII or LONG IFD entry for buildTIFF.
+type entry struct {
+	tag   uint16
+	ascii string
+	long  uint32
+}
+
+// buildTIFF lays out a TIFF header, IFD0 and, if exif is not nil, an Exif
+// IFD that IFD0 points to, followed by the ASCII values too long to fit in
+// their entries.
+func buildTIFF(order binary.ByteOrder, ifd0 []entry, exif []entry) []byte {
+	if exif != nil {
+		ifd0 = append(ifd0, entry{tag: tagExifIFD})
+	}
+	ifdSize := func(entries []entry) int { return 2 + 12*len(entries) + 4 }
+	exifOffset := 8 + ifdSize(ifd0)
+	dataOffset := exifOffset
+	if exif != nil {
+		dataOffset += ifdSize(exif)
+	}
+
+	var values []byte
+	writeIFD := func(buf *bytes.Buffer, entries []entry) {
+		binary.Write(buf, order, uint16(len(entries)))
+		for _, e := range entries {
+			binary.Write(buf, order, e.tag)
+			if e.tag == tagExifIFD {
+				binary.Write(buf, order, uint16(typeLong))
+				binary.Write(buf, order, uint32(1))
+				binary.Write(buf, order, uint32(exifOffset))
+				continue
+			}
+			value := append([]byte(e.ascii), 0)
+			binary.Write(buf, order, uint16(typeASCII))
+			binary.Write(buf, order, uint32(len(value)))
+			if len(value) <= 4 {
+				buf.Write(append(value, make([]byte, 4-len(value))...))
+				continue
+			}
+			binary.Write(buf, order, uint32(dataOffset+len(values)))
+			values = append(values, value...)
+		}
+		binary.Write(buf, order, uint32(0))
+	}
+
+	var buf bytes.Buffer
+	if order == binary.LittleEndian {
+		buf.WriteString("II")
+	} else {
+		buf.WriteString("MM")
+	}
+	binary.Write(&buf, order, uint16(42))
+	binary.Write(&buf, order, uint32(8))
+	writeIFD(&buf, ifd0)
+	if exif != nil {
+		writeIFD(&buf, exif)
+	}
+	buf.Write(values)
+	return buf.Bytes()
+}
+
+// segment encodes a JPEG segment with the given marker.
+func segment(marker byte, data []byte) []byte {
+	seg := []byte{0xff, marker, 0, 0}
+	binary.BigEndian.PutUint16(seg[2:], uint16(len(data)+2))
+	return append(seg, data...)
+}
+
+// buildJPEG returns the start of a JPEG file holding tiff in an APP1 Exif
+// segment after a JFIF APP0 segment, up to the start of the scan.
+func buildJPEG(tiff []byte) []byte {
+	jpeg := []byte{0xff, 0xd8}
+	jpeg = append(jpeg, segment(0xe0, []byte("JFIF\x00\x01\x01\x00\x00\x01\x00\x01\x00\x00"))...)
+	jpeg = append(jpeg, segment(0xe1, append([]byte("Exif\x00\x00"), tiff...))...)
+	return append(jpeg, segment(0xda, []byte{0})...)
+}
+
+func TestDateTaken(t *testing.T) {
+	loc := time.FixedZone("UTC-5", -5*60*60)
+	taken := time.Date(2019, 6, 1, 14, 30, 5, 0, loc)
+	for _, tt := range []struct {
+		name  string
+		order binary.ByteOrder
+		ifd0  []entry
+		exif  []entry
+		want  time.Time
+	}{
+		{
+			name:  "original, little endian",
+			order: binary.LittleEndian,
+			exif:  []entry{{tag: tagDateTimeOriginal, ascii: "2019:06:01 14:30:05"}},
+			want:  taken,
+		},
+		{
+			name:  "original, big endian",
+			order: binary.BigEndian,
+			exif:  []entry{{tag: tagDateTimeOriginal, ascii: "2019:06:01 14:30:05"}},
+			want:  taken,
+		},
+		{
+			name:  "original before digitized and modified",
+			order: binary.BigEndian,
+			ifd0:  []entry{{tag: tagDateTime, ascii: "2020:01:01 00:00:00"}},
+			exif: []entry{
+				{tag: tagDateTimeDigitized, ascii: "2019:07:01 00:00:00"},
+				{tag: tagDateTimeOriginal, ascii: "2019:06:01 14:30:05"},
+			},
+			want: taken,
+		},
+		{
+			name:  "digitized before modified",
+			order: binary.LittleEndian,
+			ifd0:  []entry{{tag: tagDateTime, ascii: "2020:01:01 00:00:00"}},
+			exif:  []entry{{tag: tagDateTimeDigitized, ascii: "2019:06:01 14:30:05"}},
+			want:  taken,
+		},
+		{
+			name:  "modified only",
+			order: binary.LittleEndian,
+			ifd0:  []entry{{tag: tagDateTime, ascii: "2019:06:01 14:30:05"}},
+			want:  taken,
+		},
+		{
+			name:  "offset time",
+			order: binary.LittleEndian,
+			exif: []entry{
+				{tag: tagDateTimeOriginal, ascii: "2019:06:01 14:30:05"},
+				{tag: tagOffsetTimeOriginal, ascii: "+02:00"},
+			},
+			want: time.Date(2019, 6, 1, 12, 30, 5, 0, time.UTC),
+		},
+		{
+			name:  "offset time, big endian",
+			order: binary.BigEndian,
+			exif: []entry{
+				{tag: tagOffsetTimeOriginal, ascii: "-08:00"},
+				{tag: tagDateTimeOriginal, ascii: "2019:06:01 14:30:05"},
+			},
+			want: time.Date(2019, 6, 1, 22, 30, 5, 0, time.UTC),
+		},
+		{
+			name:  "offset time is only for the original date",
+			order: binary.LittleEndian,
+			exif: []entry{
+				{tag: tagDateTimeDigitized, ascii: "2019:06:01 14:30:05"},
+				{tag: tagOffsetTimeOriginal, ascii: "+02:00"},
+			},
+			want: taken,
+		},
+		{
+			name:  "malformed offset time",
+			order: binary.LittleEndian,
+			exif: []entry{
+				{tag: tagDateTimeOriginal, ascii: "2019:06:01 14:30:05"},
+				{tag: tagOffsetTimeOriginal, ascii: "local"},
+			},
+			want: taken,
+		},
+		{
+			name:  "zero original date",
+			order: binary.BigEndian,
+			ifd0:  []entry{{tag: tagDateTime, ascii: "2019:06:01 14:30:05"}},
+			exif:  []entry{{tag: tagDateTimeOriginal, ascii: "0000:00:00 00:00:00"}},
+			want:  taken,
+		},
+		{
+			name:  "blank original date",
+			order: binary.LittleEndian,
+			ifd0:  []entry{{tag: tagDateTime, ascii: "2019:06:01 14:30:05"}},
+			exif:  []entry{{tag: tagDateTimeOriginal, ascii: "    :  :     :  :  "}},
+			want:  taken,
+		},
+		{
+			name:  "only zero dates",
+			order: binary.LittleEndian,
+			ifd0:  []entry{{tag: tagDateTime, ascii: "0000:00:00 00:00:00"}},
+			exif:  []entry{{tag: tagDateTimeOriginal, ascii: "0000:00:00 00:00:00"}},
+		},
+		{
+			name:  "no dates",
+			order: binary.BigEndian,
+			exif:  []entry{},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := DateTaken(bytes.NewReader(buildJPEG(buildTIFF(tt.order, tt.ifd0, tt.exif))), loc)
+			if tt.want.IsZero() {
+				if !errors.Is(err, ErrNoDate) {
+					t.Errorf("DateTaken = %v, %v, want ErrNoDate", got, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !got.Equal(tt.want) {
+				t.Errorf("DateTaken = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDateTakenMalformed(t *testing.T) {
+	loc := time.UTC
+	valid := buildTIFF(binary.LittleEndian, nil, []entry{{tag: tagDateTimeOriginal, ascii: "2019:06:01 14:30:05"}})
+	withData := func(f func(tiff []byte) []byte) []byte {
+		return f(append([]byte{}, valid...))
+	}
+	for _, tt := range []struct {
+		name string
+		data []byte
+		// noDate is set if the image is readable but has no date, rather
+		// than being an error.
+		noDate bool
+	}{
+		{name: "empty", data: nil},
+		{name: "not a JPEG", data: []byte("\x89PNG\r\n\x1a\n")},
+		{name: "no Exif segment", data: append([]byte{0xff, 0xd8}, segment(0xda, []byte{0})...), noDate: true},
+		{name: "end of image", data: []byte{0xff, 0xd8, 0xff, 0xd9}, noDate: true},
+		{name: "truncated marker", data: []byte{0xff, 0xd8, 0xff}},
+		{name: "bad marker", data: []byte{0xff, 0xd8, 0x00, 0xe1, 0x00, 0x10}},
+		{name: "bad segment length", data: []byte{0xff, 0xd8, 0xff, 0xe1, 0x00, 0x01}},
+		{name: "truncated segment", data: buildJPEG(valid)[:40]},
+		{name: "short TIFF header", data: buildJPEG([]byte("II*\x00"))},
+		{name: "bad byte order", data: buildJPEG(withData(func(tiff []byte) []byte { return append([]byte("XX"), tiff[2:]...) }))},
+		{name: "IFD0 out of range", data: buildJPEG(withData(func(tiff []byte) []byte {
+			binary.LittleEndian.PutUint32(tiff[4:], 0xfffffff0)
+			return tiff
+		}))},
+		{name: "IFD entries out of range", data: buildJPEG(withData(func(tiff []byte) []byte {
+			binary.LittleEndian.PutUint16(tiff[8:], 1000)
+			return tiff
+		}))},
+		{name: "Exif IFD out of range", data: buildJPEG(withData(func(tiff []byte) []byte {
+			// IFD0's only entry points to the Exif IFD.
+			binary.LittleEndian.PutUint32(tiff[8+2+8:], uint32(len(tiff)))
+			return tiff
+		}))},
+		{name: "date out of range", noDate: true, data: buildJPEG(withData(func(tiff []byte) []byte {
+			// The Exif IFD follows IFD0, and its only entry is the date.
+			exifIFD := binary.LittleEndian.Uint32(tiff[8+2+8:])
+			binary.LittleEndian.PutUint32(tiff[exifIFD+2+8:], uint32(len(tiff)-4))
+			return tiff
+		}))},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := DateTaken(bytes.NewReader(tt.data), loc)
+			if err == nil {
+				t.Fatalf("DateTaken = %v, want an error", got)
+			}
+			if errors.Is(err, ErrNoDate) != tt.noDate {
+				t.Errorf("DateTaken = %v, want ErrNoDate: %t", err, tt.noDate)
+			}
+		})
+	}
+}
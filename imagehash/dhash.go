@@ -0,0 +1,70 @@
+// Package imagehash computes perceptual hashes of images, which stay the same
+// (or nearly so) when an image is resized, re-encoded or lightly edited.
+package imagehash
+
+import (
+	"image"
+	"math/bits"
+)
+
+// samplesPerCell is how many pixels, along each axis, are averaged for each
+// cell of the reduced image. Sampling instead of averaging every pixel keeps
+// hashing a 50 megapixel panorama fast.
+const samplesPerCell = 16
+
+// DHash returns the 64 bit difference hash of img: the image is reduced to
+// 9x8 grayscale cells, and each bit records whether a cell is brighter than
+// its right hand neighbour.
+func DHash(img image.Image) uint64 {
+	const width, height = 9, 8
+	var cells [height][width]float64
+	bounds := img.Bounds()
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			cells[y][x] = cellBrightness(img, bounds, x, y, width, height)
+		}
+	}
+	var hash uint64
+	for y := 0; y < height; y++ {
+		for x := 0; x < width-1; x++ {
+			hash <<= 1
+			if cells[y][x] > cells[y][x+1] {
+				hash |= 1
+			}
+		}
+	}
+	return hash
+}
+
+// cellBrightness averages the luminance of a grid of samples within one
+// cell of the reduced image.
+func cellBrightness(img image.Image, bounds image.Rectangle, cx, cy, width, height int) float64 {
+	x0 := bounds.Min.X + cx*bounds.Dx()/width
+	x1 := bounds.Min.X + (cx+1)*bounds.Dx()/width
+	y0 := bounds.Min.Y + cy*bounds.Dy()/height
+	y1 := bounds.Min.Y + (cy+1)*bounds.Dy()/height
+	if x1 <= x0 {
+		x1 = x0 + 1
+	}
+	if y1 <= y0 {
+		y1 = y0 + 1
+	}
+	var total float64
+	var n int
+	for sy := 0; sy < samplesPerCell; sy++ {
+		y := y0 + sy*(y1-y0)/samplesPerCell
+		for sx := 0; sx < samplesPerCell; sx++ {
+			x := x0 + sx*(x1-x0)/samplesPerCell
+			r, g, b, _ := img.At(x, y).RGBA()
+			total += 0.299*float64(r) + 0.587*float64(g) + 0.114*float64(b)
+			n++
+		}
+	}
+	return total / float64(n)
+}
+
+// Distance is the number of bits that differ between two hashes. Copies of
+// the same photo are usually within 5 or so.
+func Distance(a, b uint64) int {
+	return bits.OnesCount64(a ^ b)
+}
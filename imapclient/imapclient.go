@@ -0,0 +1,387 @@
+// Package imapclient is a minimal IMAP4rev1 client (RFC 3501) with just
+// enough to collect new messages from a mailbox and file them away once they
+// have been dealt with.
+package imapclient
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxLine limits the length of a response line, not counting literals.
+const maxLine = 64 << 10
+
+// defaultMaxLiteral is the largest literal accepted when Client.MaxLiteral
+// is not set.
+const defaultMaxLiteral = 64 << 20
+
+// Client is a connection to an IMAP server. It is not safe for concurrent
+// use.
+type Client struct {
+	conn         net.Conn
+	r            *bufio.Reader
+	w            *bufio.Writer
+	tag          int
+	capabilities map[string]bool
+	// Timeout is how long each command may take, including reading its
+	// response.
+	Timeout time.Duration
+	// MaxLiteral is the largest literal, such as a fetched message, that is
+	// read from the server. The server says how large a literal is before
+	// sending it, so without a limit it could make the client use up any
+	// amount of memory.
+	MaxLiteral int
+}
+
+// response is one untagged response line, with any literals that were in it
+// replaced by "{n}" in line and collected in literals.
+type response struct {
+	line     string
+	literals [][]byte
+}
+
+// StatusError is a NO or BAD reply to a command.
+type StatusError struct {
+	Command string
+	Status  string
+	Text    string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("imap: %s: %s %s", e.Command, e.Status, e.Text)
+}
+
+// Dial connects to addr, with TLS unless useTLS is false, and reads the
+// server's greeting.
+func Dial(addr string, useTLS bool, timeout time.Duration) (*Client, error) {
+	dialer := &net.Dialer{Timeout: timeout}
+	var conn net.Conn
+	var err error
+	if useTLS {
+		host, _, _ := net.SplitHostPort(addr)
+		conn, err = tls.DialWithDialer(dialer, "tcp", addr, &tls.Config{ServerName: host})
+	} else {
+		conn, err = dialer.Dial("tcp", addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	c := &Client{conn: conn, r: bufio.NewReader(conn), w: bufio.NewWriter(conn), Timeout: timeout}
+	c.deadline()
+	greeting, err := c.readLine()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if !strings.HasPrefix(greeting, "* OK") && !strings.HasPrefix(greeting, "* PREAUTH") {
+		conn.Close()
+		return nil, fmt.Errorf("imap: unexpected greeting %q", greeting)
+	}
+	return c, nil
+}
+
+func (c *Client) deadline() {
+	if c.Timeout > 0 {
+		c.conn.SetDeadline(time.Now().Add(c.Timeout))
+	}
+}
+
+// Close closes the connection without logging out.
+func (c *Client) Close() error {
+	return c.conn.Close()
+}
+
+// Logout ends the session and closes the connection.
+func (c *Client) Logout() error {
+	_, err := c.command("LOGOUT")
+	if closeErr := c.conn.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// Login authenticates with a username and password, and then asks for the
+// server's capabilities.
+func (c *Client) Login(username string, password string) error {
+	user, err := quote(username)
+	if err != nil {
+		return err
+	}
+	pass, err := quote(password)
+	if err != nil {
+		return err
+	}
+	if _, err := c.command("LOGIN " + user + " " + pass); err != nil {
+		return err
+	}
+	responses, err := c.command("CAPABILITY")
+	if err != nil {
+		return err
+	}
+	c.capabilities = map[string]bool{}
+	for _, resp := range responses {
+		if fields := strings.Fields(resp.line); len(fields) > 1 && strings.EqualFold(fields[1], "CAPABILITY") {
+			for _, capability := range fields[2:] {
+				c.capabilities[strings.ToUpper(capability)] = true
+			}
+		}
+	}
+	return nil
+}
+
+// Has reports whether the server announced a capability, such as "MOVE".
+func (c *Client) Has(capability string) bool {
+	return c.capabilities[strings.ToUpper(capability)]
+}
+
+// Select opens a mailbox for reading and writing.
+func (c *Client) Select(mailbox string) error {
+	name, err := quote(mailbox)
+	if err != nil {
+		return err
+	}
+	_, err = c.command("SELECT " + name)
+	return err
+}
+
+// Create creates a mailbox, succeeding if it already exists.
+func (c *Client) Create(mailbox string) error {
+	name, err := quote(mailbox)
+	if err != nil {
+		return err
+	}
+	_, err = c.command("CREATE " + name)
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) && statusErr.Status == "NO" {
+		// Servers word "already exists" differently, so check for the
+		// mailbox instead.
+		responses, listErr := c.command("LIST \"\" " + name)
+		if listErr == nil && len(responses) > 0 {
+			return nil
+		}
+	}
+	return err
+}
+
+// SearchUnseen returns the UIDs of the messages in the selected mailbox
+// that have not been read.
+func (c *Client) SearchUnseen() ([]uint32, error) {
+	responses, err := c.command("UID SEARCH UNSEEN")
+	if err != nil {
+		return nil, err
+	}
+	var uids []uint32
+	for _, resp := range responses {
+		fields := strings.Fields(resp.line)
+		if len(fields) < 2 || !strings.EqualFold(fields[1], "SEARCH") {
+			continue
+		}
+		for _, field := range fields[2:] {
+			uid, err := strconv.ParseUint(field, 10, 32)
+			if err != nil {
+				return nil, fmt.Errorf("imap: bad UID %q in search results", field)
+			}
+			uids = append(uids, uint32(uid))
+		}
+	}
+	return uids, nil
+}
+
+// Size returns the size of a message in bytes.
+func (c *Client) Size(uid uint32) (int64, error) {
+	responses, err := c.command(fmt.Sprintf("UID FETCH %d (RFC822.SIZE)", uid))
+	if err != nil {
+		return 0, err
+	}
+	for _, resp := range responses {
+		if value, ok := fetchItem(resp.line, "RFC822.SIZE"); ok {
+			return strconv.ParseInt(value, 10, 64)
+		}
+	}
+	return 0, fmt.Errorf("imap: no message with UID %d", uid)
+}
+
+// Fetch returns the whole of a message, without marking it as read.
+func (c *Client) Fetch(uid uint32) ([]byte, error) {
+	responses, err := c.command(fmt.Sprintf("UID FETCH %d (BODY.PEEK[])", uid))
+	if err != nil {
+		return nil, err
+	}
+	for _, resp := range responses {
+		if _, ok := fetchItem(resp.line, "BODY[]"); ok && len(resp.literals) > 0 {
+			return resp.literals[0], nil
+		}
+	}
+	return nil, fmt.Errorf("imap: no message with UID %d", uid)
+}
+
+// MarkSeen marks a message as read.
+func (c *Client) MarkSeen(uid uint32) error {
+	_, err := c.command(fmt.Sprintf("UID STORE %d +FLAGS.SILENT (\\Seen)", uid))
+	return err
+}
+
+// Move moves a message to another mailbox, with MOVE if the server has it,
+// and otherwise by copying it and deleting the original.
+func (c *Client) Move(uid uint32, mailbox string) error {
+	name, err := quote(mailbox)
+	if err != nil {
+		return err
+	}
+	if c.Has("MOVE") {
+		_, err := c.command(fmt.Sprintf("UID MOVE %d %s", uid, name))
+		return err
+	}
+	if _, err := c.command(fmt.Sprintf("UID COPY %d %s", uid, name)); err != nil {
+		return err
+	}
+	if _, err := c.command(fmt.Sprintf("UID STORE %d +FLAGS.SILENT (\\Deleted)", uid)); err != nil {
+		return err
+	}
+	// A plain EXPUNGE would also remove messages someone else marked as
+	// deleted, so without UIDPLUS the original is left for the mail client
+	// to expunge.
+	if c.Has("UIDPLUS") {
+		_, err = c.command(fmt.Sprintf("UID EXPUNGE %d", uid))
+	}
+	return err
+}
+
+// command sends a tagged command and reads the responses up to its tagged
+// reply, returning the untagged ones.
+func (c *Client) command(cmd string) ([]response, error) {
+	c.tag++
+	tag := fmt.Sprintf("p%d", c.tag)
+	c.deadline()
+	if _, err := fmt.Fprintf(c.w, "%s %s\r\n", tag, cmd); err != nil {
+		return nil, err
+	}
+	if err := c.w.Flush(); err != nil {
+		return nil, err
+	}
+	verb := strings.SplitN(cmd, " ", 3)[0]
+	if verb == "UID" {
+		verb = strings.Join(strings.SplitN(cmd, " ", 3)[:2], " ")
+	}
+	var responses []response
+	for {
+		resp, err := c.readResponse()
+		if err != nil {
+			return nil, err
+		}
+		if strings.HasPrefix(resp.line, "* ") {
+			responses = append(responses, resp)
+			continue
+		}
+		if strings.HasPrefix(resp.line, "+") {
+			return nil, fmt.Errorf("imap: %s: unexpected continuation request", verb)
+		}
+		rest, ok := strings.CutPrefix(resp.line, tag+" ")
+		if !ok {
+			return nil, fmt.Errorf("imap: %s: unexpected response %q", verb, resp.line)
+		}
+		status, text, _ := strings.Cut(rest, " ")
+		status = strings.ToUpper(status)
+		if status != "OK" {
+			return nil, &StatusError{Command: verb, Status: status, Text: text}
+		}
+		return responses, nil
+	}
+}
+
+// readResponse reads a response line, along with the literals in it.
+func (c *Client) readResponse() (response, error) {
+	var resp response
+	var line strings.Builder
+	for {
+		part, err := c.readLine()
+		if err != nil {
+			return resp, err
+		}
+		line.WriteString(part)
+		n, ok := literalSize(part)
+		if !ok {
+			resp.line = line.String()
+			return resp, nil
+		}
+		limit := c.MaxLiteral
+		if limit <= 0 {
+			limit = defaultMaxLiteral
+		}
+		if n > limit {
+			return resp, fmt.Errorf("imap: literal of %d bytes is over the %d byte limit", n, limit)
+		}
+		literal := make([]byte, n)
+		if _, err := io.ReadFull(c.r, literal); err != nil {
+			return resp, err
+		}
+		resp.literals = append(resp.literals, literal)
+	}
+}
+
+func (c *Client) readLine() (string, error) {
+	var line []byte
+	for {
+		chunk, err := c.r.ReadSlice('\n')
+		line = append(line, chunk...)
+		if len(line) > maxLine {
+			return "", errors.New("imap: response line too long")
+		}
+		if err == nil {
+			return strings.TrimRight(string(line), "\r\n"), nil
+		}
+		if !errors.Is(err, bufio.ErrBufferFull) {
+			return "", err
+		}
+	}
+}
+
+// literalSize reads the n from a line ending in "{n}", which is followed by
+// n bytes of data.
+func literalSize(line string) (int, bool) {
+	if !strings.HasSuffix(line, "}") {
+		return 0, false
+	}
+	start := strings.LastIndexByte(line, '{')
+	if start < 0 {
+		return 0, false
+	}
+	n, err := strconv.Atoi(strings.TrimSuffix(line[start+1:len(line)-1], "+"))
+	if err != nil || n < 0 {
+		return 0, false
+	}
+	return n, true
+}
+
+// fetchItem finds a data item in a FETCH response, such as
+// "* 3 FETCH (UID 7 RFC822.SIZE 1234)", returning the word after it.
+func fetchItem(line string, item string) (string, bool) {
+	fields := strings.Fields(line)
+	if len(fields) < 3 || !strings.EqualFold(fields[2], "FETCH") {
+		return "", false
+	}
+	for i, field := range fields[3:] {
+		field = strings.TrimPrefix(field, "(")
+		if strings.EqualFold(field, item) && 3+i+1 < len(fields) {
+			return strings.TrimRight(fields[3+i+1], ")"), true
+		}
+	}
+	return "", false
+}
+
+// quote makes an IMAP quoted string.
+func quote(s string) (string, error) {
+	if strings.ContainsAny(s, "\r\n\x00") {
+		return "", errors.New("imap: strings may not contain line breaks")
+	}
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	s = strings.ReplaceAll(s, `"`, `\"`)
+	return `"` + s + `"`, nil
+}
@@ -0,0 +1,179 @@
+package imapclient
+
+import (
+	"bufio"
+	"github.com/mattgibbs/photopost/imapclient/imaptest"
+	"net"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// dialTest connects to server and logs in.
+func dialTest(t *testing.T, server *imaptest.Server) *Client {
+	t.Helper()
+	c, err := Dial(server.Addr, false, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	if err := c.Login("photos", "secret"); err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestReadResponseLiterals(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	c := &Client{conn: client, r: bufio.NewReader(client), w: bufio.NewWriter(client)}
+	go func() {
+		// The literals hold line breaks and braces that must not be taken
+		// for the end of the response or for more literals.
+		server.Write([]byte("* 1 FETCH (BODY[HEADER] {10}\r\nA: b {3}\r\n BODY[TEXT] {5}\r\nhi)\r\n)\r\n"))
+	}()
+	resp, err := c.readResponse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "* 1 FETCH (BODY[HEADER] {10} BODY[TEXT] {5})"; resp.line != want {
+		t.Errorf("line = %q, want %q", resp.line, want)
+	}
+	if len(resp.literals) != 2 || string(resp.literals[0]) != "A: b {3}\r\n" || string(resp.literals[1]) != "hi)\r\n" {
+		t.Errorf("literals = %q", resp.literals)
+	}
+}
+
+func TestReadResponseLiteralLimit(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	c := &Client{conn: client, r: bufio.NewReader(client), w: bufio.NewWriter(client), MaxLiteral: 1024}
+	go server.Write([]byte("* 1 FETCH (BODY[] {4000000000}\r\n"))
+	if _, err := c.readResponse(); err == nil || !strings.Contains(err.Error(), "limit") {
+		t.Errorf("readResponse of a huge literal = %v, want it refused", err)
+	}
+}
+
+func TestSearchUnseenAndFetch(t *testing.T) {
+	server := imaptest.NewServer()
+	defer server.Close()
+	message := "Subject: hello\r\n\r\n* 2 FETCH (not a response)\r\n"
+	first := server.Add("INBOX", []byte(message))
+	second := server.Add("INBOX", []byte("Subject: second\r\n\r\nhi\r\n"))
+	c := dialTest(t, server)
+	if err := c.Select("INBOX"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.MarkSeen(second); err != nil {
+		t.Fatal(err)
+	}
+
+	uids, err := c.SearchUnseen()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(uids, []uint32{first}) {
+		t.Errorf("unseen = %v, want [%d]", uids, first)
+	}
+	size, err := c.Size(first)
+	if err != nil || size != int64(len(message)) {
+		t.Errorf("Size = %d, %v, want %d", size, err, len(message))
+	}
+	data, err := c.Fetch(first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != message {
+		t.Errorf("Fetch = %q, want %q", data, message)
+	}
+	// Fetching must not mark the message as read.
+	if messages, _ := server.Mailbox("INBOX"); messages[0].Seen {
+		t.Error("Fetch marked the message as read")
+	}
+	if _, err := c.Fetch(99); err == nil {
+		t.Error("Fetch of a missing message succeeded")
+	}
+}
+
+func TestMove(t *testing.T) {
+	for _, tt := range []struct {
+		capabilities []string
+		command      string
+		// kept is whether the original is left, marked as deleted, for
+		// the mail client to expunge.
+		kept bool
+	}{
+		{[]string{"MOVE"}, "UID MOVE", false},
+		{[]string{"UIDPLUS"}, "UID EXPUNGE", false},
+		{nil, "UID COPY", true},
+	} {
+		t.Run(strings.Join(append([]string{"IMAP4rev1"}, tt.capabilities...), " "), func(t *testing.T) {
+			server := imaptest.NewServer(tt.capabilities...)
+			defer server.Close()
+			uid := server.Add("INBOX", []byte("Subject: hello\r\n\r\nhi\r\n"))
+			c := dialTest(t, server)
+			if err := c.Create("Done"); err != nil {
+				t.Fatal(err)
+			}
+			if err := c.Select("INBOX"); err != nil {
+				t.Fatal(err)
+			}
+			if err := c.Move(uid, "Done"); err != nil {
+				t.Fatal(err)
+			}
+
+			moved, _ := server.Mailbox("Done")
+			if len(moved) != 1 || string(moved[0].Data) != "Subject: hello\r\n\r\nhi\r\n" {
+				t.Errorf("Done = %v, want the message", moved)
+			}
+			inbox, _ := server.Mailbox("INBOX")
+			if tt.kept {
+				if len(inbox) != 1 || !inbox[0].Deleted {
+					t.Errorf("INBOX = %v, want the original marked as deleted", inbox)
+				}
+			} else if len(inbox) != 0 {
+				t.Errorf("INBOX = %v, want it empty", inbox)
+			}
+			commands := server.Commands()
+			found := false
+			for _, cmd := range commands {
+				found = found || strings.HasPrefix(cmd, tt.command+" ")
+				if strings.HasPrefix(cmd, "EXPUNGE") {
+					t.Errorf("sent %q, which expunges other messages too", cmd)
+				}
+			}
+			if !found {
+				t.Errorf("commands = %q, want %s", commands, tt.command)
+			}
+		})
+	}
+}
+
+func TestCreateExisting(t *testing.T) {
+	server := imaptest.NewServer()
+	defer server.Close()
+	c := dialTest(t, server)
+	if err := c.Create("Photopost"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Create("Photopost"); err != nil {
+		t.Errorf("Create of an existing mailbox: %s", err)
+	}
+	if _, ok := server.Mailbox("Photopost"); !ok {
+		t.Error("the mailbox was not created")
+	}
+}
+
+func TestStatusError(t *testing.T) {
+	server := imaptest.NewServer()
+	defer server.Close()
+	c := dialTest(t, server)
+	err := c.Select("Missing")
+	statusErr, ok := err.(*StatusError)
+	if !ok || statusErr.Status != "NO" || statusErr.Command != "SELECT" {
+		t.Errorf("Select of a missing mailbox = %v, want a NO StatusError", err)
+	}
+}
@@ -0,0 +1,321 @@
+// Package imaptest is an in-memory IMAP server for testing, with just the
+// commands that imapclient sends.
+package imaptest
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Message is a message in one of the server's mailboxes.
+type Message struct {
+	UID     uint32
+	Data    []byte
+	Seen    bool
+	Deleted bool
+}
+
+// Server serves the mailboxes in memory on a loopback port. Any username
+// and password are accepted.
+type Server struct {
+	// Addr is the address the server is listening on.
+	Addr string
+
+	capabilities []string
+	listener     net.Listener
+	conns        sync.WaitGroup
+
+	mu        sync.Mutex
+	mailboxes map[string][]*Message
+	nextUID   uint32
+	commands  []string
+	open      map[net.Conn]bool
+}
+
+// NewServer starts a server with an empty INBOX, which announces the given
+// capabilities, such as "MOVE" or "UIDPLUS".
+func NewServer(capabilities ...string) *Server {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic(fmt.Sprintf("imaptest: failed to listen: %v", err))
+	}
+	s := &Server{
+		Addr:         l.Addr().String(),
+		capabilities: append([]string{"IMAP4rev1"}, capabilities...),
+		listener:     l,
+		mailboxes:    map[string][]*Message{"INBOX": nil},
+		nextUID:      1,
+		open:         map[net.Conn]bool{},
+	}
+	go s.serve()
+	return s
+}
+
+// Close stops the server and waits for its connections to end.
+func (s *Server) Close() {
+	s.listener.Close()
+	s.mu.Lock()
+	for conn := range s.open {
+		conn.Close()
+	}
+	s.mu.Unlock()
+	s.conns.Wait()
+}
+
+// Add puts a message in a mailbox, creating it if needed, and returns the
+// message's UID.
+func (s *Server) Add(mailbox string, data []byte) uint32 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	uid := s.nextUID
+	s.nextUID++
+	s.mailboxes[mailbox] = append(s.mailboxes[mailbox], &Message{UID: uid, Data: data})
+	return uid
+}
+
+// Mailbox returns copies of the messages in a mailbox, and whether it
+// exists.
+func (s *Server) Mailbox(name string) ([]Message, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	messages, ok := s.mailboxes[name]
+	var copies []Message
+	for _, msg := range messages {
+		copies = append(copies, *msg)
+	}
+	return copies, ok
+}
+
+// Commands returns the commands the server has been sent, without their
+// tags.
+func (s *Server) Commands() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return slices.Clone(s.commands)
+}
+
+func (s *Server) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		s.open[conn] = true
+		s.mu.Unlock()
+		s.conns.Add(1)
+		go func() {
+			defer s.conns.Done()
+			s.serveConn(conn)
+			s.mu.Lock()
+			delete(s.open, conn)
+			s.mu.Unlock()
+		}()
+	}
+}
+
+// session is one connection's state: the selected mailbox and where to send
+// responses.
+type session struct {
+	s        *Server
+	w        *bufio.Writer
+	selected string
+}
+
+func (s *Server) serveConn(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	ss := &session{s: s, w: bufio.NewWriter(conn)}
+	ss.write("* OK imaptest ready\r\n")
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		tag, cmd, _ := strings.Cut(strings.TrimRight(line, "\r\n"), " ")
+		s.mu.Lock()
+		s.commands = append(s.commands, cmd)
+		status := ss.command(cmd)
+		s.mu.Unlock()
+		ss.write("%s %s\r\n", tag, status)
+		if strings.EqualFold(cmd, "LOGOUT") {
+			return
+		}
+	}
+}
+
+func (ss *session) write(format string, args ...any) {
+	fmt.Fprintf(ss.w, format, args...)
+	ss.w.Flush()
+}
+
+// command carries out a command, writing its untagged responses, and returns
+// the status for its tagged reply. It is called with s.mu held.
+func (ss *session) command(cmd string) string {
+	args := words(cmd)
+	if len(args) == 0 {
+		return "BAD empty command"
+	}
+	verb := strings.ToUpper(args[0])
+	args = args[1:]
+	if verb == "UID" && len(args) > 0 {
+		verb += " " + strings.ToUpper(args[0])
+		args = args[1:]
+	}
+	switch verb {
+	case "LOGIN":
+		return "OK logged in"
+	case "LOGOUT":
+		ss.write("* BYE\r\n")
+		return "OK bye"
+	case "CAPABILITY":
+		ss.write("* CAPABILITY %s\r\n", strings.Join(ss.s.capabilities, " "))
+		return "OK"
+	case "SELECT":
+		if len(args) != 1 {
+			return "BAD SELECT needs a mailbox"
+		}
+		messages, ok := ss.s.mailboxes[args[0]]
+		if !ok {
+			return "NO [NONEXISTENT] no such mailbox"
+		}
+		ss.selected = args[0]
+		ss.write("* %d EXISTS\r\n", len(messages))
+		return "OK [READ-WRITE] selected"
+	case "CREATE":
+		if len(args) != 1 {
+			return "BAD CREATE needs a mailbox"
+		}
+		if _, ok := ss.s.mailboxes[args[0]]; ok {
+			return "NO [ALREADYEXISTS] Mailbox exists"
+		}
+		ss.s.mailboxes[args[0]] = nil
+		return "OK created"
+	case "LIST":
+		if len(args) != 2 {
+			return "BAD LIST needs a reference and a mailbox"
+		}
+		if _, ok := ss.s.mailboxes[args[1]]; ok {
+			ss.write("* LIST () \"/\" %q\r\n", args[1])
+		}
+		return "OK"
+	}
+
+	if ss.selected == "" {
+		return "BAD no mailbox selected"
+	}
+	if verb == "UID SEARCH" {
+		var uids []string
+		for _, msg := range ss.s.mailboxes[ss.selected] {
+			if !msg.Seen && !msg.Deleted {
+				uids = append(uids, strconv.FormatUint(uint64(msg.UID), 10))
+			}
+		}
+		ss.write("* SEARCH %s\r\n", strings.Join(uids, " "))
+		return "OK"
+	}
+	if len(args) < 1 {
+		return "BAD " + verb + " needs a UID"
+	}
+	uid, err := strconv.ParseUint(args[0], 10, 32)
+	if err != nil {
+		return "BAD bad UID"
+	}
+	seq, msg := ss.find(uint32(uid))
+	if msg == nil {
+		// A UID command for a message that is not there is not an error.
+		return "OK"
+	}
+	switch verb {
+	case "UID FETCH":
+		switch strings.Join(args[1:], " ") {
+		case "(RFC822.SIZE)":
+			ss.write("* %d FETCH (UID %d RFC822.SIZE %d)\r\n", seq, msg.UID, len(msg.Data))
+		case "(BODY.PEEK[])":
+			ss.write("* %d FETCH (UID %d BODY[] {%d}\r\n%s)\r\n", seq, msg.UID, len(msg.Data), msg.Data)
+		default:
+			return "BAD unknown fetch items"
+		}
+	case "UID STORE":
+		switch strings.Join(args[1:], " ") {
+		case `+FLAGS.SILENT (\Seen)`:
+			msg.Seen = true
+		case `+FLAGS.SILENT (\Deleted)`:
+			msg.Deleted = true
+		default:
+			return "BAD unknown flags"
+		}
+	case "UID COPY", "UID MOVE":
+		if verb == "UID MOVE" && !slices.Contains(ss.s.capabilities, "MOVE") {
+			return "BAD unknown command"
+		}
+		if len(args) != 2 {
+			return "BAD " + verb + " needs a mailbox"
+		}
+		if _, ok := ss.s.mailboxes[args[1]]; !ok {
+			return "NO [TRYCREATE] no such mailbox"
+		}
+		ss.s.mailboxes[args[1]] = append(ss.s.mailboxes[args[1]], &Message{UID: ss.s.nextUID, Data: msg.Data, Seen: msg.Seen})
+		ss.s.nextUID++
+		if verb == "UID MOVE" {
+			ss.remove(msg)
+		}
+	case "UID EXPUNGE":
+		if !slices.Contains(ss.s.capabilities, "UIDPLUS") {
+			return "BAD unknown command"
+		}
+		if msg.Deleted {
+			ss.remove(msg)
+		}
+	default:
+		return "BAD unknown command"
+	}
+	return "OK"
+}
+
+// find returns the sequence number of the message with a UID in the
+// selected mailbox, and the message, if it is there.
+func (ss *session) find(uid uint32) (int, *Message) {
+	for i, msg := range ss.s.mailboxes[ss.selected] {
+		if msg.UID == uid {
+			return i + 1, msg
+		}
+	}
+	return 0, nil
+}
+
+func (ss *session) remove(msg *Message) {
+	seq, _ := ss.find(msg.UID)
+	ss.s.mailboxes[ss.selected] = slices.Delete(ss.s.mailboxes[ss.selected], seq-1, seq)
+	ss.write("* %d EXPUNGE\r\n", seq)
+}
+
+// words splits a command into its arguments, unquoting quoted strings but
+// leaving parenthesised lists as they are.
+func words(cmd string) []string {
+	var args []string
+	for cmd = strings.TrimSpace(cmd); cmd != ""; cmd = strings.TrimSpace(cmd) {
+		if cmd[0] != '"' {
+			word, rest, _ := strings.Cut(cmd, " ")
+			args = append(args, word)
+			cmd = rest
+			continue
+		}
+		var word strings.Builder
+		i := 1
+		for ; i < len(cmd) && cmd[i] != '"'; i++ {
+			if cmd[i] == '\\' && i+1 < len(cmd) {
+				i++
+			}
+			word.WriteByte(cmd[i])
+		}
+		args = append(args, word.String())
+		cmd = cmd[min(i+1, len(cmd)):]
+	}
+	return args
+}
@@ -1,21 +1,115 @@
 package main
 
 import (
-	"log"
+	"github.com/mattgibbs/photopost/config"
+	"log/slog"
+	"net"
 	"net/http"
+	"net/netip"
+	"strings"
 	"time"
 )
 
+// responseRecorder remembers the status code and number of bytes written so
+// they can be included in the access log.
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (rr *responseRecorder) WriteHeader(status int) {
+	if rr.status == 0 {
+		rr.status = status
+	}
+	rr.ResponseWriter.WriteHeader(status)
+}
+
+func (rr *responseRecorder) Write(b []byte) (int, error) {
+	if rr.status == 0 {
+		rr.status = http.StatusOK
+	}
+	n, err := rr.ResponseWriter.Write(b)
+	rr.bytes += int64(n)
+	return n, err
+}
+
+func (rr *responseRecorder) Unwrap() http.ResponseWriter {
+	return rr.ResponseWriter
+}
+
+func (rr *responseRecorder) Flush() {
+	if f, ok := rr.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
 func Logger(inner http.Handler, name string) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		start := time.Now()
-		inner.ServeHTTP(w, r)
-		log.Printf(
-			"%s\t%s\t%s\t%s",
-			r.Method,
-			r.RequestURI,
-			name,
-			time.Since(start),
+		rec := &responseRecorder{ResponseWriter: w}
+		inner.ServeHTTP(rec, r)
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		level := slog.LevelInfo
+		switch {
+		case rec.status >= 500:
+			level = slog.LevelError
+		case rec.status >= 400:
+			level = slog.LevelWarn
+		}
+		user, _, _ := r.BasicAuth()
+		slog.Log(r.Context(), level, "request",
+			"method", r.Method,
+			"uri", r.RequestURI,
+			"route", name,
+			"status", rec.status,
+			"bytes", rec.bytes,
+			"duration", time.Since(start),
+			"client_ip", clientIP(r, configuration.Get().TrustedProxies),
+			"user", user,
+			"user_agent", r.UserAgent(),
 		)
 	})
 }
+
+// clientIP is the address of the client that made the request. Behind
+// reverse proxies that are listed in trustedProxies, that is the last
+// address in X-Forwarded-For that is not one of theirs. Anyone else could
+// put anything in the header, so it is ignored for requests that do not come
+// from a trusted proxy.
+func clientIP(r *http.Request, trustedProxies []string) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	if !trustedProxy(host, trustedProxies) {
+		return host
+	}
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		if hop == "" {
+			continue
+		}
+		host = hop
+		if !trustedProxy(hop, trustedProxies) {
+			break
+		}
+	}
+	return host
+}
+
+func trustedProxy(address string, trustedProxies []string) bool {
+	addr, err := netip.ParseAddr(address)
+	if err != nil {
+		return false
+	}
+	for _, proxy := range trustedProxies {
+		if prefix, err := config.ParseTrustedProxy(proxy); err == nil && prefix.Contains(addr.Unmap()) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestClientIP(t *testing.T) {
+	proxies := []string{"10.0.0.0/8", "192.0.2.7"}
+	for _, tt := range []struct {
+		remote    string
+		forwarded string
+		want      string
+	}{
+		{"203.0.113.5:4000", "", "203.0.113.5"},
+		// Only trusted proxies may say who the client is.
+		{"203.0.113.5:4000", "198.51.100.1", "203.0.113.5"},
+		{"10.1.2.3:4000", "198.51.100.1", "198.51.100.1"},
+		{"192.0.2.7:4000", "198.51.100.1", "198.51.100.1"},
+		// A client can put anything at the front of the header, so the
+		// last address a trusted proxy did not add is the client.
+		{"10.1.2.3:4000", "1.2.3.4, 198.51.100.1, 10.9.9.9", "198.51.100.1"},
+		{"10.1.2.3:4000", "10.9.9.9", "10.9.9.9"},
+		{"[::ffff:10.1.2.3]:4000", "198.51.100.1", "198.51.100.1"},
+	} {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = tt.remote
+		if tt.forwarded != "" {
+			r.Header.Set("X-Forwarded-For", tt.forwarded)
+		}
+		if got := clientIP(r, proxies); got != tt.want {
+			t.Errorf("clientIP(%s, X-Forwarded-For %q) = %s, want %s", tt.remote, tt.forwarded, got, tt.want)
+		}
+	}
+}
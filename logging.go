@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/mattgibbs/photopost/requestid"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+// logLevel is shared by every handler so the level can be changed without
+// rebuilding the logger.
+var logLevel = new(slog.LevelVar)
+
+// setupLogging installs the default slog logger. Output from the standard
+// library log package is routed through it as well.
+func setupLogging(w io.Writer, level string, format string) error {
+	lvl, err := parseLogLevel(level)
+	if err != nil {
+		return err
+	}
+	logLevel.Set(lvl)
+	opts := &slog.HandlerOptions{Level: logLevel}
+	var handler slog.Handler
+	switch strings.ToLower(format) {
+	case "", "json":
+		handler = slog.NewJSONHandler(w, opts)
+	case "text":
+		handler = slog.NewTextHandler(w, opts)
+	default:
+		return fmt.Errorf("unknown log format %q, expected json or text", format)
+	}
+	slog.SetDefault(slog.New(contextHandler{handler}))
+	// The remaining log.Fatalf calls are all startup errors.
+	slog.SetLogLoggerLevel(slog.LevelError)
+	return nil
+}
+
+func parseLogLevel(level string) (slog.Level, error) {
+	var lvl slog.Level
+	if level == "" {
+		return slog.LevelInfo, nil
+	}
+	if err := lvl.UnmarshalText([]byte(level)); err != nil {
+		return lvl, fmt.Errorf("unknown log level %q, expected debug, info, warn or error", level)
+	}
+	return lvl, nil
+}
+
+// contextHandler adds the request ID to every record logged with a request
+// context, so handlers only need to use the *Context logging functions.
+type contextHandler struct {
+	slog.Handler
+}
+
+func (h contextHandler) Handle(ctx context.Context, r slog.Record) error {
+	if id := requestid.FromContext(ctx); id != "" {
+		r.AddAttrs(slog.String("request_id", id))
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return contextHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h contextHandler) WithGroup(name string) slog.Handler {
+	return contextHandler{h.Handler.WithGroup(name)}
+}
+
+func init() {
+	// Until the config file is loaded, log at info level as JSON.
+	setupLogging(os.Stderr, "info", "json")
+}
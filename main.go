@@ -1,33 +1,121 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"flag"
 	"fmt"
 	"github.com/mattgibbs/photopost/config"
 	"github.com/mattgibbs/photopost/controllers"
+	"github.com/mattgibbs/photopost/metrics"
 	"github.com/mattgibbs/photopost/model"
 	"log"
+	"log/slog"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 )
 
 var datastore model.Datastore
 var postController *controllers.PostController
-var configuration config.Config
+var healthController *controllers.HealthController
+var tusController *controllers.TusController
+var backupController *controllers.BackupController
+var deviceController *controllers.DeviceController
+var configuration *config.Store
+
+// staleUploadAge is how old a temporary upload must be to be removed at
+// startup. It is well past the write timeout of any request.
+const staleUploadAge = 24 * time.Hour
 
 func main() {
-	if len(os.Args) < 2 {
-		fmt.Println("Usage: photopost <config file>")
+	if len(os.Args) > 1 {
+		if command, ok := commands[os.Args[1]]; ok {
+			os.Exit(command(os.Args[2:]))
+		}
+	}
+	cfg, configFile, err := config.LoadWithFile(os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
 		os.Exit(0)
 	}
-	configuration, err := config.LoadConfig(os.Args[1])
 	if err != nil {
-		log.Fatalf("Error: Could not load config file. %s", err)
+		log.Fatalf("Error: Invalid configuration.\n%s", err)
+	}
+	if err := setupLogging(os.Stderr, cfg.LogLevel, cfg.LogFormat); err != nil {
+		log.Fatalf("Error: Invalid logging configuration. %s", err)
+	}
+	configuration = config.NewStore(cfg)
+	slog.Info("Starting photopost server.")
+	slog.Info("Loaded configuration", "config", cfg)
+	datastore = openDatastore(cfg)
+	if err := controllers.RemoveStaleUploads(cfg.UploadsPath, staleUploadAge); err != nil {
+		slog.Error("Error while removing stale temporary uploads", "err", err)
 	}
-	log.Println("Starting photopost server.")
-	log.Printf("Configuration: %+v\n", configuration)
-	datastore := model.NewSQLiteDatastore(fmt.Sprintf("%s?mode=rwc", configuration.DatabaseURL))
 	postController = controllers.NewPostController(datastore, configuration)
-	defer datastore.Close()
-	router := NewRouter()
-	log.Fatal(http.ListenAndServe(fmt.Sprintf(":%s", configuration.Port), router))
+	tusController = controllers.NewTusController(postController, configuration)
+	backupController = controllers.NewBackupController(datastore, configuration)
+	deviceController = controllers.NewDeviceController(postController, configuration)
+	healthController = controllers.NewHealthController(datastore, configuration, version, buildCommit())
+	metrics.RegisterPostCount(datastore.CountPosts)
+	metrics.RegisterUploadsDirSize(cfg.UploadsPath)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	startWorker("config-reload", func(ctx context.Context) {
+		watchConfig(ctx, os.Args[1:], configFile)
+	})
+	startWorker("resumable-upload-expiry", func(ctx context.Context) {
+		tusController.ExpireUploads(ctx, 10*time.Minute)
+	})
+	startWorker("image-hash-backfill", postController.BackfillHashes)
+	startWorker("shuffle-expiry", func(ctx context.Context) {
+		postController.ForgetIdleShuffles(ctx, time.Hour)
+	})
+	startWorker("backup", backupController.ScheduleBackups)
+	startWorker("watch-folders", postController.WatchFolders)
+	startWorker("smtp", postController.ServeSMTP)
+	startWorker("imap-poller", postController.PollIMAP)
+
+	server := &http.Server{
+		Addr:         fmt.Sprintf(":%s", cfg.Port),
+		Handler:      NewRouter(),
+		ReadTimeout:  cfg.ReadTimeout.Duration(),
+		WriteTimeout: cfg.WriteTimeout.Duration(),
+		IdleTimeout:  cfg.IdleTimeout.Duration(),
+	}
+	serverErr := make(chan error, 1)
+	go func() {
+		slog.Info("Listening", "addr", server.Addr)
+		serverErr <- server.ListenAndServe()
+	}()
+
+	// The shutdown timeout can be changed by a reload, so read it late.
+	failed := false
+	select {
+	case err = <-serverErr:
+		if !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("HTTP server stopped", "err", err)
+			failed = true
+		}
+	case <-ctx.Done():
+		slog.Info("Received shutdown signal, draining requests", "timeout", configuration.Get().ShutdownTimeout.String())
+	}
+	// A second signal while draining kills the process immediately.
+	stop()
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), configuration.Get().ShutdownTimeout.Duration())
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		slog.Warn("Requests did not drain in time, closing remaining connections", "err", err)
+		server.Close()
+	}
+	stopWorkers()
+	datastore.Close()
+	slog.Info("Photopost server stopped.")
+	if failed {
+		// So that a supervisor sees the server did not stop cleanly.
+		os.Exit(1)
+	}
 }
@@ -0,0 +1,150 @@
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"path/filepath"
+	"time"
+)
+
+// Registry holds every photopost metric plus the standard Go runtime and
+// process collectors.
+var Registry = prometheus.NewRegistry()
+
+var (
+	httpRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "photopost",
+		Name:      "http_requests_total",
+		Help:      "HTTP requests handled, by route, method and status code.",
+	}, []string{"route", "method", "code"})
+	httpDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "photopost",
+		Name:      "http_request_duration_seconds",
+		Help:      "HTTP request latency, by route and method.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"route", "method"})
+	uploads = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "photopost",
+		Name:      "uploads_total",
+		Help:      "Images uploaded, by MIME type.",
+	}, []string{"mime_type"})
+	uploadBytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "photopost",
+		Name:      "upload_bytes_total",
+		Help:      "Bytes of image data uploaded, by MIME type.",
+	}, []string{"mime_type"})
+	queryDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "photopost",
+		Name:      "datastore_query_duration_seconds",
+		Help:      "Datastore query latency, by datastore method.",
+		Buckets:   []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1},
+	}, []string{"method"})
+	rotateFailures = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "photopost",
+		Name:      "rotate_failures_total",
+		Help:      "Image rotations that failed.",
+	})
+	deleteFailures = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "photopost",
+		Name:      "delete_failures_total",
+		Help:      "Post deletions that failed.",
+	})
+)
+
+func init() {
+	Registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		httpRequests,
+		httpDuration,
+		uploads,
+		uploadBytes,
+		queryDuration,
+		rotateFailures,
+		deleteFailures,
+	)
+}
+
+// Handler serves the metrics in the Prometheus exposition format.
+func Handler() http.Handler {
+	return promhttp.HandlerFor(Registry, promhttp.HandlerOpts{})
+}
+
+// InstrumentRoute records the request count and latency of inner under the
+// given route name.
+func InstrumentRoute(inner http.Handler, name string) http.Handler {
+	labels := prometheus.Labels{"route": name}
+	return promhttp.InstrumentHandlerDuration(httpDuration.MustCurryWith(labels),
+		promhttp.InstrumentHandlerCounter(httpRequests.MustCurryWith(labels), inner))
+}
+
+// ObserveUpload records an uploaded image of the given type and size.
+func ObserveUpload(mimeType string, size int64) {
+	uploads.WithLabelValues(mimeType).Inc()
+	uploadBytes.WithLabelValues(mimeType).Add(float64(size))
+}
+
+// TimeQuery records the time since start for a datastore method. It is meant
+// to be deferred at the top of the method:
+//
+//	defer metrics.TimeQuery("FindPost", time.Now())
+func TimeQuery(method string, start time.Time) {
+	queryDuration.WithLabelValues(method).Observe(time.Since(start).Seconds())
+}
+
+func RotateFailed() {
+	rotateFailures.Inc()
+}
+
+func DeleteFailed() {
+	deleteFailures.Inc()
+}
+
+// RegisterPostCount exports the number of posts, calling count at scrape time.
+func RegisterPostCount(count func() (int, error)) {
+	Registry.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: "photopost",
+		Name:      "posts",
+		Help:      "Number of posts in the datastore.",
+	}, func() float64 {
+		n, err := count()
+		if err != nil {
+			slog.Error("Error while counting posts for metrics", "err", err)
+			return 0
+		}
+		return float64(n)
+	}))
+}
+
+// RegisterUploadsDirSize exports the total size of the files under dir,
+// walking it at scrape time.
+func RegisterUploadsDirSize(dir string) {
+	Registry.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: "photopost",
+		Name:      "uploads_dir_bytes",
+		Help:      "Total size of the uploads directory.",
+	}, func() float64 {
+		var total int64
+		err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if d.Type().IsRegular() {
+				info, err := d.Info()
+				if err != nil {
+					return err
+				}
+				total += info.Size()
+			}
+			return nil
+		})
+		if err != nil {
+			slog.Error("Error while measuring uploads directory", "dir", dir, "err", err)
+		}
+		return float64(total)
+	}))
+}
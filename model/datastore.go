@@ -1,6 +1,9 @@
 package model
 
-import "time"
+import (
+	"context"
+	"time"
+)
 
 type Datastore interface {
 	//Post Methods
@@ -8,9 +11,49 @@ type Datastore interface {
 	FindAllPosts() ([]*Post, error)
 	FindPostsWithFilters(filters []interface{}) ([]*Post, error)
 	SavePost(post *Post) (int64, error)
+	SavePosts(posts []*Post) ([]int64, error)
 	UpdatePost(post *Post) error
 	DeletePost(post *Post) error
 	PostIDs() ([]int64, error)
+	CountPosts() (int, error)
+	// OldestPostTime is the earliest post time, or the zero time if there
+	// are no posts.
+	OldestPostTime() (time.Time, error)
+	PostIDsForImageFile(imageFile string) ([]int64, error)
+
+	// RestorePosts saves posts exactly as given, IDs and creation times
+	// included, in a single transaction.
+	RestorePosts(posts []*Post) error
+
+	//Duplicate detection
+	PostIDsForContentHash(contentHash string) ([]int64, error)
+	FindSimilarPosts(hash PerceptualHash, maxDistance int) ([]SimilarPost, error)
+	PostsMissingHashes(afterId int64, limit int) ([]*Post, error)
+	UpdatePostHashes(id int64, contentHash string, hash PerceptualHash) error
+
+	//Random selection
+	NextRandomPost(client string, weights RandomWeights, filters []interface{}) (int64, error)
+	ForgetRandomClients(idleSince time.Time) (int64, error)
+	// NextPostInOrder is the first post passing every filter that comes
+	// after the post with afterId and afterTime, ordered by post time, and
+	// goes back to the start once there are no more.
+	NextPostInOrder(afterTime time.Time, afterId int64, filters []interface{}) (int64, error)
+
+	//Display devices
+	FindDevice(id int64) (*Device, error)
+	FindAllDevices() ([]*Device, error)
+	SaveDevice(device *Device) (int64, error)
+	UpdateDevice(device *Device) error
+	DeleteDevice(id int64) error
+	// DeviceShown records that a device was given a post to show.
+	DeviceShown(id int64, postId int64, postTime time.Time, seen time.Time) error
+
+	// Backup writes a consistent copy of the database to path while it is
+	// in use.
+	Backup(ctx context.Context, path string) error
+
+	Ping(ctx context.Context) error
+	SchemaVersion() (int, error)
 	Close()
 }
 
@@ -40,4 +83,43 @@ type PostIdFilter struct {
 type AuthorFilter struct {
 	Matching string
 	Contains string
+	// Any matches posts by any one of the authors listed.
+	Any []string
+}
+
+type AlbumFilter struct {
+	Matching string
+}
+
+// TagFilter matches posts that have every one of Tags.
+type TagFilter struct {
+	Tags []string
+}
+
+// PostTimeRangesFilter matches posts whose post time is in any of Ranges.
+// With no ranges, it matches nothing.
+type PostTimeRangesFilter struct {
+	Ranges []TimeRange
+}
+
+// TimeRange runs from Start up to, but not including, End.
+type TimeRange struct {
+	Start time.Time
+	End   time.Time
+}
+
+// RandomWeights favours some posts when NextRandomPost picks one. Every post
+// gets one turn per shuffle, plus the extra turns given here; a weight of 0
+// turns that kind of favouring off.
+type RandomWeights struct {
+	// Favorites is the extra turns for posts tagged FavoriteTag.
+	Favorites   int
+	FavoriteTag string
+	// Recent is the extra turns for posts from the last RecentWithin, and
+	// half as many for those from the period before that.
+	Recent       int
+	RecentWithin time.Duration
+	// Unseen is the extra turns for posts that have never been shown, and
+	// half as many for those shown less often than average.
+	Unseen int
 }
@@ -0,0 +1,124 @@
+package model
+
+import (
+	"errors"
+	"time"
+)
+
+// Device is a registered display, such as a photo frame, that asks for the
+// next photo to show with its pairing token. Only a hash of the token is
+// kept, so a lost token is replaced rather than looked up.
+type Device struct {
+	Id        int64         `json:"id"`
+	Name      string        `json:"name"`
+	TokenHash string        `json:"-"`
+	Profile   DeviceProfile `json:"profile"`
+	Created   time.Time     `json:"created"`
+	// LastSeen is when the device last asked for a photo, and LastPostId
+	// and LastPostTime are the photo it was given, which is where a
+	// chronological slideshow carries on from.
+	LastSeen     time.Time `json:"lastSeen"`
+	LastPostId   int64     `json:"lastPostId"`
+	LastPostTime time.Time `json:"-"`
+}
+
+// Slideshow orders for DeviceProfile.Order.
+const (
+	OrderShuffle       = "shuffle"
+	OrderChronological = "chronological"
+)
+
+// Transitions between photos for DeviceProfile.Transition.
+var Transitions = []string{"none", "fade", "slide"}
+
+// DeviceProfile is what a device shows and how. Posts must be in Album, if
+// set, and have every one of Tags and be by any of Authors, if given.
+type DeviceProfile struct {
+	Album   string   `json:"album"`
+	Tags    []string `json:"tags"`
+	Authors []string `json:"authors"`
+	// Interval is how many seconds each photo is shown for, or 0 for the
+	// configured slideshowInterval.
+	Interval   int    `json:"interval"`
+	Transition string `json:"transition"`
+	// QuietStart and QuietEnd are times of day, as "22:30", between which
+	// the device shows nothing. The quiet hours may run past midnight.
+	QuietStart string `json:"quietStart"`
+	QuietEnd   string `json:"quietEnd"`
+	Order      string `json:"order"`
+}
+
+// maxDeviceInterval is the longest a device may show one photo for: a day.
+const maxDeviceInterval = 24 * 60 * 60
+
+func (p *DeviceProfile) Validate() error {
+	if p.Interval < 0 || p.Interval > maxDeviceInterval {
+		return errors.New("A device's interval must be between 0 and 86400 seconds.")
+	}
+	if p.Order != OrderShuffle && p.Order != OrderChronological {
+		return errors.New("A device's order must be shuffle or chronological.")
+	}
+	known := false
+	for _, transition := range Transitions {
+		known = known || p.Transition == transition
+	}
+	if !known {
+		return errors.New("A device's transition must be none, fade or slide.")
+	}
+	if (p.QuietStart == "") != (p.QuietEnd == "") {
+		return errors.New("A device's quiet hours need both a start and an end.")
+	}
+	if p.QuietStart != "" {
+		if _, err := time.Parse("15:04", p.QuietStart); err != nil {
+			return errors.New("A device's quietStart must be a time of day such as 22:30.")
+		}
+		if _, err := time.Parse("15:04", p.QuietEnd); err != nil {
+			return errors.New("A device's quietEnd must be a time of day such as 07:00.")
+		}
+	}
+	return nil
+}
+
+// Quiet reports whether t, in the time zone the quiet hours are in, is
+// within them, and if so when they end.
+func (p *DeviceProfile) Quiet(t time.Time) (bool, time.Time) {
+	if p.QuietStart == "" || p.QuietStart == p.QuietEnd {
+		return false, time.Time{}
+	}
+	start, err1 := time.Parse("15:04", p.QuietStart)
+	end, err2 := time.Parse("15:04", p.QuietEnd)
+	if err1 != nil || err2 != nil {
+		return false, time.Time{}
+	}
+	minutes := func(c time.Time) int { return c.Hour()*60 + c.Minute() }
+	now, from, to := minutes(t), minutes(start), minutes(end)
+	var quiet bool
+	if from < to {
+		quiet = now >= from && now < to
+	} else {
+		quiet = now >= from || now < to
+	}
+	if !quiet {
+		return false, time.Time{}
+	}
+	until := time.Date(t.Year(), t.Month(), t.Day(), end.Hour(), end.Minute(), 0, 0, t.Location())
+	if !until.After(t) {
+		until = time.Date(t.Year(), t.Month(), t.Day()+1, end.Hour(), end.Minute(), 0, 0, t.Location())
+	}
+	return true, until
+}
+
+// Filters are the filters for the posts the profile shows.
+func (p *DeviceProfile) Filters() []interface{} {
+	var filters []interface{}
+	if p.Album != "" {
+		filters = append(filters, AlbumFilter{Matching: p.Album})
+	}
+	if len(p.Tags) > 0 {
+		filters = append(filters, TagFilter{Tags: p.Tags})
+	}
+	if len(p.Authors) > 0 {
+		filters = append(filters, AuthorFilter{Any: p.Authors})
+	}
+	return filters
+}
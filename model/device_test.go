@@ -0,0 +1,41 @@
+package model
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDeviceProfileQuiet(t *testing.T) {
+	at := func(day int, hour int, minute int) time.Time {
+		return time.Date(2024, time.June, day, hour, minute, 0, 0, time.UTC)
+	}
+	overnight := DeviceProfile{QuietStart: "22:30", QuietEnd: "07:00"}
+	daytime := DeviceProfile{QuietStart: "12:00", QuietEnd: "14:00"}
+	for _, tt := range []struct {
+		name    string
+		profile DeviceProfile
+		now     time.Time
+		quiet   bool
+		until   time.Time
+	}{
+		{"before overnight quiet hours", overnight, at(1, 22, 29), false, time.Time{}},
+		{"start of overnight quiet hours", overnight, at(1, 22, 30), true, at(2, 7, 0)},
+		{"before midnight", overnight, at(1, 23, 59), true, at(2, 7, 0)},
+		{"midnight", overnight, at(2, 0, 0), true, at(2, 7, 0)},
+		{"after midnight", overnight, at(2, 6, 59), true, at(2, 7, 0)},
+		{"end of overnight quiet hours", overnight, at(2, 7, 0), false, time.Time{}},
+		{"midday", overnight, at(2, 12, 0), false, time.Time{}},
+		{"daytime quiet hours", daytime, at(1, 13, 0), true, at(1, 14, 0)},
+		{"end of daytime quiet hours", daytime, at(1, 14, 0), false, time.Time{}},
+		{"night with daytime quiet hours", daytime, at(1, 23, 0), false, time.Time{}},
+		{"no quiet hours", DeviceProfile{}, at(1, 23, 0), false, time.Time{}},
+		{"empty quiet hours", DeviceProfile{QuietStart: "22:00", QuietEnd: "22:00"}, at(1, 22, 0), false, time.Time{}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			quiet, until := tt.profile.Quiet(tt.now)
+			if quiet != tt.quiet || !until.Equal(tt.until) {
+				t.Errorf("Quiet(%s) = %t until %v, want %t until %v", tt.now.Format("15:04"), quiet, until, tt.quiet, tt.until)
+			}
+		})
+	}
+}
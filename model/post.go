@@ -2,6 +2,8 @@ package model
 
 import (
 	"errors"
+	"fmt"
+	"strconv"
 	"time"
 )
 
@@ -13,7 +15,40 @@ type Post struct {
 	PostTime     time.Time `json:"postTime"`
 	CreationTime time.Time `json:"creationTime"`
 	Author       string    `json:"author"`
-	Saved        bool      `json:"-"`
+	Album        string    `json:"album"`
+	Tags         []string  `json:"tags"`
+	// ContentHash is the hex SHA-1 of the image, and PerceptualHash its
+	// dHash. Both are empty for posts saved before they were computed.
+	ContentHash    string          `json:"contentHash,omitempty"`
+	PerceptualHash *PerceptualHash `json:"perceptualHash,omitempty"`
+	Saved          bool            `json:"-"`
+}
+
+// PerceptualHash is a 64 bit image hash that is written as 16 hex digits.
+type PerceptualHash uint64
+
+func (h PerceptualHash) String() string {
+	return fmt.Sprintf("%016x", uint64(h))
+}
+
+func (h PerceptualHash) MarshalText() ([]byte, error) {
+	return []byte(h.String()), nil
+}
+
+func (h *PerceptualHash) UnmarshalText(text []byte) error {
+	v, err := strconv.ParseUint(string(text), 16, 64)
+	if err != nil {
+		return err
+	}
+	*h = PerceptualHash(v)
+	return nil
+}
+
+// SimilarPost is a post whose perceptual hash is Distance bits away from
+// the one searched for.
+type SimilarPost struct {
+	Id       int64 `json:"id"`
+	Distance int   `json:"distance"`
 }
 
 type Posts []Post
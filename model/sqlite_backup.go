@@ -0,0 +1,82 @@
+package model
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"github.com/mattgibbs/photopost/metrics"
+	"net/url"
+	"time"
+)
+
+// Backup writes a consistent copy of the database to path with VACUUM INTO,
+// which is safe while other connections are writing. path must not exist.
+func (d *ds) Backup(ctx context.Context, path string) error {
+	defer metrics.TimeQuery("Backup", time.Now())
+	_, err := d.db.ExecContext(ctx, "VACUUM INTO ?", path)
+	return err
+}
+
+// CheckDatabase opens the SQLite database at path read only, runs an
+// integrity check, and returns its schema version.
+func CheckDatabase(path string) (int, error) {
+	db, err := sql.Open("sqlite3", fmt.Sprintf("file:%s?mode=ro", url.PathEscape(path)))
+	if err != nil {
+		return 0, err
+	}
+	defer db.Close()
+	rows, err := db.Query("PRAGMA integrity_check")
+	if err != nil {
+		return 0, err
+	}
+	var problems []string
+	for rows.Next() {
+		var result string
+		if err := rows.Scan(&result); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		if result != "ok" {
+			problems = append(problems, result)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+	if len(problems) > 0 {
+		return 0, fmt.Errorf("integrity check failed: %v", problems)
+	}
+	version, err := schemaVersion(db)
+	if err != nil {
+		return 0, err
+	}
+	if version > SchemaVersion {
+		return version, fmt.Errorf("database schema version %d is newer than this build of photopost supports (%d)", version, SchemaVersion)
+	}
+	return version, nil
+}
+
+// BackupImageFiles lists the image files the posts in the database at path
+// refer to, without migrating or otherwise changing it.
+func BackupImageFiles(path string) ([]string, error) {
+	db, err := sql.Open("sqlite3", fmt.Sprintf("file:%s?mode=ro", url.PathEscape(path)))
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	rows, err := db.Query("SELECT DISTINCT image_file FROM posts")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var files []string
+	for rows.Next() {
+		var file string
+		if err := rows.Scan(&file); err != nil {
+			return nil, err
+		}
+		files = append(files, file)
+	}
+	return files, rows.Err()
+}
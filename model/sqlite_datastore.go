@@ -1,17 +1,22 @@
 package model
 
 import (
+	"context"
 	"database/sql"
 	"errors"
 	"fmt"
+	"github.com/mattgibbs/photopost/metrics"
 	_ "github.com/mattn/go-sqlite3"
 	"log"
+	"log/slog"
+	"math/bits"
+	"sort"
 	"strings"
 	"time"
 )
 
 func initSQLiteDB(addr string) *sql.DB {
-	db, err := sql.Open("sqlite3", addr)
+	db, err := sql.Open("sqlite3", sqliteDSN(addr))
 	if err != nil {
 		log.Fatalf("Unable to open sqlite database: %s", err)
 	}
@@ -22,6 +27,17 @@ func initSQLiteDB(addr string) *sql.DB {
 	return db
 }
 
+// sqliteDSN adds the connection settings the datastore relies on to addr.
+// Transactions take the write lock as they begin (BEGIN IMMEDIATE), so that
+// two that read and then write, such as NextRandomPost, wait on the busy
+// timeout for each other rather than one failing with "database is locked".
+func sqliteDSN(addr string) string {
+	if strings.Contains(addr, "?") {
+		return addr + "&_txlock=immediate"
+	}
+	return addr + "?_txlock=immediate"
+}
+
 type scannable interface {
 	Scan(dest ...interface{}) error
 }
@@ -36,17 +52,36 @@ type ds struct {
 	post_ids_stmt     *sql.Stmt
 }
 
-var save_post_sql = "INSERT INTO posts(title, text, image_file, author, post_time, creation_time) VALUES (?, ?, ?, ?, ?, ?)"
-var findall_post_sql = `SELECT id, title, text, image_file, author, post_time, creation_time FROM posts`
+var save_post_sql = "INSERT INTO posts(title, text, image_file, author, post_time, creation_time, album, content_hash, phash) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)"
+var restore_post_sql = "INSERT INTO posts(id, title, text, image_file, author, post_time, creation_time, album, content_hash, phash) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)"
+var findall_post_sql = `SELECT id, title, text, image_file, author, post_time, creation_time, album, content_hash, phash FROM posts`
 var find_post_sql = findall_post_sql + " WHERE id = ?"
 var findall_post_sql_ordered = findall_post_sql + " ORDER BY post_time DESC"
 var delete_post_sql = "DELETE FROM posts WHERE id = ?"
-var update_post_sql = "UPDATE posts SET title = ?, text = ?, image_file = ?, author = ?, post_time = ? WHERE id = ?"
+var update_post_sql = "UPDATE posts SET title = ?, text = ?, image_file = ?, author = ?, post_time = ?, album = ?, content_hash = ?, phash = ? WHERE id = ?"
 var post_ids_sql = `SELECT id FROM posts`
+var count_posts_sql = `SELECT COUNT(*) FROM posts`
+var oldest_post_time_sql = `SELECT MIN(post_time) FROM posts`
+var post_ids_for_image_sql = `SELECT id FROM posts WHERE image_file = ?`
+var save_tag_sql = `INSERT OR IGNORE INTO post_tags(post_id, tag) VALUES (?, ?)`
+var delete_tags_sql = `DELETE FROM post_tags WHERE post_id = ?`
+var find_tags_sql = `SELECT post_id, tag FROM post_tags WHERE post_id IN (%s) ORDER BY tag`
+var post_ids_for_content_hash_sql = `SELECT id FROM posts WHERE content_hash = ?`
+var phashes_sql = `SELECT id, phash FROM posts WHERE phash IS NOT NULL`
+var posts_missing_hashes_sql = findall_post_sql + ` WHERE (content_hash = '' OR phash IS NULL) AND id > ? ORDER BY id LIMIT ?`
+var update_post_hashes_sql = `UPDATE posts SET content_hash = ?, phash = ? WHERE id = ?`
+var save_phash_band_sql = `INSERT OR IGNORE INTO post_phash_bands(band, value, post_id) VALUES (?, ?, ?)`
+var delete_phash_bands_sql = `DELETE FROM post_phash_bands WHERE post_id = ?`
+var phash_candidates_sql = `SELECT id, phash FROM posts WHERE id IN (` + phashBandQuery() + `)`
+
+// phashBands is the number of 8 bit bands a perceptual hash is indexed by.
+// Two hashes within phashBands-1 bits of each other must have at least one
+// band in common, so looking up each band finds every such hash.
+const phashBands = 8
 
 func NewSQLiteDatastore(addr string) *ds {
 	d := initSQLiteDB(addr)
-	createTables(d)
+	migrate(d)
 	save_post_stmt, err := d.Prepare(save_post_sql)
 	if err != nil {
 		log.Fatalf("Error while preparing post save statement: %s", err)
@@ -83,29 +118,56 @@ func NewSQLiteDatastore(addr string) *ds {
 }
 
 func (d *ds) FindPost(id int) (*Post, error) {
+	defer metrics.TimeQuery("FindPost", time.Now())
 	row := d.find_post_stmt.QueryRow(id)
 	result, scanErr := scanPostFromRow(row)
 	if scanErr != nil {
 		return nil, scanErr
 	}
-	return result, nil
+	return result, d.attachTags([]*Post{result})
 }
 
 func (d *ds) FindAllPosts() ([]*Post, error) {
+	defer metrics.TimeQuery("FindAllPosts", time.Now())
 	rows, err := d.findall_post_stmt.Query()
 	if err != nil {
-		log.Printf("Error during Post FindAll: %s", err)
+		slog.Error("Error during Post FindAll", "err", err)
 		return nil, err
 	}
 	defer rows.Close()
-	return scanPostsFromRows(rows)
+	posts, err := scanPostsFromRows(rows)
+	if err != nil {
+		return posts, err
+	}
+	return posts, d.attachTags(posts)
 }
 
 func (d *ds) FindPostsWithFilters(filters []interface{}) ([]*Post, error) {
+	defer metrics.TimeQuery("FindPostsWithFilters", time.Now())
 	if len(filters) == 0 {
 		return d.FindAllPosts()
 	}
-	query := findall_post_sql + " WHERE "
+	where, args, err := whereClauseForFilters(filters)
+	if err != nil {
+		return nil, err
+	}
+	query := findall_post_sql + where + " ORDER BY post_time DESC"
+	rows, queryErr := d.db.Query(query, args...)
+	if queryErr != nil {
+		slog.Error("Error during Post FindPostsWithFilters", "err", queryErr)
+		return nil, queryErr
+	}
+	defer rows.Close()
+	posts, err := scanPostsFromRows(rows)
+	if err != nil {
+		return posts, err
+	}
+	return posts, d.attachTags(posts)
+}
+
+// whereClauseForFilters builds a " WHERE ..." clause (or an empty string)
+// and its arguments that match posts passing every filter.
+func whereClauseForFilters(filters []interface{}) (string, []interface{}, error) {
 	var args []interface{}
 	var clauses []string
 	for _, filter := range filters {
@@ -145,7 +207,7 @@ func (d *ds) FindPostsWithFilters(filters []interface{}) ([]*Post, error) {
 				args = append(args, f.Contains)
 			}
 		case PostIdFilter:
-			addIdFilterClause(f.PostIds, "id", clauses, args)
+			clauses, args = addIdFilterClause(f.PostIds, "id", clauses, args)
 		case AuthorFilter:
 			if f.Matching != "" {
 				clauses = append(clauses, "author = ?")
@@ -155,101 +217,206 @@ func (d *ds) FindPostsWithFilters(filters []interface{}) ([]*Post, error) {
 				clauses = append(clauses, "author LIKE '%' || ? || '%'")
 				args = append(args, f.Contains)
 			}
+			if len(f.Any) > 0 {
+				clauses = append(clauses, fmt.Sprintf("author IN (%s)", placeholders(len(f.Any))))
+				for _, author := range f.Any {
+					args = append(args, author)
+				}
+			}
+		case AlbumFilter:
+			if f.Matching != "" {
+				clauses = append(clauses, "album = ?")
+				args = append(args, f.Matching)
+			}
+		case TagFilter:
+			if len(f.Tags) > 0 {
+				clauses = append(clauses, fmt.Sprintf("id IN (SELECT post_id FROM post_tags WHERE tag IN (%s) GROUP BY post_id HAVING COUNT(*) = ?)", placeholders(len(f.Tags))))
+				for _, tag := range f.Tags {
+					args = append(args, tag)
+				}
+				args = append(args, len(f.Tags))
+			}
+		case PostTimeRangesFilter:
+			if len(f.Ranges) == 0 {
+				clauses = append(clauses, "0")
+				break
+			}
+			ranges := make([]string, len(f.Ranges))
+			for i, r := range f.Ranges {
+				ranges[i] = "(post_time >= ? AND post_time < ?)"
+				args = append(args, r.Start.Unix(), r.End.Unix())
+			}
+			clauses = append(clauses, "("+strings.Join(ranges, " OR ")+")")
 		default:
-			return nil, errors.New("Unknown filter type.")
+			return "", nil, errors.New("Unknown filter type.")
 		}
 	}
-	query = query + strings.Join(clauses, " AND ")
-	query = query + " ORDER BY post_time DESC"
-	rows, queryErr := d.db.Query(query, args...)
-	defer rows.Close()
-	if queryErr != nil {
-		return nil, queryErr
+	if len(clauses) == 0 {
+		return "", nil, nil
 	}
-	return scanPostsFromRows(rows)
+	return " WHERE " + strings.Join(clauses, " AND "), args, nil
 }
 
-func addIdFilterClause(ids []int64, columnName string, clauses []string, args []interface{}) {
+func addIdFilterClause(ids []int64, columnName string, clauses []string, args []interface{}) ([]string, []interface{}) {
 	if len(ids) > 0 {
 		idClause := "%s IN (%s)"
-		questionMarks := make([]string, len(ids))
-		for i, _ := range questionMarks {
-			questionMarks[i] = "?"
-		}
-		clauses = append(clauses, fmt.Sprintf(idClause, columnName, strings.Join(questionMarks, ",")))
+		clauses = append(clauses, fmt.Sprintf(idClause, columnName, placeholders(len(ids))))
 		for _, id := range ids {
 			args = append(args, id)
 		}
 	}
+	return clauses, args
+}
+
+func placeholders(n int) string {
+	questionMarks := make([]string, n)
+	for i := range questionMarks {
+		questionMarks[i] = "?"
+	}
+	return strings.Join(questionMarks, ",")
 }
 
+// scanPostsFromRows reads posts in the order the query returned them, which
+// callers such as PostsMissingHashes depend on.
 func scanPostsFromRows(rows *sql.Rows) ([]*Post, error) {
 	var err error
-	posts := make(map[int64]*Post)
+	posts := []*Post{}
 	for rows.Next() {
 		rowErr := rows.Err()
 		if rowErr != nil {
-			log.Printf("Row Errow during Post FindAll: %s", rowErr)
+			slog.Error("Row Errow during Post FindAll", "err", rowErr)
 			err = rowErr
 			break
 		}
 		result, scanErr := scanPostFromRow(rows)
 		if scanErr != nil {
-			log.Printf("Error while scanning row during Post FindAll: %s", scanErr)
+			slog.Error("Error while scanning row during Post FindAll", "err", scanErr)
 			err = scanErr
 			continue
 		}
-		posts[result.Id] = result
+		posts = append(posts, result)
 	}
+	return posts, err
+}
 
-	postList := []*Post{}
-	for id := range posts {
-		postList = append(postList, posts[id])
+// attachTags loads the tags of posts, in batches to stay under SQLite's
+// limit on the number of bound parameters.
+func (d *ds) attachTags(posts []*Post) error {
+	const batchSize = 500
+	byId := make(map[int64]*Post, len(posts))
+	for _, post := range posts {
+		post.Tags = []string{}
+		byId[post.Id] = post
 	}
-	return postList, err
+	for start := 0; start < len(posts); start += batchSize {
+		end := start + batchSize
+		if end > len(posts) {
+			end = len(posts)
+		}
+		args := make([]interface{}, 0, end-start)
+		for _, post := range posts[start:end] {
+			args = append(args, post.Id)
+		}
+		rows, err := d.db.Query(fmt.Sprintf(find_tags_sql, placeholders(len(args))), args...)
+		if err != nil {
+			slog.Error("Error while fetching tags", "err", err)
+			return err
+		}
+		for rows.Next() {
+			var postId int64
+			var tag string
+			if err := rows.Scan(&postId, &tag); err != nil {
+				rows.Close()
+				return err
+			}
+			byId[postId].Tags = append(byId[postId].Tags, tag)
+		}
+		err = rows.Err()
+		rows.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 func scanPostFromRow(row scannable) (*Post, error) {
-	//id, title, text, image_file, author, post_time, creation_time
+	//id, title, text, image_file, author, post_time, creation_time, album, content_hash, phash
 	post := Post{}
 	var postTimestamp int64
 	var creationTimestamp int64
-	err := row.Scan(&post.Id, &post.Title, &post.Text, &post.ImageFile, &post.Author, &postTimestamp, &creationTimestamp)
+	var phash sql.NullInt64
+	err := row.Scan(&post.Id, &post.Title, &post.Text, &post.ImageFile, &post.Author, &postTimestamp, &creationTimestamp, &post.Album, &post.ContentHash, &phash)
 	if err != nil {
 		return nil, err
 	}
+	if phash.Valid {
+		hash := PerceptualHash(phash.Int64)
+		post.PerceptualHash = &hash
+	}
 	post.PostTime = time.Unix(postTimestamp, 0)
 	post.CreationTime = time.Unix(creationTimestamp, 0)
 	return &post, nil
 }
 
 func (d *ds) SavePost(post *Post) (int64, error) {
+	defer metrics.TimeQuery("SavePost", time.Now())
+	ids, err := d.savePosts([]*Post{post})
+	if err != nil {
+		return -1, err
+	}
+	return ids[0], nil
+}
+
+// SavePosts saves every post in a single transaction: either all of them are
+// saved, or none are.
+func (d *ds) SavePosts(posts []*Post) ([]int64, error) {
+	defer metrics.TimeQuery("SavePosts", time.Now())
+	return d.savePosts(posts)
+}
+
+func (d *ds) savePosts(posts []*Post) ([]int64, error) {
 	transaction, txErr := d.db.Begin()
-	defer transaction.Rollback()
 	//First, insert a new row into the 'posts' table.
 	if txErr != nil {
-		log.Printf("Error while creating post save transaction: %s", txErr)
-		return -1, txErr
+		slog.Error("Error while creating post save transaction", "err", txErr)
+		return nil, txErr
 	}
+	defer transaction.Rollback()
 	stmt, prepErr := transaction.Prepare(save_post_sql)
-	defer stmt.Close()
 	if prepErr != nil {
-		log.Printf("Error while preparing post insert statement: %s", prepErr)
-		return -1, prepErr
+		slog.Error("Error while preparing post insert statement", "err", prepErr)
+		return nil, prepErr
 	}
-	lastId, saveErr := savePostWithStatement(post, stmt)
-	if saveErr != nil {
-		log.Printf("Error while saving new post: %s", saveErr)
-		return -1, saveErr
+	defer stmt.Close()
+	ids := make([]int64, len(posts))
+	for i, post := range posts {
+		lastId, saveErr := savePostWithStatement(post, stmt)
+		if saveErr != nil {
+			slog.Error("Error while saving new post", "err", saveErr)
+			return nil, saveErr
+		}
+		//Then, the post's tags.
+		if tagErr := saveTags(transaction, lastId, post.Tags); tagErr != nil {
+			slog.Error("Error while saving tags for new post", "err", tagErr)
+			return nil, tagErr
+		}
+		if bandErr := savePhashBands(transaction, lastId, post.PerceptualHash); bandErr != nil {
+			slog.Error("Error while indexing perceptual hash for new post", "err", bandErr)
+			return nil, bandErr
+		}
+		ids[i] = lastId
 	}
 
 	commitErr := transaction.Commit()
 	if commitErr != nil {
-		log.Printf("Error while commiting post save transaction: %s", commitErr)
-		return -1, commitErr
+		slog.Error("Error while commiting post save transaction", "err", commitErr)
+		return nil, commitErr
 	}
-	post.Id = lastId
-	return lastId, nil
+	for i, post := range posts {
+		post.Id = ids[i]
+	}
+	return ids, nil
 }
 
 func savePostWithStatement(post *Post, stmt *sql.Stmt) (int64, error) {
@@ -257,49 +424,146 @@ func savePostWithStatement(post *Post, stmt *sql.Stmt) (int64, error) {
 	if post.PostTime.IsZero() {
 		post.PostTime = post.CreationTime
 	}
-	//title, text, image_file, author, post_time, creation_time)
-	res, execErr := stmt.Exec(post.Title, post.Text, post.ImageFile, post.Author, post.PostTime.Unix(), post.CreationTime.Unix())
+	//title, text, image_file, author, post_time, creation_time, album, content_hash, phash)
+	res, execErr := stmt.Exec(post.Title, post.Text, post.ImageFile, post.Author, post.PostTime.Unix(), post.CreationTime.Unix(), post.Album, post.ContentHash, phashValue(post.PerceptualHash))
 	if execErr != nil {
-		log.Printf("Error while executing save statement: %s", execErr)
+		slog.Error("Error while executing save statement", "err", execErr)
 		return -1, execErr
 	}
 	lastId, lastIdErr := res.LastInsertId()
 	if lastIdErr != nil {
-		log.Printf("Error while fetching last ID for saved post: %s", lastIdErr)
+		slog.Error("Error while fetching last ID for saved post", "err", lastIdErr)
 		return -1, lastIdErr
 	}
 	return lastId, nil
 }
 
+// RestorePosts saves posts with the IDs and creation times they already have,
+// as when restoring an export. Nothing is saved if any of the IDs is taken.
+func (d *ds) RestorePosts(posts []*Post) error {
+	defer metrics.TimeQuery("RestorePosts", time.Now())
+	transaction, err := d.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer transaction.Rollback()
+	stmt, err := transaction.Prepare(restore_post_sql)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	for _, post := range posts {
+		if post.Id <= 0 {
+			return errors.New("Cannot restore a post without an ID.")
+		}
+		//id, title, text, image_file, author, post_time, creation_time, album, content_hash, phash
+		_, err := stmt.Exec(post.Id, post.Title, post.Text, post.ImageFile, post.Author, post.PostTime.Unix(), post.CreationTime.Unix(), post.Album, post.ContentHash, phashValue(post.PerceptualHash))
+		if err != nil {
+			return fmt.Errorf("post %d: %w", post.Id, err)
+		}
+		if err := saveTags(transaction, post.Id, post.Tags); err != nil {
+			return err
+		}
+		if err := savePhashBands(transaction, post.Id, post.PerceptualHash); err != nil {
+			return err
+		}
+	}
+	return transaction.Commit()
+}
+
+// saveTags replaces the tags of a post.
+func saveTags(transaction *sql.Tx, postId int64, tags []string) error {
+	if _, err := transaction.Exec(delete_tags_sql, postId); err != nil {
+		return err
+	}
+	for _, tag := range tags {
+		if _, err := transaction.Exec(save_tag_sql, postId, tag); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (d *ds) UpdatePost(post *Post) error {
-	//"UPDATE posts SET title = ?, text = ?, image_file = ?, author = ?, post_time = ? WHERE id = ?"
+	defer metrics.TimeQuery("UpdatePost", time.Now())
+	//"UPDATE posts SET title = ?, text = ?, image_file = ?, author = ?, post_time = ?, album = ?, content_hash = ?, phash = ? WHERE id = ?"
 	if post.Id == 0 {
 		return errors.New("Cannot update a post without an ID.")
 	}
-	_, err := d.update_post_stmt.Exec(post.Title, post.Text, post.ImageFile, post.Author, post.PostTime.Unix(), post.Id)
-	return err
+	transaction, err := d.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer transaction.Rollback()
+	_, err = transaction.Stmt(d.update_post_stmt).Exec(post.Title, post.Text, post.ImageFile, post.Author, post.PostTime.Unix(), post.Album, post.ContentHash, phashValue(post.PerceptualHash), post.Id)
+	if err != nil {
+		return err
+	}
+	if err = saveTags(transaction, post.Id, post.Tags); err != nil {
+		return err
+	}
+	if err = savePhashBands(transaction, post.Id, post.PerceptualHash); err != nil {
+		return err
+	}
+	return transaction.Commit()
 }
 
 func (d *ds) DeletePost(post *Post) error {
+	defer metrics.TimeQuery("DeletePost", time.Now())
 	if post.Id == 0 {
 		return errors.New("Cannot delete a post without an ID.")
 	}
-	_, err := d.delete_post_stmt.Exec(post.Id)
-	return err
+	transaction, err := d.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer transaction.Rollback()
+	if _, err = transaction.Exec(delete_tags_sql, post.Id); err != nil {
+		return err
+	}
+	if _, err = transaction.Exec(delete_phash_bands_sql, post.Id); err != nil {
+		return err
+	}
+	if _, err = transaction.Exec(delete_post_shows_sql, post.Id); err != nil {
+		return err
+	}
+	if _, err = transaction.Exec(delete_shuffle_turns_sql, post.Id); err != nil {
+		return err
+	}
+	if _, err = transaction.Stmt(d.delete_post_stmt).Exec(post.Id); err != nil {
+		return err
+	}
+	return transaction.Commit()
 }
 
 func (d *ds) PostIDs() ([]int64, error) {
+	defer metrics.TimeQuery("PostIDs", time.Now())
 	rows, err := d.post_ids_stmt.Query()
+	if err != nil {
+		slog.Error("Error while fetching all IDs", "err", err)
+		return nil, err
+	}
 	defer rows.Close()
+	return scanIDsFromRows(rows)
+}
+
+func (d *ds) PostIDsForImageFile(imageFile string) ([]int64, error) {
+	defer metrics.TimeQuery("PostIDsForImageFile", time.Now())
+	rows, err := d.db.Query(post_ids_for_image_sql, imageFile)
 	if err != nil {
-		log.Printf("Error while fetching all IDs: %s", err)
+		slog.Error("Error while fetching IDs for image", "err", err)
 		return nil, err
 	}
+	defer rows.Close()
+	return scanIDsFromRows(rows)
+}
+
+func scanIDsFromRows(rows *sql.Rows) ([]int64, error) {
 	var ids []int64
 	for rows.Next() {
 		rowErr := rows.Err()
 		if rowErr != nil {
-			log.Printf("Row Errow during PostIDs: %s", rowErr)
+			slog.Error("Row Error while scanning IDs", "err", rowErr)
 			return nil, rowErr
 		}
 		var id int64
@@ -312,25 +576,178 @@ func (d *ds) PostIDs() ([]int64, error) {
 	return ids, nil
 }
 
+// phashValue stores a perceptual hash in a (signed) integer column, or NULL
+// if it has not been computed.
+func phashValue(hash *PerceptualHash) interface{} {
+	if hash == nil {
+		return nil
+	}
+	return int64(*hash)
+}
+
+func (d *ds) PostIDsForContentHash(contentHash string) ([]int64, error) {
+	defer metrics.TimeQuery("PostIDsForContentHash", time.Now())
+	rows, err := d.db.Query(post_ids_for_content_hash_sql, contentHash)
+	if err != nil {
+		slog.Error("Error while fetching IDs for content hash", "err", err)
+		return nil, err
+	}
+	defer rows.Close()
+	return scanIDsFromRows(rows)
+}
+
+// FindSimilarPosts returns the posts whose perceptual hash is within
+// maxDistance bits of hash, closest first. Distances under phashBands are
+// looked up in the band index; larger ones have to compare every hash.
+func (d *ds) FindSimilarPosts(hash PerceptualHash, maxDistance int) ([]SimilarPost, error) {
+	defer metrics.TimeQuery("FindSimilarPosts", time.Now())
+	var hashes map[int64]PerceptualHash
+	var err error
+	if maxDistance < phashBands {
+		hashes, err = d.perceptualHashes(phash_candidates_sql, phashBandArgs(hash)...)
+	} else {
+		hashes, err = d.perceptualHashes(phashes_sql)
+	}
+	if err != nil {
+		return nil, err
+	}
+	similar := []SimilarPost{}
+	for id, other := range hashes {
+		if distance := bits.OnesCount64(uint64(hash ^ other)); distance <= maxDistance {
+			similar = append(similar, SimilarPost{Id: id, Distance: distance})
+		}
+	}
+	sortSimilarPosts(similar)
+	return similar, nil
+}
+
+// phashBandQuery selects the IDs of posts that share any band with a hash,
+// given the band and value of each as arguments.
+func phashBandQuery() string {
+	queries := make([]string, phashBands)
+	for i := range queries {
+		queries[i] = "SELECT post_id FROM post_phash_bands WHERE band = ? AND value = ?"
+	}
+	return strings.Join(queries, " UNION ")
+}
+
+func phashBandArgs(hash PerceptualHash) []interface{} {
+	args := make([]interface{}, 0, 2*phashBands)
+	for band := 0; band < phashBands; band++ {
+		args = append(args, band, phashBandValue(hash, band))
+	}
+	return args
+}
+
+func phashBandValue(hash PerceptualHash, band int) int64 {
+	return int64((uint64(hash) >> (8 * band)) & 0xff)
+}
+
+// savePhashBands replaces the band index entries of a post.
+func savePhashBands(transaction *sql.Tx, postId int64, hash *PerceptualHash) error {
+	if _, err := transaction.Exec(delete_phash_bands_sql, postId); err != nil {
+		return err
+	}
+	if hash == nil {
+		return nil
+	}
+	for band := 0; band < phashBands; band++ {
+		if _, err := transaction.Exec(save_phash_band_sql, band, phashBandValue(*hash, band), postId); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func sortSimilarPosts(similar []SimilarPost) {
+	sort.Slice(similar, func(i, j int) bool {
+		if similar[i].Distance != similar[j].Distance {
+			return similar[i].Distance < similar[j].Distance
+		}
+		return similar[i].Id < similar[j].Id
+	})
+}
+
+func (d *ds) perceptualHashes(query string, args ...interface{}) (map[int64]PerceptualHash, error) {
+	rows, err := d.db.Query(query, args...)
+	if err != nil {
+		slog.Error("Error while fetching perceptual hashes", "err", err)
+		return nil, err
+	}
+	defer rows.Close()
+	hashes := map[int64]PerceptualHash{}
+	for rows.Next() {
+		var id, hash int64
+		if err := rows.Scan(&id, &hash); err != nil {
+			return nil, err
+		}
+		hashes[id] = PerceptualHash(hash)
+	}
+	return hashes, rows.Err()
+}
+
+// PostsMissingHashes returns up to limit posts, with IDs after afterId, that
+// were saved before content and perceptual hashes were computed.
+func (d *ds) PostsMissingHashes(afterId int64, limit int) ([]*Post, error) {
+	defer metrics.TimeQuery("PostsMissingHashes", time.Now())
+	rows, err := d.db.Query(posts_missing_hashes_sql, afterId, limit)
+	if err != nil {
+		slog.Error("Error while fetching posts missing hashes", "err", err)
+		return nil, err
+	}
+	defer rows.Close()
+	return scanPostsFromRows(rows)
+}
+
+func (d *ds) UpdatePostHashes(id int64, contentHash string, hash PerceptualHash) error {
+	defer metrics.TimeQuery("UpdatePostHashes", time.Now())
+	transaction, err := d.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer transaction.Rollback()
+	if _, err = transaction.Exec(update_post_hashes_sql, contentHash, int64(hash), id); err != nil {
+		return err
+	}
+	if err = savePhashBands(transaction, id, &hash); err != nil {
+		return err
+	}
+	return transaction.Commit()
+}
+
+func (d *ds) CountPosts() (int, error) {
+	defer metrics.TimeQuery("CountPosts", time.Now())
+	var count int
+	err := d.db.QueryRow(count_posts_sql).Scan(&count)
+	return count, err
+}
+
+func (d *ds) OldestPostTime() (time.Time, error) {
+	defer metrics.TimeQuery("OldestPostTime", time.Now())
+	var oldest sql.NullInt64
+	if err := d.db.QueryRow(oldest_post_time_sql).Scan(&oldest); err != nil || !oldest.Valid {
+		return time.Time{}, err
+	}
+	return time.Unix(oldest.Int64, 0), nil
+}
+
+func (d *ds) Ping(ctx context.Context) error {
+	defer metrics.TimeQuery("Ping", time.Now())
+	var one int
+	return d.db.QueryRowContext(ctx, "SELECT 1").Scan(&one)
+}
+
+func (d *ds) SchemaVersion() (int, error) {
+	return schemaVersion(d.db)
+}
+
 func (d *ds) Close() {
-	log.Print("Closing SQLite Datastore.")
+	slog.Info("Closing SQLite Datastore.")
 	d.save_post_stmt.Close()
 	d.find_post_stmt.Close()
 	d.findall_post_stmt.Close()
 	d.delete_post_stmt.Close()
 	d.update_post_stmt.Close()
+	d.post_ids_stmt.Close()
 	d.db.Close()
 }
-
-func createTables(db *sql.DB) {
-	transaction, err := db.Begin()
-	if err != nil {
-		log.Fatalf("Error while creating table transaction: %s", err)
-	}
-	//Create entries table
-	_, err = transaction.Exec("CREATE TABLE IF NOT EXISTS posts (id integer PRIMARY KEY, title string NOT NULL, text string, image_file string NOT NULL, author string NOT NULL, post_time integer NOT NULL, creation_time integer NOT NULL)")
-	if err != nil {
-		log.Fatalf("Error while creating posts table: %s", err)
-	}
-	transaction.Commit()
-}
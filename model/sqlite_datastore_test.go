@@ -0,0 +1,47 @@
+package model
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newTestDatastore(t *testing.T) *ds {
+	t.Helper()
+	d := NewSQLiteDatastore(filepath.Join(t.TempDir(), "photopost.db"))
+	t.Cleanup(d.Close)
+	return d
+}
+
+func TestPostsMissingHashesInIdOrder(t *testing.T) {
+	d := newTestDatastore(t)
+	var posts []*Post
+	for i := 0; i < 40; i++ {
+		posts = append(posts, &Post{Title: fmt.Sprint(i), Author: "tester", ImageFile: fmt.Sprintf("%d.png", i), PostTime: time.Now(), Tags: []string{}})
+	}
+	if _, err := d.SavePosts(posts); err != nil {
+		t.Fatal(err)
+	}
+	var afterId int64
+	seen := 0
+	for {
+		batch, err := d.PostsMissingHashes(afterId, 15)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(batch) == 0 {
+			break
+		}
+		for _, post := range batch {
+			if post.Id <= afterId {
+				t.Fatalf("post %d came after post %d", post.Id, afterId)
+			}
+			afterId = post.Id
+			seen++
+		}
+	}
+	if seen != len(posts) {
+		t.Errorf("saw %d posts, want %d", seen, len(posts))
+	}
+}
@@ -0,0 +1,123 @@
+package model
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/mattgibbs/photopost/metrics"
+	"strconv"
+	"time"
+)
+
+var find_device_sql = `SELECT id, name, token_hash, profile, creation_time, last_seen, last_post_id, last_post_time FROM devices WHERE id = ?`
+var findall_devices_sql = `SELECT id, name, token_hash, profile, creation_time, last_seen, last_post_id, last_post_time FROM devices ORDER BY id`
+var save_device_sql = `INSERT INTO devices(name, token_hash, profile, creation_time) VALUES (?, ?, ?, ?)`
+var update_device_sql = `UPDATE devices SET name = ?, token_hash = ?, profile = ? WHERE id = ?`
+var delete_device_sql = `DELETE FROM devices WHERE id = ?`
+var device_shown_sql = `UPDATE devices SET last_seen = ?, last_post_id = ?, last_post_time = ? WHERE id = ?`
+var delete_device_turns_sql = `DELETE FROM shuffle_turns WHERE client = ?`
+var delete_device_client_sql = `DELETE FROM shuffle_clients WHERE client = ?`
+
+// DeviceClient is the slideshow client a device's shuffle is kept under.
+// See NextRandomPost.
+func DeviceClient(id int64) string {
+	return "frame:" + strconv.FormatInt(id, 10)
+}
+
+func scanDeviceFromRow(row scannable) (*Device, error) {
+	device := Device{}
+	var profile string
+	var created, lastSeen, lastPostTime int64
+	err := row.Scan(&device.Id, &device.Name, &device.TokenHash, &profile, &created, &lastSeen, &device.LastPostId, &lastPostTime)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal([]byte(profile), &device.Profile); err != nil {
+		return nil, err
+	}
+	device.Created = time.Unix(created, 0)
+	if lastSeen != 0 {
+		device.LastSeen = time.Unix(lastSeen, 0)
+		device.LastPostTime = time.Unix(lastPostTime, 0)
+	}
+	return &device, nil
+}
+
+func (d *ds) FindDevice(id int64) (*Device, error) {
+	defer metrics.TimeQuery("FindDevice", time.Now())
+	return scanDeviceFromRow(d.db.QueryRow(find_device_sql, id))
+}
+
+func (d *ds) FindAllDevices() ([]*Device, error) {
+	defer metrics.TimeQuery("FindAllDevices", time.Now())
+	rows, err := d.db.Query(findall_devices_sql)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	devices := []*Device{}
+	for rows.Next() {
+		device, err := scanDeviceFromRow(rows)
+		if err != nil {
+			return nil, err
+		}
+		devices = append(devices, device)
+	}
+	return devices, rows.Err()
+}
+
+func (d *ds) SaveDevice(device *Device) (int64, error) {
+	defer metrics.TimeQuery("SaveDevice", time.Now())
+	profile, err := json.Marshal(device.Profile)
+	if err != nil {
+		return 0, err
+	}
+	if device.Created.IsZero() {
+		device.Created = time.Now()
+	}
+	res, err := d.db.Exec(save_device_sql, device.Name, device.TokenHash, string(profile), device.Created.Unix())
+	if err != nil {
+		return 0, err
+	}
+	device.Id, err = res.LastInsertId()
+	return device.Id, err
+}
+
+// UpdateDevice saves a device's name, token and profile.
+func (d *ds) UpdateDevice(device *Device) error {
+	defer metrics.TimeQuery("UpdateDevice", time.Now())
+	profile, err := json.Marshal(device.Profile)
+	if err != nil {
+		return err
+	}
+	_, err = d.db.Exec(update_device_sql, device.Name, device.TokenHash, string(profile), device.Id)
+	return err
+}
+
+// DeleteDevice removes a device along with its shuffle.
+func (d *ds) DeleteDevice(id int64) error {
+	defer metrics.TimeQuery("DeleteDevice", time.Now())
+	if id == 0 {
+		return errors.New("Cannot delete a device without an ID.")
+	}
+	transaction, err := d.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer transaction.Rollback()
+	if _, err := transaction.Exec(delete_device_turns_sql, DeviceClient(id)); err != nil {
+		return err
+	}
+	if _, err := transaction.Exec(delete_device_client_sql, DeviceClient(id)); err != nil {
+		return err
+	}
+	if _, err := transaction.Exec(delete_device_sql, id); err != nil {
+		return err
+	}
+	return transaction.Commit()
+}
+
+func (d *ds) DeviceShown(id int64, postId int64, postTime time.Time, seen time.Time) error {
+	defer metrics.TimeQuery("DeviceShown", time.Now())
+	_, err := d.db.Exec(device_shown_sql, seen.Unix(), postId, postTime.Unix(), id)
+	return err
+}
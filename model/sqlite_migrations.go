@@ -0,0 +1,83 @@
+package model
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"log/slog"
+)
+
+// migrations are applied in order, each in its own transaction. The schema
+// version stored in PRAGMA user_version is the number of migrations that have
+// been applied. Never edit a migration that has shipped; append a new one.
+var migrations = []string{
+	// 1: posts table. Databases created before versioning already have it.
+	`CREATE TABLE IF NOT EXISTS posts (id integer PRIMARY KEY, title string NOT NULL, text string, image_file string NOT NULL, author string NOT NULL, post_time integer NOT NULL, creation_time integer NOT NULL)`,
+	// 2: look up posts by image, to tell whether an image is still in use.
+	`CREATE INDEX IF NOT EXISTS posts_image_file ON posts(image_file)`,
+	// 3: albums and tags.
+	`ALTER TABLE posts ADD COLUMN album string NOT NULL DEFAULT '';
+	CREATE INDEX posts_album ON posts(album);
+	CREATE TABLE post_tags (post_id integer NOT NULL, tag string NOT NULL, PRIMARY KEY (post_id, tag));
+	CREATE INDEX post_tags_tag ON post_tags(tag);`,
+	// 4: content and perceptual hashes for duplicate detection. Existing
+	// posts are filled in by a background job.
+	`ALTER TABLE posts ADD COLUMN content_hash string NOT NULL DEFAULT '';
+	ALTER TABLE posts ADD COLUMN phash integer;
+	CREATE INDEX posts_content_hash ON posts(content_hash);`,
+	// 5: index perceptual hashes by 8 bit band, to find similar images
+	// without comparing against every post. See FindSimilarPosts.
+	`CREATE TABLE post_phash_bands (band integer NOT NULL, value integer NOT NULL, post_id integer NOT NULL, PRIMARY KEY (band, value, post_id)) WITHOUT ROWID;
+	CREATE INDEX post_phash_bands_post_id ON post_phash_bands(post_id);
+	INSERT INTO post_phash_bands(band, value, post_id)
+		SELECT b.band, (p.phash >> (8 * b.band)) & 255, p.id
+		FROM posts p, (SELECT 0 AS band UNION ALL SELECT 1 UNION ALL SELECT 2 UNION ALL SELECT 3
+			UNION ALL SELECT 4 UNION ALL SELECT 5 UNION ALL SELECT 6 UNION ALL SELECT 7) b
+		WHERE p.phash IS NOT NULL;`,
+	// 6: how often each post has been shown, and each slideshow client's
+	// place in its shuffle. See NextRandomPost.
+	`CREATE TABLE post_shows (post_id integer PRIMARY KEY, show_count integer NOT NULL, last_shown integer NOT NULL);
+	CREATE TABLE shuffle_clients (client string PRIMARY KEY, last_post_id integer NOT NULL, last_seen integer NOT NULL);
+	CREATE TABLE shuffle_turns (client string NOT NULL, post_id integer NOT NULL, turns integer NOT NULL, PRIMARY KEY (client, post_id)) WITHOUT ROWID;
+	CREATE INDEX shuffle_turns_post_id ON shuffle_turns(post_id);`,
+	// 7: registered display devices and their slideshow profiles, kept as
+	// JSON. See Device.
+	`CREATE TABLE devices (id integer PRIMARY KEY, name string NOT NULL, token_hash string NOT NULL, profile string NOT NULL, creation_time integer NOT NULL, last_seen integer NOT NULL DEFAULT 0, last_post_id integer NOT NULL DEFAULT 0, last_post_time integer NOT NULL DEFAULT 0);
+	CREATE UNIQUE INDEX devices_token_hash ON devices(token_hash);`,
+}
+
+// SchemaVersion is the schema version this build of photopost expects.
+var SchemaVersion = len(migrations)
+
+func schemaVersion(db *sql.DB) (int, error) {
+	var version int
+	err := db.QueryRow("PRAGMA user_version").Scan(&version)
+	return version, err
+}
+
+func migrate(db *sql.DB) {
+	version, err := schemaVersion(db)
+	if err != nil {
+		log.Fatalf("Error while reading schema version: %s", err)
+	}
+	if version > len(migrations) {
+		log.Fatalf("Database schema version %d is newer than this build of photopost supports (%d).", version, len(migrations))
+	}
+	for i := version; i < len(migrations); i++ {
+		transaction, err := db.Begin()
+		if err != nil {
+			log.Fatalf("Error while creating migration transaction: %s", err)
+		}
+		if _, err = transaction.Exec(migrations[i]); err != nil {
+			log.Fatalf("Error while applying migration %d: %s", i+1, err)
+		}
+		// PRAGMA does not accept bound parameters.
+		if _, err = transaction.Exec(fmt.Sprintf("PRAGMA user_version = %d", i+1)); err != nil {
+			log.Fatalf("Error while updating schema version to %d: %s", i+1, err)
+		}
+		if err = transaction.Commit(); err != nil {
+			log.Fatalf("Error while commiting migration %d: %s", i+1, err)
+		}
+		slog.Info("Applied database migration", "version", i+1)
+	}
+}
@@ -0,0 +1,133 @@
+package model
+
+import (
+	"fmt"
+	"math/bits"
+	"math/rand"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// flipBits returns hash with n distinct random bits flipped.
+func flipBits(r *rand.Rand, hash PerceptualHash, n int) PerceptualHash {
+	for _, bit := range r.Perm(64)[:n] {
+		hash ^= 1 << bit
+	}
+	return hash
+}
+
+// countPhashBands counts the band index rows of a post.
+func countPhashBands(t *testing.T, d *ds, id int64) int {
+	t.Helper()
+	var count int
+	if err := d.db.QueryRow("SELECT COUNT(*) FROM post_phash_bands WHERE post_id = ?", id).Scan(&count); err != nil {
+		t.Fatal(err)
+	}
+	return count
+}
+
+func TestFindSimilarPostsMatchesFullScan(t *testing.T) {
+	d := newTestDatastore(t)
+	r := rand.New(rand.NewSource(1))
+	// Clusters of hashes around a few centres, at every distance up to
+	// twice the band count, and some unrelated ones.
+	var centres []PerceptualHash
+	hashes := map[int64]PerceptualHash{}
+	var posts []*Post
+	for c := 0; c < 4; c++ {
+		centre := PerceptualHash(r.Uint64())
+		centres = append(centres, centre)
+		for distance := 0; distance <= 2*phashBands; distance++ {
+			for i := 0; i < 3; i++ {
+				hash := flipBits(r, centre, distance)
+				posts = append(posts, &Post{Title: fmt.Sprint(len(posts)), Author: "tester", ImageFile: fmt.Sprintf("%d.png", len(posts)), PostTime: time.Now(), Tags: []string{}, PerceptualHash: &hash})
+			}
+		}
+	}
+	for i := 0; i < 50; i++ {
+		hash := PerceptualHash(r.Uint64())
+		posts = append(posts, &Post{Title: fmt.Sprint(len(posts)), Author: "tester", ImageFile: fmt.Sprintf("%d.png", len(posts)), PostTime: time.Now(), Tags: []string{}, PerceptualHash: &hash})
+	}
+	if _, err := d.SavePosts(posts); err != nil {
+		t.Fatal(err)
+	}
+	for _, post := range posts {
+		hashes[post.Id] = *post.PerceptualHash
+	}
+
+	for _, query := range centres {
+		for maxDistance := 0; maxDistance < phashBands; maxDistance++ {
+			want := map[int64]int{}
+			for id, hash := range hashes {
+				if distance := bits.OnesCount64(uint64(query ^ hash)); distance <= maxDistance {
+					want[id] = distance
+				}
+			}
+			similar, err := d.FindSimilarPosts(query, maxDistance)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := map[int64]int{}
+			for i, post := range similar {
+				got[post.Id] = post.Distance
+				if i > 0 && post.Distance < similar[i-1].Distance {
+					t.Errorf("distance %d: post %d at %d comes after post %d at %d", maxDistance, post.Id, post.Distance, similar[i-1].Id, similar[i-1].Distance)
+				}
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("hash %s within %d: band lookup found %v, full scan %v", query, maxDistance, got, want)
+			}
+		}
+	}
+}
+
+func TestPhashBandsFollowPost(t *testing.T) {
+	d := newTestDatastore(t)
+	hash := PerceptualHash(0x0123456789abcdef)
+	post := &Post{Title: "photo", Author: "tester", ImageFile: "photo.png", PostTime: time.Now(), Tags: []string{}, PerceptualHash: &hash}
+	id, err := d.SavePost(post)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := countPhashBands(t, d, id); n != phashBands {
+		t.Errorf("%d band rows after saving, want %d", n, phashBands)
+	}
+
+	// Rotating an image gives it a new hash, and only that should find it.
+	rotated := PerceptualHash(0xfedcba9876543210)
+	post.PerceptualHash = &rotated
+	if err := d.UpdatePost(post); err != nil {
+		t.Fatal(err)
+	}
+	if n := countPhashBands(t, d, id); n != phashBands {
+		t.Errorf("%d band rows after updating, want %d", n, phashBands)
+	}
+	if similar, err := d.FindSimilarPosts(hash, phashBands-1); err != nil || len(similar) != 0 {
+		t.Errorf("the old hash still finds %v (%v)", similar, err)
+	}
+	if similar, err := d.FindSimilarPosts(rotated, 0); err != nil || len(similar) != 1 {
+		t.Errorf("the new hash finds %v (%v), want the post", similar, err)
+	}
+
+	post.PerceptualHash = nil
+	if err := d.UpdatePost(post); err != nil {
+		t.Fatal(err)
+	}
+	if n := countPhashBands(t, d, id); n != 0 {
+		t.Errorf("%d band rows after removing the hash, want none", n)
+	}
+
+	if err := d.UpdatePostHashes(id, "content", hash); err != nil {
+		t.Fatal(err)
+	}
+	if n := countPhashBands(t, d, id); n != phashBands {
+		t.Errorf("%d band rows after backfilling the hash, want %d", n, phashBands)
+	}
+	if err := d.DeletePost(post); err != nil {
+		t.Fatal(err)
+	}
+	if n := countPhashBands(t, d, id); n != 0 {
+		t.Errorf("%d band rows after deleting the post, want none", n)
+	}
+}
@@ -0,0 +1,172 @@
+package model
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/mattgibbs/photopost/metrics"
+	"math/rand"
+	"strings"
+	"time"
+)
+
+// ErrNoPosts is returned by NextRandomPost when there are no posts to pick.
+var ErrNoPosts = errors.New("There are no posts.")
+
+var delete_post_shows_sql = `DELETE FROM post_shows WHERE post_id = ?`
+var delete_shuffle_turns_sql = `DELETE FROM shuffle_turns WHERE post_id = ?`
+var shuffle_last_post_sql = `SELECT last_post_id FROM shuffle_clients WHERE client = ?`
+var reset_shuffle_sql = `DELETE FROM shuffle_turns WHERE client = ? AND post_id IN (SELECT id FROM posts%s)`
+var record_turn_sql = `INSERT INTO shuffle_turns(client, post_id, turns) VALUES (?, ?, 1)
+	ON CONFLICT(client, post_id) DO UPDATE SET turns = turns + 1`
+var record_show_sql = `INSERT INTO post_shows(post_id, show_count, last_shown) VALUES (?, 1, ?)
+	ON CONFLICT(post_id) DO UPDATE SET show_count = show_count + 1, last_shown = excluded.last_shown`
+var record_shuffle_client_sql = `INSERT INTO shuffle_clients(client, last_post_id, last_seen) VALUES (?, ?, ?)
+	ON CONFLICT(client) DO UPDATE SET last_post_id = excluded.last_post_id, last_seen = excluded.last_seen`
+var idle_shuffle_turns_sql = `DELETE FROM shuffle_turns WHERE client IN (SELECT client FROM shuffle_clients WHERE last_seen < ?)`
+var idle_shuffle_clients_sql = `DELETE FROM shuffle_clients WHERE last_seen < ?`
+var next_in_order_sql = ` WHERE post_time > ? OR (post_time = ? AND id > ?) ORDER BY post_time, id LIMIT 1`
+var first_in_order_sql = ` ORDER BY post_time, id LIMIT 1`
+
+// NextRandomPost picks a post that passes every filter to show a slideshow
+// client next, and records that it was shown. Each client has a shuffle: a
+// post is only picked while it has turns left (one, plus any extra from
+// weights), so every matching post is shown before anything repeats. Once
+// every matching turn is used, a new shuffle of those posts starts, avoiding
+// the post that was shown last. The shuffles are kept in the database, so
+// they carry on after a restart.
+//
+// The post is picked with a probability in proportion to its turns left,
+// using a running total over the posts so that no list of IDs is loaded.
+func (d *ds) NextRandomPost(client string, weights RandomWeights, filters []interface{}) (int64, error) {
+	defer metrics.TimeQuery("NextRandomPost", time.Now())
+	transaction, err := d.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer transaction.Rollback()
+
+	var lastId int64
+	err = transaction.QueryRow(shuffle_last_post_sql, client).Scan(&lastId)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return 0, err
+	}
+	where, filterArgs, err := whereClauseForFilters(filters)
+	if err != nil {
+		return 0, err
+	}
+	now := time.Now()
+	credits, args := shuffleCredits(client, weights, where, filterArgs, now)
+	id, err := pickByCredits(transaction, credits, args, lastId)
+	if errors.Is(err, ErrNoPosts) {
+		// Every turn in this shuffle has been used, so start another.
+		if _, err := transaction.Exec(fmt.Sprintf(reset_shuffle_sql, where), append([]interface{}{client}, filterArgs...)...); err != nil {
+			return 0, err
+		}
+		id, err = pickByCredits(transaction, credits, args, lastId)
+		if errors.Is(err, ErrNoPosts) && lastId != 0 {
+			// The post shown last is the only one there is.
+			id, err = pickByCredits(transaction, credits, args, 0)
+		}
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	if _, err := transaction.Exec(record_turn_sql, client, id); err != nil {
+		return 0, err
+	}
+	if _, err := transaction.Exec(record_show_sql, id, now.Unix()); err != nil {
+		return 0, err
+	}
+	if _, err := transaction.Exec(record_shuffle_client_sql, client, id, now.Unix()); err != nil {
+		return 0, err
+	}
+	return id, transaction.Commit()
+}
+
+// shuffleCredits builds a query for the turns each post matching where has
+// left in a client's shuffle, as "SELECT id, credit ...".
+func shuffleCredits(client string, weights RandomWeights, where string, filterArgs []interface{}, now time.Time) (string, []interface{}) {
+	turns := []string{"1"}
+	var args []interface{}
+	if weights.Favorites > 0 && weights.FavoriteTag != "" {
+		turns = append(turns, "CASE WHEN EXISTS (SELECT 1 FROM post_tags t WHERE t.post_id = p.id AND t.tag = ?) THEN ? ELSE 0 END")
+		args = append(args, weights.FavoriteTag, weights.Favorites)
+	}
+	if weights.Recent > 0 && weights.RecentWithin > 0 {
+		turns = append(turns, "CASE WHEN p.post_time > ? THEN ? WHEN p.post_time > ? THEN ? ELSE 0 END")
+		args = append(args, now.Add(-weights.RecentWithin).Unix(), weights.Recent, now.Add(-2*weights.RecentWithin).Unix(), weights.Recent/2)
+	}
+	if weights.Unseen > 0 {
+		turns = append(turns, "CASE WHEN s.show_count IS NULL THEN ? WHEN s.show_count < (SELECT AVG(show_count) FROM post_shows) THEN ? ELSE 0 END")
+		args = append(args, weights.Unseen, weights.Unseen/2)
+	}
+	query := fmt.Sprintf(`SELECT p.id AS id, %s - COALESCE(u.turns, 0) AS credit
+		FROM (SELECT id, post_time FROM posts%s) p
+		LEFT JOIN post_shows s ON s.post_id = p.id
+		LEFT JOIN shuffle_turns u ON u.client = ? AND u.post_id = p.id`, strings.Join(turns, " + "), where)
+	args = append(args, filterArgs...)
+	return query, append(args, client)
+}
+
+// pickByCredits picks a post at random, in proportion to its credit, leaving
+// out the post with ID exclude.
+func pickByCredits(transaction *sql.Tx, credits string, args []interface{}, exclude int64) (int64, error) {
+	candidates := fmt.Sprintf("SELECT id, credit FROM (%s) WHERE credit > 0 AND id != ?", credits)
+	args = append(append([]interface{}{}, args...), exclude)
+	var total int64
+	if err := transaction.QueryRow("SELECT COALESCE(SUM(credit), 0) FROM ("+candidates+")", args...).Scan(&total); err != nil {
+		return 0, err
+	}
+	if total == 0 {
+		return 0, ErrNoPosts
+	}
+	target := rand.Int63n(total)
+	var id int64
+	err := transaction.QueryRow(`SELECT id FROM (SELECT id, SUM(credit) OVER (ORDER BY id) AS running FROM (`+candidates+`))
+		WHERE running > ? ORDER BY running LIMIT 1`, append(args, target)...).Scan(&id)
+	return id, err
+}
+
+func (d *ds) NextPostInOrder(afterTime time.Time, afterId int64, filters []interface{}) (int64, error) {
+	defer metrics.TimeQuery("NextPostInOrder", time.Now())
+	where, args, err := whereClauseForFilters(filters)
+	if err != nil {
+		return 0, err
+	}
+	candidates := fmt.Sprintf("SELECT id FROM (SELECT id, post_time FROM posts%s)", where)
+	var id int64
+	err = d.db.QueryRow(candidates+next_in_order_sql, append(args, afterTime.Unix(), afterTime.Unix(), afterId)...).Scan(&id)
+	if errors.Is(err, sql.ErrNoRows) {
+		// Past the last post, so start again from the first.
+		err = d.db.QueryRow(candidates+first_in_order_sql, args...).Scan(&id)
+	}
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, ErrNoPosts
+	}
+	return id, err
+}
+
+// ForgetRandomClients removes the shuffles of clients that have not asked
+// for a post since idleSince.
+func (d *ds) ForgetRandomClients(idleSince time.Time) (int64, error) {
+	defer metrics.TimeQuery("ForgetRandomClients", time.Now())
+	transaction, err := d.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer transaction.Rollback()
+	if _, err := transaction.Exec(idle_shuffle_turns_sql, idleSince.Unix()); err != nil {
+		return 0, err
+	}
+	res, err := transaction.Exec(idle_shuffle_clients_sql, idleSince.Unix())
+	if err != nil {
+		return 0, err
+	}
+	forgotten, err := res.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	return forgotten, transaction.Commit()
+}
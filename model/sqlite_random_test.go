@@ -0,0 +1,152 @@
+package model
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// saveTestPosts saves a post for each list of tags, and returns their IDs.
+func saveTestPosts(t *testing.T, d *ds, tags ...[]string) []int64 {
+	t.Helper()
+	var posts []*Post
+	for i, postTags := range tags {
+		posts = append(posts, &Post{Title: fmt.Sprint(i), Author: "tester", ImageFile: fmt.Sprintf("%d.png", i), PostTime: time.Now(), Tags: postTags})
+	}
+	if _, err := d.SavePosts(posts); err != nil {
+		t.Fatal(err)
+	}
+	var ids []int64
+	for _, post := range posts {
+		ids = append(ids, post.Id)
+	}
+	return ids
+}
+
+func TestNextRandomPostShowsEveryPostBeforeRepeating(t *testing.T) {
+	d := newTestDatastore(t)
+	ids := saveTestPosts(t, d, []string{}, []string{}, []string{}, []string{}, []string{})
+	var last int64
+	for round := 0; round < 3; round++ {
+		shown := map[int64]bool{}
+		for range ids {
+			id, err := d.NextRandomPost("test", RandomWeights{}, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if shown[id] {
+				t.Fatalf("round %d: post %d was shown twice before the others", round, id)
+			}
+			if id == last {
+				t.Errorf("round %d: post %d was shown twice in a row", round, id)
+			}
+			shown[id] = true
+			last = id
+		}
+	}
+}
+
+func TestNextRandomPostWeights(t *testing.T) {
+	d := newTestDatastore(t)
+	ids := saveTestPosts(t, d, []string{"favorite"}, []string{}, []string{})
+	weights := RandomWeights{Favorites: 2, FavoriteTag: "favorite"}
+	// The favourite has three turns a shuffle and the others one each. A
+	// post is never shown twice in a row, so a shuffle can end with some of
+	// the favourite's turns left over, but it must still be shown much more
+	// often than either of the others.
+	counts := map[int64]int{}
+	for i := 0; i < 300; i++ {
+		id, err := d.NextRandomPost("test", weights, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		counts[id]++
+	}
+	if 2*counts[ids[0]] < 3*max(counts[ids[1]], counts[ids[2]]) {
+		t.Errorf("shown %v times, want the favourite %d shown at least half as often again as the others", counts, ids[0])
+	}
+}
+
+func TestNextRandomPostConcurrentClients(t *testing.T) {
+	d := newTestDatastore(t)
+	saveTestPosts(t, d, []string{}, []string{}, []string{}, []string{})
+	var wg sync.WaitGroup
+	errs := make(chan error, 8*25)
+	for client := 0; client < 8; client++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 25; i++ {
+				if _, err := d.NextRandomPost(fmt.Sprintf("client-%d", client), RandomWeights{Unseen: 2}, nil); err != nil {
+					errs <- err
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	failed := 0
+	for err := range errs {
+		if failed == 0 {
+			t.Errorf("NextRandomPost: %s", err)
+		}
+		failed++
+	}
+	if failed > 0 {
+		t.Errorf("%d of %d calls failed", failed, 8*25)
+	}
+}
+
+func TestNextPostInOrderWrapsAround(t *testing.T) {
+	d := newTestDatastore(t)
+	base := time.Date(2019, 6, 1, 12, 0, 0, 0, time.UTC)
+	// Saved out of order, with the last two taken at the same time.
+	var posts []*Post
+	for i, post := range []struct {
+		album  string
+		offset time.Duration
+	}{
+		{"Summer", 3 * time.Hour},
+		{"Winter", time.Hour},
+		{"Summer", 0},
+		{"Summer", 2 * time.Hour},
+		{"Winter", 2 * time.Hour},
+	} {
+		posts = append(posts, &Post{Title: fmt.Sprint(i), Author: "tester", ImageFile: fmt.Sprintf("%d.png", i), Album: post.album, PostTime: base.Add(post.offset), Tags: []string{}})
+	}
+	ids, err := d.SavePosts(posts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	walk := func(filters []interface{}, steps int) []int64 {
+		var shown []int64
+		var afterTime time.Time
+		var afterId int64
+		for i := 0; i < steps; i++ {
+			id, err := d.NextPostInOrder(afterTime, afterId, filters)
+			if err != nil {
+				t.Fatal(err)
+			}
+			post, err := d.FindPost(int(id))
+			if err != nil {
+				t.Fatal(err)
+			}
+			shown = append(shown, id)
+			afterTime, afterId = post.PostTime, post.Id
+		}
+		return shown
+	}
+	if got, want := walk(nil, 7), []int64{ids[2], ids[1], ids[3], ids[4], ids[0], ids[2], ids[1]}; fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("posts in order = %v, want %v", got, want)
+	}
+	summer := []interface{}{AlbumFilter{Matching: "Summer"}}
+	if got, want := walk(summer, 4), []int64{ids[2], ids[3], ids[0], ids[2]}; fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("Summer posts in order = %v, want %v", got, want)
+	}
+	if _, err := d.NextPostInOrder(base, ids[0], []interface{}{AlbumFilter{Matching: "Autumn"}}); !errors.Is(err, ErrNoPosts) {
+		t.Errorf("with no matching posts = %v, want ErrNoPosts", err)
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/mattgibbs/photopost/requestid"
+	"log/slog"
+	"net/http"
+	"runtime/debug"
+)
+
+type problem struct {
+	Type      string `json:"type"`
+	Title     string `json:"title"`
+	Status    int    `json:"status"`
+	Detail    string `json:"detail,omitempty"`
+	Instance  string `json:"instance,omitempty"`
+	RequestID string `json:"requestId,omitempty"`
+}
+
+// Recoverer turns a panic in inner into a 500 application/problem+json
+// response instead of letting it take down the connection. If inner had
+// already started its response, there is no changing its status, so the
+// connection is aborted instead to show the client the response is broken.
+func Recoverer(inner http.Handler, name string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rec := &responseRecorder{ResponseWriter: w}
+		defer func() {
+			panicked := recover()
+			if panicked == nil {
+				return
+			}
+			if panicked == http.ErrAbortHandler {
+				panic(panicked)
+			}
+			slog.ErrorContext(r.Context(), "Recovered from panic", "route", name, "panic", panicked, "stack", string(debug.Stack()))
+			if rec.status != 0 {
+				panic(http.ErrAbortHandler)
+			}
+			writeProblem(w, r, http.StatusInternalServerError, "An unexpected error occurred while handling the request.")
+		}()
+		inner.ServeHTTP(rec, r)
+	})
+}
+
+func writeProblem(w http.ResponseWriter, r *http.Request, status int, detail string) {
+	p := problem{
+		Type:      "about:blank",
+		Title:     http.StatusText(status),
+		Status:    status,
+		Detail:    detail,
+		Instance:  r.URL.Path,
+		RequestID: requestid.Get(r),
+	}
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(p); err != nil {
+		slog.ErrorContext(r.Context(), "Error while writing problem response", "err", err)
+	}
+}
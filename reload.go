@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"github.com/fsnotify/fsnotify"
+	"github.com/mattgibbs/photopost/config"
+	"log/slog"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
+)
+
+// reloadDebounce collapses the burst of events an editor produces when it
+// saves a file into a single reload.
+const reloadDebounce = 500 * time.Millisecond
+
+// watchConfig reloads the configuration on SIGHUP, and whenever the config
+// file changes, until ctx is done.
+func watchConfig(ctx context.Context, args []string, configFile string) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	var fileEvents <-chan fsnotify.Event
+	var fileErrors <-chan error
+	if configFile != "" {
+		watcher, err := fsnotify.NewWatcher()
+		if err != nil {
+			slog.Error("Could not watch config file, reload with SIGHUP instead", "err", err)
+		} else {
+			defer watcher.Close()
+			// Watch the directory, since many editors replace the file
+			// rather than writing to it.
+			if err := watcher.Add(filepath.Dir(configFile)); err != nil {
+				slog.Error("Could not watch config file, reload with SIGHUP instead", "file", configFile, "err", err)
+			}
+			fileEvents = watcher.Events
+			fileErrors = watcher.Errors
+		}
+	}
+
+	var debounce <-chan time.Time
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			slog.Info("Received SIGHUP, reloading configuration")
+			reloadConfig(args)
+		case event := <-fileEvents:
+			if filepath.Clean(event.Name) == filepath.Clean(configFile) && event.Has(fsnotify.Write|fsnotify.Create|fsnotify.Rename) {
+				debounce = time.After(reloadDebounce)
+			}
+		case err := <-fileErrors:
+			slog.Error("Error while watching config file", "err", err)
+		case <-debounce:
+			debounce = nil
+			slog.Info("Config file changed, reloading configuration", "file", configFile)
+			reloadConfig(args)
+		}
+	}
+}
+
+// reloadConfig loads the configuration again and swaps it in. An invalid
+// configuration is rejected as a whole and the running one is kept.
+func reloadConfig(args []string) {
+	next, _, err := config.LoadWithFile(args)
+	if err != nil {
+		slog.Error("Configuration reload failed, keeping the current configuration", "err", err)
+		return
+	}
+	current := configuration.Get()
+	applied, restart := config.Diff(current, next)
+	if len(restart) > 0 {
+		slog.Warn("Some changed settings only take effect after a restart", "settings", restart)
+		config.KeepRestartSettings(current, next)
+	}
+	if len(applied) == 0 {
+		slog.Info("Configuration reloaded, nothing to apply")
+		return
+	}
+	if err := setupLogging(os.Stderr, next.LogLevel, next.LogFormat); err != nil {
+		slog.Error("Configuration reload failed, keeping the current configuration", "err", err)
+		return
+	}
+	configuration.Set(next)
+	slog.Info("Configuration reloaded", "changed", applied)
+}
@@ -0,0 +1,47 @@
+package requestid
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+)
+
+const Header = "X-Request-ID"
+
+type contextKey struct{}
+
+// New returns a random 16 byte hex encoded request ID.
+func New() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "unknown"
+	}
+	return hex.EncodeToString(b)
+}
+
+// FromContext returns the request ID stored in ctx, or an empty string.
+func FromContext(ctx context.Context) string {
+	id, _ := ctx.Value(contextKey{}).(string)
+	return id
+}
+
+// Get returns the request ID for r.
+func Get(r *http.Request) string {
+	return FromContext(r.Context())
+}
+
+// Middleware reuses the X-Request-ID header sent by the client (or a proxy in
+// front of us) or generates a new one, stores it in the request context and
+// echoes it back in the response.
+func Middleware(inner http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(Header)
+		if id == "" || len(id) > 128 {
+			id = New()
+		}
+		w.Header().Set(Header, id)
+		ctx := context.WithValue(r.Context(), contextKey{}, id)
+		inner.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
@@ -2,7 +2,10 @@ package main
 
 import (
 	"github.com/gorilla/mux"
+	"github.com/mattgibbs/photopost/metrics"
+	"github.com/mattgibbs/photopost/requestid"
 	"net/http"
+	"strings"
 )
 
 const (
@@ -15,20 +18,35 @@ func NewRouter() *mux.Router {
 		Route{
 			"Index", "GET", "/", Index,
 		},
+		Route{
+			"Healthz", "GET", "/healthz", healthController.Healthz,
+		},
+		Route{
+			"Readyz", "GET", "/readyz", healthController.Readyz,
+		},
+		Route{
+			"Version", "GET", "/version", healthController.Version,
+		},
 		Route{
 			"PostRandom", "GET", "/posts/random", postController.PostRandom,
 		},
 		Route{
-			"PostShow", "GET", "/posts/{postid}", postController.PostShow,
+			"PostMemories", "GET", "/posts/memories", postController.PostMemories,
 		},
 		Route{
-			"PostUpdate", "POST", "/posts/{postid}", postController.PostUpdate,
+			"PostShow", "GET", "/posts/{postid:[0-9]+}", postController.PostShow,
 		},
 		Route{
-			"PostRotate", "POST", "/posts/{postid}/rotate", postController.PostRotate,
+			"PostUpdate", "POST", "/posts/{postid:[0-9]+}", postController.PostUpdate,
 		},
 		Route{
-			"PostDelete", "DELETE", "/posts/{postid}", postController.PostDelete,
+			"PostRotate", "POST", "/posts/{postid:[0-9]+}/rotate", postController.PostRotate,
+		},
+		Route{
+			"PostSimilar", "GET", "/posts/{postid:[0-9]+}/similar", postController.PostSimilar,
+		},
+		Route{
+			"PostDelete", "DELETE", "/posts/{postid:[0-9]+}", postController.PostDelete,
 		},
 		Route{
 			"PostCreate", "POST", "/posts", postController.PostCreate,
@@ -36,16 +54,71 @@ func NewRouter() *mux.Router {
 		Route{
 			"PostIndex", "GET", "/posts", postController.PostIndex,
 		},
+		Route{
+			"PostBatchCreate", "POST", "/posts/batch", postController.PostBatchCreate,
+		},
+		Route{
+			"DuplicatesReport", "GET", "/admin/duplicates", RequireAdmin(postController.DuplicatesReport),
+		},
+		Route{
+			"Export", "GET", "/admin/export", RequireAdmin(postController.ExportHandler),
+		},
+		Route{
+			"Backup", "POST", "/admin/backup", RequireAdmin(backupController.BackupHandler),
+		},
+		Route{
+			"DeviceIndex", "GET", "/admin/devices", RequireAdmin(deviceController.DeviceIndex),
+		},
+		Route{
+			"DeviceCreate", "POST", "/admin/devices", RequireAdmin(deviceController.DeviceCreate),
+		},
+		Route{
+			"DeviceShow", "GET", "/admin/devices/{id:[0-9]+}", RequireAdmin(deviceController.DeviceShow),
+		},
+		Route{
+			"DeviceUpdate", "POST", "/admin/devices/{id:[0-9]+}", RequireAdmin(deviceController.DeviceUpdate),
+		},
+		Route{
+			"DeviceDelete", "DELETE", "/admin/devices/{id:[0-9]+}", RequireAdmin(deviceController.DeviceDelete),
+		},
+		Route{
+			"DevicePair", "POST", "/admin/devices/{id:[0-9]+}/pair", RequireAdmin(deviceController.DevicePair),
+		},
+		Route{
+			"DeviceNext", "GET", "/devices/{id:[0-9]+}/next", deviceController.DeviceNext,
+		},
+		Route{
+			"TusCollectionOptions", "OPTIONS", "/posts/uploads", tusController.TusOptions,
+		},
+		Route{
+			"TusCreate", "POST", "/posts/uploads", tusController.TusCreate,
+		},
+		Route{
+			"TusOptions", "OPTIONS", "/posts/uploads/{uploadid}", tusController.TusOptions,
+		},
+		Route{
+			"TusHead", "HEAD", "/posts/uploads/{uploadid}", tusController.TusHead,
+		},
+		Route{
+			"TusPatch", "PATCH", "/posts/uploads/{uploadid}", tusController.TusPatch,
+		},
+		Route{
+			"TusDelete", "DELETE", "/posts/uploads/{uploadid}", tusController.TusDelete,
+		},
 	}
 
 	router := mux.NewRouter().StrictSlash(true)
 
+	router.Methods("GET").Path("/metrics").Handler(metrics.Handler())
 	router.PathPrefix(VIEW_DIR).Handler(http.StripPrefix(VIEW_DIR, http.FileServer(http.Dir("."+VIEW_DIR))))
-	router.PathPrefix(UPLOAD_DIR).Handler(http.StripPrefix(UPLOAD_DIR, http.FileServer(http.Dir("."+UPLOAD_DIR))))
+	router.PathPrefix(UPLOAD_DIR).Handler(http.StripPrefix(UPLOAD_DIR, hideDotFiles(http.FileServer(http.Dir("."+UPLOAD_DIR)))))
 	for _, route := range routes {
 		var handler http.Handler
 		handler = route.HandlerFunc
+		handler = Recoverer(handler, route.Name)
+		handler = metrics.InstrumentRoute(handler, route.Name)
 		handler = Logger(handler, route.Name)
+		handler = requestid.Middleware(handler)
 		router.Methods(route.Method).
 			Path(route.Pattern).
 			Name(route.Name).
@@ -53,3 +126,17 @@ func NewRouter() *mux.Router {
 	}
 	return router
 }
+
+// hideDotFiles keeps temporary and partial uploads, which are stored in
+// hidden files and directories under the uploads directory, from being served.
+func hideDotFiles(inner http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, segment := range strings.Split(r.URL.Path, "/") {
+			if strings.HasPrefix(segment, ".") {
+				http.NotFound(w, r)
+				return
+			}
+		}
+		inner.ServeHTTP(w, r)
+	})
+}
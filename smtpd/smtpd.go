@@ -0,0 +1,424 @@
+// Package smtpd is a minimal SMTP server (RFC 5321) for receiving mail that
+// is handed straight to a function. It does not relay, authenticate or
+// queue, so it should only be reachable by the mail server that forwards to
+// it, or on a trusted network.
+package smtpd
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/mail"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Envelope is one message, as it was given to the server.
+type Envelope struct {
+	RemoteAddr string
+	From       string
+	To         []string
+	Data       []byte
+}
+
+// Error is an SMTP reply a Handler or recipient check can return to choose
+// the code that is sent; other errors are sent as 451 (try again later).
+type Error struct {
+	Code    int
+	Message string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%d %s", e.Code, e.Message)
+}
+
+// Server receives mail on Addr and passes each message to Handler.
+type Server struct {
+	Addr     string
+	Hostname string
+	// MaxSize is the largest message accepted, in bytes.
+	MaxSize int64
+	// AcceptRecipient, if set, decides whether mail for an address is
+	// accepted at all.
+	AcceptRecipient func(address string) error
+	Handler         func(ctx context.Context, envelope *Envelope) error
+	// Timeout is how long a client may take over each command, and over
+	// sending a message.
+	Timeout time.Duration
+
+	mu       sync.Mutex
+	listener net.Listener
+	conns    sync.WaitGroup
+	sessions map[*session]bool
+	closing  bool
+}
+
+// ListenAndServe accepts connections until ctx is done, then waits for the
+// open ones to finish.
+func (s *Server) ListenAndServe(ctx context.Context) error {
+	l, err := net.Listen("tcp", s.Addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(ctx, l)
+}
+
+// Serve accepts connections on l until ctx is done. Clients that are
+// waiting between commands are then sent 421 and disconnected, and those
+// in the middle of a message are let finish it.
+func (s *Server) Serve(ctx context.Context, l net.Listener) error {
+	s.mu.Lock()
+	s.listener = l
+	s.sessions = map[*session]bool{}
+	s.closing = false
+	s.mu.Unlock()
+	stop := context.AfterFunc(ctx, func() {
+		l.Close()
+		s.closeSessions()
+	})
+	defer stop()
+	defer s.conns.Wait()
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				time.Sleep(100 * time.Millisecond)
+				continue
+			}
+			return err
+		}
+		s.conns.Add(1)
+		go func() {
+			defer s.conns.Done()
+			s.serveConn(ctx, conn)
+		}()
+	}
+}
+
+// ListenAddr is the address the server is listening on, once it is.
+func (s *Server) ListenAddr() net.Addr {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.listener == nil {
+		return nil
+	}
+	return s.listener.Addr()
+}
+
+// closeSessions ends the open sessions, and any that start after it, with a
+// 421 reply. See session.close.
+func (s *Server) closeSessions() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closing = true
+	for ss := range s.sessions {
+		ss.close()
+	}
+}
+
+type session struct {
+	s        *Server
+	conn     net.Conn
+	r        *bufio.Reader
+	w        *bufio.Writer
+	helo     bool
+	envelope *Envelope
+
+	// mu guards idle, which is whether the session is waiting for a
+	// command, and closing, so that close cannot cut short the read of a
+	// message or have its deadline put back.
+	mu      sync.Mutex
+	idle    bool
+	closing bool
+}
+
+func (s *Server) serveConn(ctx context.Context, conn net.Conn) {
+	defer conn.Close()
+	ss := &session{s: s, conn: conn, r: bufio.NewReader(conn), w: bufio.NewWriter(conn)}
+	s.mu.Lock()
+	s.sessions[ss] = true
+	if s.closing {
+		ss.close()
+	}
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.sessions, ss)
+		s.mu.Unlock()
+	}()
+
+	ss.reply(220, fmt.Sprintf("%s ESMTP photopost", s.Hostname))
+	for {
+		ss.awaitCommand()
+		line, err := ss.readLine()
+		ss.busy()
+		if err != nil {
+			if ss.shuttingDown() {
+				ss.shutdown()
+				return
+			}
+			if !errors.Is(err, io.EOF) {
+				slog.Debug("SMTP connection closed", "remote", conn.RemoteAddr().String(), "err", err)
+			}
+			return
+		}
+		verb, arg, _ := strings.Cut(line, " ")
+		switch strings.ToUpper(verb) {
+		case "HELO":
+			ss.helo = true
+			ss.envelope = nil
+			ss.reply(250, s.Hostname)
+		case "EHLO":
+			ss.helo = true
+			ss.envelope = nil
+			ss.reply(250, s.Hostname, "8BITMIME", "PIPELINING", fmt.Sprintf("SIZE %d", s.MaxSize))
+		case "MAIL":
+			ss.mail(arg)
+		case "RCPT":
+			ss.rcpt(arg)
+		case "DATA":
+			if ss.data(ctx) != nil {
+				return
+			}
+		case "RSET":
+			ss.envelope = nil
+			ss.reply(250, "OK")
+		case "NOOP":
+			ss.reply(250, "OK")
+		case "VRFY":
+			ss.reply(252, "Cannot verify addresses")
+		case "QUIT":
+			ss.reply(221, "Bye")
+			return
+		default:
+			ss.reply(500, "Command not recognized")
+		}
+		if ss.shuttingDown() {
+			ss.shutdown()
+			return
+		}
+	}
+}
+
+// shutdownGrace is how long a client that is cut off by a shutdown is given
+// to take its 421 reply.
+const shutdownGrace = time.Second
+
+func (ss *session) deadline() {
+	if ss.s.Timeout > 0 {
+		ss.conn.SetDeadline(time.Now().Add(ss.s.Timeout))
+	}
+}
+
+// awaitCommand sets the deadline for the next command, which is now if the
+// server is shutting down.
+func (ss *session) awaitCommand() {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	ss.idle = true
+	if ss.closing {
+		ss.conn.SetReadDeadline(time.Now())
+		return
+	}
+	ss.deadline()
+}
+
+func (ss *session) busy() {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	ss.idle = false
+}
+
+// close ends the session once it is done with its current command, or now
+// if it is waiting for the next one.
+func (ss *session) close() {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	ss.closing = true
+	if ss.idle {
+		ss.conn.SetReadDeadline(time.Now())
+	}
+}
+
+func (ss *session) shuttingDown() bool {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	return ss.closing
+}
+
+func (ss *session) shutdown() {
+	ss.conn.SetWriteDeadline(time.Now().Add(shutdownGrace))
+	ss.reply(421, "Shutting down")
+}
+
+// readLine reads a command line, which may be at most 512 bytes long.
+func (ss *session) readLine() (string, error) {
+	line, err := ss.r.ReadSlice('\n')
+	if errors.Is(err, bufio.ErrBufferFull) || len(line) > 512 {
+		ss.reply(500, "Line too long")
+		for errors.Is(err, bufio.ErrBufferFull) {
+			_, err = ss.r.ReadSlice('\n')
+		}
+		return "", errors.New("line too long")
+	}
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(line), "\r\n"), nil
+}
+
+func (ss *session) reply(code int, lines ...string) {
+	for i, line := range lines {
+		sep := " "
+		if i < len(lines)-1 {
+			sep = "-"
+		}
+		fmt.Fprintf(ss.w, "%d%s%s\r\n", code, sep, line)
+	}
+	ss.w.Flush()
+}
+
+func (ss *session) replyError(err error) {
+	var smtpErr *Error
+	if errors.As(err, &smtpErr) {
+		ss.reply(smtpErr.Code, smtpErr.Message)
+		return
+	}
+	ss.reply(451, "Temporary failure, try again later")
+}
+
+// pathArg reads the address from "FROM:<a@b> SIZE=123" or "TO:<a@b>". The
+// null sender <> is allowed.
+func pathArg(arg string, prefix string) (string, map[string]string, bool) {
+	if len(arg) < len(prefix) || !strings.EqualFold(arg[:len(prefix)], prefix) {
+		return "", nil, false
+	}
+	rest := strings.TrimSpace(arg[len(prefix):])
+	if !strings.HasPrefix(rest, "<") {
+		return "", nil, false
+	}
+	end := strings.IndexByte(rest, '>')
+	if end < 0 {
+		return "", nil, false
+	}
+	params := map[string]string{}
+	for _, param := range strings.Fields(rest[end+1:]) {
+		key, value, _ := strings.Cut(param, "=")
+		params[strings.ToUpper(key)] = value
+	}
+	address := rest[1:end]
+	if address != "" {
+		if _, err := mail.ParseAddress(address); err != nil {
+			return "", nil, false
+		}
+	}
+	return address, params, true
+}
+
+func (ss *session) mail(arg string) {
+	if !ss.helo {
+		ss.reply(503, "Say HELO first")
+		return
+	}
+	if ss.envelope != nil {
+		ss.reply(503, "Sender already given")
+		return
+	}
+	from, params, ok := pathArg(arg, "FROM:")
+	if !ok {
+		ss.reply(501, "Syntax: MAIL FROM:<address>")
+		return
+	}
+	if size, err := strconv.ParseInt(params["SIZE"], 10, 64); err == nil && ss.s.MaxSize > 0 && size > ss.s.MaxSize {
+		ss.reply(552, "Message too large")
+		return
+	}
+	ss.envelope = &Envelope{RemoteAddr: ss.conn.RemoteAddr().String(), From: from}
+	ss.reply(250, "OK")
+}
+
+func (ss *session) rcpt(arg string) {
+	if ss.envelope == nil {
+		ss.reply(503, "Need MAIL first")
+		return
+	}
+	to, _, ok := pathArg(arg, "TO:")
+	if !ok || to == "" {
+		ss.reply(501, "Syntax: RCPT TO:<address>")
+		return
+	}
+	if len(ss.envelope.To) >= 100 {
+		ss.reply(452, "Too many recipients")
+		return
+	}
+	if ss.s.AcceptRecipient != nil {
+		if err := ss.s.AcceptRecipient(to); err != nil {
+			ss.replyError(err)
+			return
+		}
+	}
+	ss.envelope.To = append(ss.envelope.To, to)
+	ss.reply(250, "OK")
+}
+
+// data reads a message, undoing dot stuffing, and hands it to the handler.
+// An error means the connection can no longer be used.
+func (ss *session) data(ctx context.Context) error {
+	if ss.envelope == nil || len(ss.envelope.To) == 0 {
+		ss.reply(503, "Need RCPT first")
+		return nil
+	}
+	ss.reply(354, "End data with <CR><LF>.<CR><LF>")
+	ss.deadline()
+	var data []byte
+	tooLarge := false
+	lineStart := true
+	for {
+		// Read in pieces so that a line with no end cannot use up memory.
+		chunk, err := ss.r.ReadSlice('\n')
+		if err != nil && !errors.Is(err, bufio.ErrBufferFull) {
+			return err
+		}
+		if lineStart {
+			if string(chunk) == ".\r\n" || string(chunk) == ".\n" {
+				break
+			}
+			if len(chunk) > 0 && chunk[0] == '.' {
+				chunk = chunk[1:]
+			}
+		}
+		lineStart = err == nil
+		if tooLarge {
+			continue
+		}
+		data = append(data, chunk...)
+		if ss.s.MaxSize > 0 && int64(len(data)) > ss.s.MaxSize {
+			tooLarge = true
+			data = nil
+		}
+	}
+	envelope := ss.envelope
+	ss.envelope = nil
+	if tooLarge {
+		ss.reply(552, "Message too large")
+		return nil
+	}
+	envelope.Data = data
+	if err := ss.s.Handler(ctx, envelope); err != nil {
+		slog.InfoContext(ctx, "Rejected mail", "from", envelope.From, "remote", envelope.RemoteAddr, "err", err)
+		ss.replyError(err)
+		return nil
+	}
+	ss.reply(250, "OK: message accepted")
+	return nil
+}
@@ -0,0 +1,184 @@
+package smtpd
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"strings"
+	"testing"
+	"time"
+)
+
+// startServer serves s on a loopback port until the test ends, and returns
+// its address and a function that stops it and waits for it to return.
+func startServer(t *testing.T, s *Server) (string, func()) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- s.Serve(ctx, l) }()
+	stop := func() {
+		cancel()
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Errorf("Serve: %s", err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("Serve did not return after its context was cancelled")
+		}
+	}
+	t.Cleanup(func() {
+		if ctx.Err() == nil {
+			stop()
+		}
+	})
+	for s.ListenAddr() == nil {
+		time.Sleep(time.Millisecond)
+	}
+	return s.ListenAddr().String(), stop
+}
+
+// send sends body from one address to another, and returns the error from
+// the first command that fails.
+func send(addr string, from string, to string, body string) error {
+	c, err := smtp.Dial(addr)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	if err := c.Mail(from); err != nil {
+		return err
+	}
+	if err := c.Rcpt(to); err != nil {
+		return err
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write([]byte(body)); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+func replyCode(err error) int {
+	var protoErr *textproto.Error
+	if errors.As(err, &protoErr) {
+		return protoErr.Code
+	}
+	return 0
+}
+
+func TestServerDeliversMessage(t *testing.T) {
+	received := make(chan *Envelope, 1)
+	addr, _ := startServer(t, &Server{Hostname: "test", MaxSize: 1 << 20, Timeout: time.Minute,
+		Handler: func(ctx context.Context, envelope *Envelope) error {
+			received <- envelope
+			return nil
+		},
+	})
+	// The client stuffs the line that starts with a dot, and the server
+	// must take it out again.
+	body := "Subject: hello\r\n\r\n.hidden\r\n..two\r\nend\r\n"
+	if err := send(addr, "sender@example.com", "photos@example.com", body); err != nil {
+		t.Fatal(err)
+	}
+	var got *Envelope
+	select {
+	case got = <-received:
+	default:
+		t.Fatal("the handler was not called")
+	}
+	if got.From != "sender@example.com" || len(got.To) != 1 || got.To[0] != "photos@example.com" {
+		t.Errorf("envelope = %s %v", got.From, got.To)
+	}
+	if string(got.Data) != body {
+		t.Errorf("data = %q, want %q", got.Data, body)
+	}
+}
+
+func TestServerRejectsLargeMessage(t *testing.T) {
+	received := make(chan *Envelope, 1)
+	addr, _ := startServer(t, &Server{Hostname: "test", MaxSize: 100, Timeout: time.Minute,
+		Handler: func(ctx context.Context, envelope *Envelope) error {
+			received <- envelope
+			return nil
+		},
+	})
+	err := send(addr, "sender@example.com", "photos@example.com", strings.Repeat("x", 80)+"\r\n"+strings.Repeat("y", 80)+"\r\n")
+	if replyCode(err) != 552 {
+		t.Errorf("sending too much = %v, want 552", err)
+	}
+	if len(received) > 0 {
+		t.Error("the handler was given a message that was too large")
+	}
+}
+
+func TestServerHandlerError(t *testing.T) {
+	addr, _ := startServer(t, &Server{Hostname: "test", Timeout: time.Minute,
+		Handler: func(ctx context.Context, envelope *Envelope) error {
+			if strings.Contains(string(envelope.Data), "bad") {
+				return &Error{Code: 554, Message: "Not posted"}
+			}
+			return errors.New("database is locked")
+		},
+	})
+	if err := send(addr, "sender@example.com", "photos@example.com", "bad\r\n"); replyCode(err) != 554 {
+		t.Errorf("rejected message = %v, want 554", err)
+	}
+	if err := send(addr, "sender@example.com", "photos@example.com", "good\r\n"); replyCode(err) != 451 {
+		t.Errorf("message that failed to be handled = %v, want 451", err)
+	}
+}
+
+func TestServerRejectsRecipient(t *testing.T) {
+	addr, _ := startServer(t, &Server{Hostname: "test", Timeout: time.Minute,
+		AcceptRecipient: func(address string) error {
+			if address != "photos@example.com" {
+				return &Error{Code: 550, Message: "No such mailbox"}
+			}
+			return nil
+		},
+		Handler: func(ctx context.Context, envelope *Envelope) error { return nil },
+	})
+	if err := send(addr, "sender@example.com", "someone@example.com", "hello\r\n"); replyCode(err) != 550 {
+		t.Errorf("RCPT for an unknown mailbox = %v, want 550", err)
+	}
+	if err := send(addr, "sender@example.com", "photos@example.com", "hello\r\n"); err != nil {
+		t.Errorf("RCPT for a known mailbox: %s", err)
+	}
+}
+
+func TestServerShutdownDisconnectsIdleClient(t *testing.T) {
+	addr, stop := startServer(t, &Server{Hostname: "test", Timeout: time.Hour,
+		Handler: func(ctx context.Context, envelope *Envelope) error { return nil },
+	})
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	r := bufio.NewReader(conn)
+	if line, err := r.ReadString('\n'); err != nil || !strings.HasPrefix(line, "220 ") {
+		t.Fatalf("greeting = %q, %v", line, err)
+	}
+
+	// The client says nothing more, which must not hold up the shutdown
+	// for the hour long Timeout.
+	stop()
+	if line, err := r.ReadString('\n'); err != nil || !strings.HasPrefix(line, "421 ") {
+		t.Errorf("reply on shutdown = %q, %v, want 421", line, err)
+	}
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+)
+
+// Background goroutines (reloaders, schedulers, pollers) are started with
+// startWorker and are stopped after the HTTP server has drained, but before
+// the datastore is closed.
+var workers sync.WaitGroup
+var workerCtx, cancelWorkers = context.WithCancel(context.Background())
+
+func startWorker(name string, run func(ctx context.Context)) {
+	workers.Add(1)
+	go func() {
+		defer workers.Done()
+		slog.Info("Starting background worker", "worker", name)
+		run(workerCtx)
+		slog.Info("Background worker stopped", "worker", name)
+	}()
+}
+
+func stopWorkers() {
+	cancelWorkers()
+	workers.Wait()
+}